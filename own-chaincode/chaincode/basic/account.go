@@ -0,0 +1,413 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ======================== Structs ==========================
+
+const (
+	accountObjectType = "Account"
+	ownerIndex        = "owner~account"
+	entryIndex        = "acctentry~account~seq~hash"
+
+	accountActive = "ACTIVE"
+
+	entryCredit = "CREDIT"
+	entryDebit  = "DEBIT"
+)
+
+// cashRoles may take cash deposits and withdrawals at a branch
+var cashRoles = []string{"SuperAdmin", "Admin", "Manager", "Teller"}
+
+// Account is a customer deposit account. Balance is held in minor units
+// (cents) so that every posting is exact integer arithmetic. HeldAmount is the
+// total of active holds; debits may only use Balance - HeldAmount.
+// EntryCount numbers the account's postings in the order they were made.
+// OwnerID is the primary holder; JointOwners share the account under
+// SigningRule (see jointaccount.go). BankMSP is the organisation whose bank
+// holds the account.
+type Account struct {
+	ID              string   `json:"id"`
+	OwnerID         string   `json:"ownerId"`
+	JointOwners     []string `json:"jointOwners,omitempty" metadata:",optional"`
+	SigningRule     string   `json:"signingRule,omitempty" metadata:",optional"`
+	RequiredSigners int      `json:"requiredSigners,omitempty" metadata:",optional"`
+	Product         string   `json:"product"`
+	BankBranch      string   `json:"bankBranch"`
+	BankMSP         string   `json:"bankMsp,omitempty" metadata:",optional"`
+	Balance         int64    `json:"balance"`
+	HeldAmount      int64    `json:"heldAmount"`
+	EntryCount      int64    `json:"entryCount"`
+	Status          string   `json:"status"`
+	OpenedAt        string   `json:"openedAt"`
+	CreatedBy       string   `json:"createdBy"`
+}
+
+// ======================== Account Helpers ========================
+
+func getAccount(ctx contractapi.TransactionContextInterface, id string) (*Account, error) {
+	if id == "" {
+		return nil, fmt.Errorf("account id required")
+	}
+	key, err := makeKey(ctx, accountObjectType, id)
+	if err != nil {
+		return nil, err
+	}
+	var a Account
+	found, err := getJSON(ctx, key, &a)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("account %s not found", id)
+	}
+	return &a, nil
+}
+
+func putAccount(ctx contractapi.TransactionContextInterface, a *Account) error {
+	key, err := makeKey(ctx, accountObjectType, a.ID)
+	if err != nil {
+		return err
+	}
+	return putJSON(ctx, key, a)
+}
+
+// requireAccountBank refuses callers from an organisation other than the
+// bank holding an account. Accounts opened before BankMSP was recorded
+// predate multi-bank use and are not scoped.
+func requireAccountBank(ctx contractapi.TransactionContextInterface, a *Account) error {
+	if a.BankMSP == "" {
+		return nil
+	}
+	msp, err := getClientMSP(ctx)
+	if err != nil {
+		return err
+	}
+	if msp != a.BankMSP {
+		return fmt.Errorf("access denied: account %s is held at %s", a.ID, a.BankMSP)
+	}
+	return nil
+}
+
+// requireSameBank refuses a payment between accounts held at different
+// banks, which must go through InitiateInterbankTransfer
+func requireSameBank(from *Account, to *Account) error {
+	if from.BankMSP != "" && to.BankMSP != "" && from.BankMSP != to.BankMSP {
+		return fmt.Errorf("account %s is held at %s: use InitiateInterbankTransfer", to.ID, to.BankMSP)
+	}
+	return nil
+}
+
+// requireAccountAccess allows staff of the account's bank, or a customer whose
+// certificate CN is an account owner
+func requireAccountAccess(ctx contractapi.TransactionContextInterface, a *Account) error {
+	if isStaff(ctx) {
+		return requireAccountBank(ctx, a)
+	}
+	cn, err := getCallerCN(ctx)
+	if err != nil {
+		return err
+	}
+	if !isAccountOwner(a, cn) {
+		return fmt.Errorf("access denied: %s is not an owner of account %s", cn, a.ID)
+	}
+	return nil
+}
+
+// postToAccount applies a signed amount to the account balance, records the
+// history entry, books the customer deposits GL line and saves the account.
+// Debits may not exceed the available balance, i.e. they may neither overdraw
+// the account nor use held funds. Callers post the offsetting GL lines.
+func postToAccount(ctx contractapi.TransactionContextInterface, a *Account, amount int64, narrative string) error {
+	_, err := postEntry(ctx, a, amount, narrative, "")
+	return err
+}
+
+// postEntry is postToAccount returning the history record it wrote.
+// reversalOf links a reversing entry to the record it offsets.
+func postEntry(
+	ctx contractapi.TransactionContextInterface,
+	a *Account, amount int64, narrative string, reversalOf string,
+) (*TransactionHistory, error) {
+	if amount == 0 {
+		return nil, fmt.Errorf("posting amount must be non-zero")
+	}
+	if a.Status != accountActive {
+		return nil, fmt.Errorf("account %s is %s", a.ID, a.Status)
+	}
+
+	entryType := entryCredit
+	abs := amount
+	if amount < 0 {
+		entryType = entryDebit
+		abs = -amount
+		available, err := availableBalance(ctx, a)
+		if err != nil {
+			return nil, err
+		}
+		if available < abs {
+			return nil, fmt.Errorf("insufficient funds in account %s", a.ID)
+		}
+	}
+
+	a.Balance += amount
+	record, err := recordHistory(ctx, a.ID, entryType, abs, narrative, reversalOf)
+	if err != nil {
+		return nil, err
+	}
+	a.EntryCount++
+	indexKey, err := makeKey(ctx, entryIndex, a.ID, fmt.Sprintf("%012d", a.EntryCount), record.HistoryHash)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(indexKey, []byte{0x00}); err != nil {
+		return nil, err
+	}
+	// Customer balances are liabilities: crediting the customer credits the GL
+	if err := glPost(ctx, glCustomerDeposits, -amount, narrative); err != nil {
+		return nil, err
+	}
+	return record, putAccount(ctx, a)
+}
+
+// depositCash, withdrawCash and transferFunds each post one reversible
+// operation, see ReverseTransaction
+func depositCash(ctx contractapi.TransactionContextInterface, a *Account, amount int64) error {
+	return reversibleOperation(ctx, func() error {
+		if err := postToAccount(ctx, a, amount, "Cash deposit"); err != nil {
+			return err
+		}
+		return glDebit(ctx, glCash, amount, "Cash deposit")
+	})
+}
+
+func withdrawCash(ctx contractapi.TransactionContextInterface, a *Account, amount int64) error {
+	return reversibleOperation(ctx, func() error {
+		if err := postToAccount(ctx, a, -amount, "Cash withdrawal"); err != nil {
+			return err
+		}
+		if err := glCredit(ctx, glCash, amount, "Cash withdrawal"); err != nil {
+			return err
+		}
+		return chargeFee(ctx, a, opWithdrawal, channelBranch, amount)
+	})
+}
+
+// transferFunds moves amount between accounts and charges the sender the
+// transfer fee of the channel the transfer was requested through
+func transferFunds(ctx contractapi.TransactionContextInterface, from *Account, to *Account, amount int64, channel string) error {
+	return reversibleOperation(ctx, func() error {
+		if err := postToAccount(ctx, from, -amount, "Transfer to "+to.ID); err != nil {
+			return err
+		}
+		if err := postToAccount(ctx, to, amount, "Transfer from "+from.ID); err != nil {
+			return err
+		}
+		return chargeFee(ctx, from, opTransfer, channel, amount)
+	})
+}
+
+// ======================== Account Methods ========================
+
+// Open account for an existing user
+func (s *SmartContract) OpenAccount(ctx contractapi.TransactionContextInterface, id string, ownerID string, product string) (*Account, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+	if id == "" || ownerID == "" || product == "" {
+		return nil, fmt.Errorf("id, ownerId and product required")
+	}
+
+	owner, err := s.GetUser(ctx, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	if !owner.IsActive {
+		return nil, fmt.Errorf("user %s is not active", ownerID)
+	}
+
+	if _, err := getAccount(ctx, id); err == nil {
+		return nil, fmt.Errorf("account %s already exists", id)
+	}
+
+	openedAt, err := getBusinessDate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	msp, err := getClientMSP(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cn, _ := getCallerCN(ctx)
+
+	account := &Account{
+		ID:         id,
+		OwnerID:    ownerID,
+		Product:    product,
+		BankBranch: owner.BankBranch,
+		BankMSP:    msp,
+		Status:     accountActive,
+		OpenedAt:   openedAt,
+		CreatedBy:  cn,
+	}
+	if err := putAccount(ctx, account); err != nil {
+		return nil, err
+	}
+
+	indexKey, err := makeKey(ctx, ownerIndex, ownerID, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(indexKey, []byte{0x00}); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// Fetch account
+func (s *SmartContract) GetAccount(ctx contractapi.TransactionContextInterface, id string) (*Account, error) {
+	a, err := getAccount(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountAccess(ctx, a); err != nil {
+		return nil, err
+	}
+	if err := releaseExpiredHolds(ctx, a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// List accounts held by a user
+func (s *SmartContract) ListAccountsByOwner(ctx contractapi.TransactionContextInterface, ownerID string) ([]*Account, error) {
+	if ownerID == "" {
+		return nil, fmt.Errorf("ownerId required")
+	}
+	if !isStaff(ctx) {
+		cn, err := getCallerCN(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if cn != ownerID {
+			return nil, fmt.Errorf("access denied: cannot list accounts of %s", ownerID)
+		}
+	}
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(ownerIndex, []string{ownerID})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var list []*Account
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, parts, err := ctx.GetStub().SplitCompositeKey(res.Key)
+		if err != nil || len(parts) != 2 {
+			continue
+		}
+		a, err := getAccount(ctx, parts[1])
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, a)
+	}
+	return list, nil
+}
+
+// Cash deposit at the branch. If a limit routes it to approval nothing is
+// posted yet; a LimitApprovalRequired event carries the pending approval.
+func (s *SmartContract) Deposit(ctx contractapi.TransactionContextInterface, accountID string, amount int64) (*Account, error) {
+
+	if err := requireRole(ctx, cashRoles...); err != nil {
+		return nil, err
+	}
+	if amount <= 0 {
+		return nil, fmt.Errorf("amount must be positive")
+	}
+
+	a, err := getAccount(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountBank(ctx, a); err != nil {
+		return nil, err
+	}
+	queued, err := applyLimits(ctx, &LimitedOperation{Operation: opDeposit, AccountID: a.ID, Amount: amount})
+	if err != nil || queued {
+		return a, err
+	}
+	return a, depositCash(ctx, a, amount)
+}
+
+// Cash withdrawal at the branch, subject to limits like Deposit
+func (s *SmartContract) Withdraw(ctx contractapi.TransactionContextInterface, accountID string, amount int64) (*Account, error) {
+
+	if err := requireRole(ctx, cashRoles...); err != nil {
+		return nil, err
+	}
+	if amount <= 0 {
+		return nil, fmt.Errorf("amount must be positive")
+	}
+
+	a, err := getAccount(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountBank(ctx, a); err != nil {
+		return nil, err
+	}
+	queued, err := applyLimits(ctx, &LimitedOperation{Operation: opWithdrawal, AccountID: a.ID, Amount: amount})
+	if err != nil || queued {
+		return a, err
+	}
+	return a, withdrawCash(ctx, a, amount)
+}
+
+// Transfer between two accounts, subject to limits like Deposit. A customer
+// debit from a joint account that needs more than one signature is not
+// posted yet; it waits in a SigningRequest for the other owners.
+func (s *SmartContract) Transfer(ctx contractapi.TransactionContextInterface, fromAccount string, toAccount string, amount int64) error {
+
+	if amount <= 0 {
+		return fmt.Errorf("amount must be positive")
+	}
+	if fromAccount == toAccount {
+		return fmt.Errorf("cannot transfer to the same account")
+	}
+
+	from, err := getAccount(ctx, fromAccount)
+	if err != nil {
+		return err
+	}
+	if err := requireAccountAccess(ctx, from); err != nil {
+		return err
+	}
+	to, err := getAccount(ctx, toAccount)
+	if err != nil {
+		return err
+	}
+	if err := requireSameBank(from, to); err != nil {
+		return err
+	}
+	if err := checkBeneficiary(ctx, from, to, amount); err != nil {
+		return err
+	}
+	if !isStaff(ctx) && requiredSigners(from) > 1 {
+		_, err := requestSignatures(ctx, from, to, amount)
+		return err
+	}
+	queued, err := applyLimits(ctx, &LimitedOperation{Operation: opTransfer, AccountID: from.ID, ToAccount: to.ID, Amount: amount})
+	if err != nil || queued {
+		return err
+	}
+	return transferFunds(ctx, from, to, amount, feeChannel(ctx))
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ======================== Structs ==========================
+
+const (
+	aliasObjectType         = "Alias"
+	aliasTransientKey       = "alias"
+	aliasSecretTransientKey = "aliasSecret"
+
+	// minAliasSecretLength is the shortest HMAC key accepted for alias hashing
+	minAliasSecretLength = 32
+
+	aliasMobile = "MOBILE"
+	aliasNIC    = "NIC"
+)
+
+// Alias maps a customer's mobile number or NIC to the account that payments
+// addressed to it are credited to. Only AliasHash, an HMAC-SHA256 of the type
+// and the normalised alias under a secret the member banks keep off-chain, is
+// kept: without the secret the registry cannot be searched by hashing every
+// phone number or NIC. An alias is unique: its key is the hash.
+type Alias struct {
+	AliasType    string `json:"aliasType"`
+	AliasHash    string `json:"aliasHash"`
+	UserID       string `json:"userId"`
+	AccountID    string `json:"accountId"`
+	BankMSP      string `json:"bankMsp"`
+	VerifiedBy   string `json:"verifiedBy"`
+	RegisteredAt string `json:"registeredAt"`
+	UpdatedAt    string `json:"updatedAt,omitempty" metadata:",optional"`
+}
+
+// ======================== Alias Helpers ========================
+
+// aliasInput reads the alias and the hashing secret from the transient
+// fields "alias" and "aliasSecret". Neither is a transaction argument, so
+// neither is recorded in the block.
+func aliasInput(ctx contractapi.TransactionContextInterface) (string, []byte, error) {
+	transient, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read transient data: %v", err)
+	}
+	alias := string(transient[aliasTransientKey])
+	if alias == "" {
+		return "", nil, fmt.Errorf("alias required in transient field %q", aliasTransientKey)
+	}
+	secret := transient[aliasSecretTransientKey]
+	if len(secret) < minAliasSecretLength {
+		return "", nil, fmt.Errorf("transient field %q must hold a secret of at least %d bytes", aliasSecretTransientKey, minAliasSecretLength)
+	}
+	return alias, secret, nil
+}
+
+// normaliseAlias validates an alias and reduces it to a canonical form so
+// that differently written copies hash the same. Mobile numbers are E.164
+// (+ and 8 to 15 digits); separators are dropped. NICs are upper-cased.
+func normaliseAlias(aliasType string, alias string) (string, error) {
+	switch aliasType {
+	case aliasMobile:
+		n := strings.NewReplacer(" ", "", "-", "", "(", "", ")", "").Replace(alias)
+		if !strings.HasPrefix(n, "+") || len(n) < 9 || len(n) > 16 || strings.Trim(n[1:], "0123456789") != "" {
+			return "", fmt.Errorf("mobile number must be in international format, e.g. +94771234567")
+		}
+		return n, nil
+	case aliasNIC:
+		n := strings.ToUpper(strings.TrimSpace(alias))
+		if n == "" || strings.Trim(n, "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+			return "", fmt.Errorf("NIC must be letters and digits only")
+		}
+		return n, nil
+	}
+	return "", fmt.Errorf("alias type must be %s or %s", aliasMobile, aliasNIC)
+}
+
+// aliasKey resolves the transient alias (see aliasInput) to its normalised
+// form, its hash and its ledger key
+func aliasKey(ctx contractapi.TransactionContextInterface, aliasType string) (string, string, string, error) {
+	alias, secret, err := aliasInput(ctx)
+	if err != nil {
+		return "", "", "", err
+	}
+	n, err := normaliseAlias(aliasType, alias)
+	if err != nil {
+		return "", "", "", err
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(aliasType + "|" + n))
+	hash := hex.EncodeToString(mac.Sum(nil))
+	key, err := makeKey(ctx, aliasObjectType, aliasType, hash)
+	if err != nil {
+		return "", "", "", err
+	}
+	return n, hash, key, nil
+}
+
+func getAlias(ctx contractapi.TransactionContextInterface, key string) (*Alias, bool, error) {
+	var al Alias
+	found, err := getJSON(ctx, key, &al)
+	if err != nil {
+		return nil, false, err
+	}
+	return &al, found, nil
+}
+
+// ======================== Alias Methods ========================
+
+// Register a verified mobile number or NIC of a user as an alias for one of
+// the user's accounts. A NIC must match the user's KYC record. Registering
+// an alias the user already holds moves it to the new account. The alias and
+// the hashing secret are passed as transient data, as for every alias method.
+func (s *SmartContract) RegisterAlias(
+	ctx contractapi.TransactionContextInterface,
+	aliasType string, userID string, accountID string,
+) (*Alias, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+	n, hash, key, err := aliasKey(ctx, aliasType)
+	if err != nil {
+		return nil, err
+	}
+	u, err := getUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !u.IsActive {
+		return nil, fmt.Errorf("user %s is not active", userID)
+	}
+	if aliasType == aliasNIC && !strings.EqualFold(strings.TrimSpace(u.NationalID), n) {
+		return nil, fmt.Errorf("NIC does not match the national ID of user %s", userID)
+	}
+	a, err := getAccount(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountBank(ctx, a); err != nil {
+		return nil, err
+	}
+	if !isAccountOwner(a, userID) {
+		return nil, fmt.Errorf("%s is not an owner of account %s", userID, a.ID)
+	}
+	if a.Status != accountActive {
+		return nil, fmt.Errorf("account %s is %s", a.ID, a.Status)
+	}
+
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cn, _ := getCallerCN(ctx)
+	al, found, err := getAlias(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		if al.UserID != userID {
+			return nil, fmt.Errorf("this %s alias is already registered to another user", aliasType)
+		}
+		if al.AccountID == a.ID {
+			return nil, fmt.Errorf("this %s alias already points to account %s", aliasType, a.ID)
+		}
+		al.AccountID = a.ID
+		al.BankMSP = a.BankMSP
+		al.VerifiedBy = cn
+		al.UpdatedAt = now.Format(time.RFC3339)
+	} else {
+		al = &Alias{
+			AliasType:    aliasType,
+			AliasHash:    hash,
+			UserID:       userID,
+			AccountID:    a.ID,
+			BankMSP:      a.BankMSP,
+			VerifiedBy:   cn,
+			RegisteredAt: now.Format(time.RFC3339),
+		}
+	}
+	if err := putJSON(ctx, key, al); err != nil {
+		return nil, err
+	}
+	return al, nil
+}
+
+// Look up the account that payments to a mobile number or NIC are credited to
+func (s *SmartContract) ResolveAlias(ctx contractapi.TransactionContextInterface, aliasType string) (*Alias, error) {
+	_, _, key, err := aliasKey(ctx, aliasType)
+	if err != nil {
+		return nil, err
+	}
+	al, found, err := getAlias(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("no account is registered for this %s alias", aliasType)
+	}
+	a, err := getAccount(ctx, al.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	if a.Status != accountActive {
+		return nil, fmt.Errorf("account %s registered for this %s alias is %s", a.ID, aliasType, a.Status)
+	}
+	return al, nil
+}
+
+// Remove an alias, as staff or as the user it is registered to
+func (s *SmartContract) DeregisterAlias(ctx contractapi.TransactionContextInterface, aliasType string) error {
+
+	_, _, key, err := aliasKey(ctx, aliasType)
+	if err != nil {
+		return err
+	}
+	al, found, err := getAlias(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("no account is registered for this %s alias", aliasType)
+	}
+	if !isStaff(ctx) {
+		cn, err := getCallerCN(ctx)
+		if err != nil {
+			return err
+		}
+		if cn != al.UserID {
+			return fmt.Errorf("access denied: this %s alias is not registered to %s", aliasType, cn)
+		}
+	}
+	return ctx.GetStub().DelState(key)
+}
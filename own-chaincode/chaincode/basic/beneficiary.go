@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ======================== Structs ==========================
+
+const (
+	beneficiaryObjectType = "Beneficiary"
+	beneficiaryConfigKey  = "BeneficiaryConfig"
+	beneficiaryAddedEvent = "BeneficiaryAdded"
+
+	defaultCoolingOffHours = 24
+	defaultCoolingOffCap   = 1000000
+)
+
+// Beneficiary is a payee account a customer has registered. Until
+// CoolingOffUntil (RFC3339) transfers to it are capped.
+type Beneficiary struct {
+	UserID          string `json:"userId"`
+	AccountID       string `json:"accountId"`
+	Nickname        string `json:"nickname"`
+	AddedBy         string `json:"addedBy"`
+	AddedAt         string `json:"addedAt"`
+	CoolingOffUntil string `json:"coolingOffUntil"`
+}
+
+// BeneficiaryConfig sets the cooling-off window for new beneficiaries and
+// the largest transfer allowed to them during it
+type BeneficiaryConfig struct {
+	CoolingOffHours int    `json:"coolingOffHours"`
+	CoolingOffCap   int64  `json:"coolingOffCap"`
+	UpdatedBy       string `json:"updatedBy"`
+}
+
+// ======================== Beneficiary Helpers ========================
+
+func getBeneficiaryConfig(ctx contractapi.TransactionContextInterface) (*BeneficiaryConfig, error) {
+	key, err := makeKey(ctx, beneficiaryConfigKey)
+	if err != nil {
+		return nil, err
+	}
+	cfg := BeneficiaryConfig{CoolingOffHours: defaultCoolingOffHours, CoolingOffCap: defaultCoolingOffCap}
+	if _, err := getJSON(ctx, key, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func getBeneficiary(ctx contractapi.TransactionContextInterface, userID string, accountID string) (*Beneficiary, bool, error) {
+	key, err := makeKey(ctx, beneficiaryObjectType, userID, accountID)
+	if err != nil {
+		return nil, false, err
+	}
+	var b Beneficiary
+	found, err := getJSON(ctx, key, &b)
+	if err != nil {
+		return nil, false, err
+	}
+	return &b, found, nil
+}
+
+// requireUserAccess allows staff, or the customer whose certificate CN is userID
+func requireUserAccess(ctx contractapi.TransactionContextInterface, userID string) error {
+	if userID == "" {
+		return fmt.Errorf("user id required")
+	}
+	if isStaff(ctx) {
+		return nil
+	}
+	cn, err := getCallerCN(ctx)
+	if err != nil {
+		return err
+	}
+	if cn != userID {
+		return fmt.Errorf("access denied: cannot manage beneficiaries of %s", userID)
+	}
+	return nil
+}
+
+// checkBeneficiary limits payments a customer makes to accounts of other
+// owners: the payee must be a registered beneficiary, and while it is
+// cooling off the amount is capped. Staff-initiated payments and payments
+// to accounts the caller also owns are not limited.
+func checkBeneficiary(ctx contractapi.TransactionContextInterface, from *Account, to *Account, amount int64) error {
+	if isStaff(ctx) {
+		return nil
+	}
+	cn, err := getCallerCN(ctx)
+	if err != nil {
+		return err
+	}
+	if isAccountOwner(to, cn) {
+		return nil
+	}
+	b, found, err := getBeneficiary(ctx, cn, to.ID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("account %s is not a registered beneficiary of %s", to.ID, cn)
+	}
+
+	until, err := time.Parse(time.RFC3339, b.CoolingOffUntil)
+	if err != nil {
+		return fmt.Errorf("beneficiary %s has invalid cooling-off time: %v", to.ID, err)
+	}
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+	if !now.Before(until) {
+		return nil
+	}
+	cfg, err := getBeneficiaryConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if amount > cfg.CoolingOffCap {
+		return fmt.Errorf("beneficiary %s is in its cooling-off period until %s: transfers are limited to %d",
+			to.ID, b.CoolingOffUntil, cfg.CoolingOffCap)
+	}
+	return nil
+}
+
+// ======================== Beneficiary Methods ========================
+
+// Register a payee account for a user and notify the user by event
+func (s *SmartContract) AddBeneficiary(ctx contractapi.TransactionContextInterface, userID string, accountID string, nickname string) (*Beneficiary, error) {
+
+	if err := requireUserAccess(ctx, userID); err != nil {
+		return nil, err
+	}
+	if nickname == "" {
+		return nil, fmt.Errorf("nickname required")
+	}
+	a, err := getAccount(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if isAccountOwner(a, userID) {
+		return nil, fmt.Errorf("own accounts do not need to be registered")
+	}
+	if _, found, err := getBeneficiary(ctx, userID, a.ID); err != nil {
+		return nil, err
+	} else if found {
+		return nil, fmt.Errorf("account %s is already a beneficiary of %s", a.ID, userID)
+	}
+
+	cfg, err := getBeneficiaryConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cn, _ := getCallerCN(ctx)
+	b := &Beneficiary{
+		UserID:          userID,
+		AccountID:       a.ID,
+		Nickname:        nickname,
+		AddedBy:         cn,
+		AddedAt:         now.Format(time.RFC3339),
+		CoolingOffUntil: now.Add(time.Duration(cfg.CoolingOffHours) * time.Hour).Format(time.RFC3339),
+	}
+
+	key, err := makeKey(ctx, beneficiaryObjectType, userID, a.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := putJSON(ctx, key, b); err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().SetEvent(beneficiaryAddedEvent, payload); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Remove a registered payee
+func (s *SmartContract) RemoveBeneficiary(ctx contractapi.TransactionContextInterface, userID string, accountID string) error {
+
+	if err := requireUserAccess(ctx, userID); err != nil {
+		return err
+	}
+	_, found, err := getBeneficiary(ctx, userID, accountID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("account %s is not a beneficiary of %s", accountID, userID)
+	}
+
+	key, err := makeKey(ctx, beneficiaryObjectType, userID, accountID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().DelState(key)
+}
+
+// List the payees registered by a user
+func (s *SmartContract) ListBeneficiaries(ctx contractapi.TransactionContextInterface, userID string) ([]*Beneficiary, error) {
+
+	if err := requireUserAccess(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(beneficiaryObjectType, []string{userID})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var list []*Beneficiary
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		var b Beneficiary
+		if err := json.Unmarshal(res.Value, &b); err != nil {
+			return nil, fmt.Errorf("corrupt beneficiary at %s: %v", res.Key, err)
+		}
+		list = append(list, &b)
+	}
+	return list, nil
+}
+
+// Set the cooling-off window for new beneficiaries and the transfer cap during it
+func (s *SmartContract) SetBeneficiaryCoolingOff(ctx contractapi.TransactionContextInterface, hours int, cap int64) error {
+
+	if err := requireRole(ctx, "SuperAdmin", "Admin"); err != nil {
+		return err
+	}
+	if hours < 0 || cap < 0 {
+		return fmt.Errorf("hours and cap cannot be negative")
+	}
+
+	key, err := makeKey(ctx, beneficiaryConfigKey)
+	if err != nil {
+		return err
+	}
+	cn, _ := getCallerCN(ctx)
+	return putJSON(ctx, key, BeneficiaryConfig{CoolingOffHours: hours, CoolingOffCap: cap, UpdatedBy: cn})
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ======================== Structs ==========================
+
+const (
+	billerObjectType     = "Biller"
+	billPaymentIndex     = "billpay~biller~date~id"
+	remittanceObjectType = "BillerRemittance"
+	remittanceEvent      = "BillerRemittanceGenerated"
+
+	billerActive = "ACTIVE"
+
+	// Check digit schemes a biller's references may carry as last digit
+	checkDigitNone  = "NONE"
+	checkDigitLuhn  = "LUHN"
+	checkDigitMod11 = "MOD11"
+)
+
+// Biller is a utility that customers pay bills to. Payments are credited to
+// CollectionAccount. A reference must match ReferencePattern in full and,
+// unless CheckDigit is NONE, be all digits with a valid last check digit.
+type Biller struct {
+	ID                string `json:"id"`
+	Name              string `json:"name"`
+	CollectionAccount string `json:"collectionAccount"`
+	ReferencePattern  string `json:"referencePattern"`
+	CheckDigit        string `json:"checkDigit"`
+	Status            string `json:"status"`
+	RegisteredBy      string `json:"registeredBy"`
+	RegisteredAt      string `json:"registeredAt"`
+}
+
+// BillPayment is one bill paid to a biller
+type BillPayment struct {
+	ID           string `json:"id"`
+	BillerID     string `json:"billerId"`
+	Reference    string `json:"reference"`
+	Amount       int64  `json:"amount"`
+	FromAccount  string `json:"fromAccount"`
+	BusinessDate string `json:"businessDate"`
+	HistoryHash  string `json:"historyHash"`
+	PaidBy       string `json:"paidBy"`
+	PaidAt       string `json:"paidAt"`
+}
+
+// BillerRemittance summarises the bills paid to a biller on one business
+// date, for the biller to update its customers' balances
+type BillerRemittance struct {
+	BillerID          string         `json:"billerId"`
+	BusinessDate      string         `json:"businessDate"`
+	CollectionAccount string         `json:"collectionAccount"`
+	Count             int            `json:"count"`
+	Total             int64          `json:"total"`
+	Payments          []*BillPayment `json:"payments"`
+	GeneratedBy       string         `json:"generatedBy"`
+	GeneratedAt       string         `json:"generatedAt"`
+}
+
+// ======================== Biller Helpers ========================
+
+func getBiller(ctx contractapi.TransactionContextInterface, id string) (*Biller, bool, error) {
+	if id == "" {
+		return nil, false, fmt.Errorf("biller id required")
+	}
+	key, err := makeKey(ctx, billerObjectType, id)
+	if err != nil {
+		return nil, false, err
+	}
+	var b Biller
+	found, err := getJSON(ctx, key, &b)
+	if err != nil {
+		return nil, false, err
+	}
+	return &b, found, nil
+}
+
+// referenceRule compiles a reference pattern so that it must match the
+// whole reference
+func referenceRule(pattern string) (*regexp.Regexp, error) {
+	if _, err := regexp.Compile(pattern); err != nil {
+		return nil, fmt.Errorf("invalid reference pattern: %v", err)
+	}
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+// luhnValid checks the Luhn check digit of a digit string
+func luhnValid(digits string) bool {
+	sum := 0
+	for i := 0; i < len(digits); i++ {
+		d := int(digits[len(digits)-1-i] - '0')
+		if i%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// mod11Valid checks a modulus 11 check digit: the other digits are weighted
+// 2 to 7 from the right, repeating, and the check digit is 11 minus the
+// weighted sum modulo 11, with 11 written as 0. References whose check digit
+// would be 10 cannot be issued under this scheme.
+func mod11Valid(digits string) bool {
+	body, check := digits[:len(digits)-1], int(digits[len(digits)-1]-'0')
+	sum := 0
+	for i := 0; i < len(body); i++ {
+		sum += int(body[len(body)-1-i]-'0') * (2 + i%6)
+	}
+	want := 11 - sum%11
+	if want == 11 {
+		want = 0
+	}
+	return want == check
+}
+
+// validateReference checks a bill reference against its biller's rules
+func validateReference(b *Biller, reference string) error {
+	re, err := referenceRule(b.ReferencePattern)
+	if err != nil {
+		return err
+	}
+	if !re.MatchString(reference) {
+		return fmt.Errorf("reference %q is not a valid %s reference", reference, b.Name)
+	}
+	if b.CheckDigit == checkDigitNone {
+		return nil
+	}
+	if len(reference) < 2 || strings.Trim(reference, "0123456789") != "" {
+		return fmt.Errorf("reference %q must be digits with a check digit", reference)
+	}
+	valid := luhnValid(reference)
+	if b.CheckDigit == checkDigitMod11 {
+		valid = mod11Valid(reference)
+	}
+	if !valid {
+		return fmt.Errorf("reference %q has an invalid check digit", reference)
+	}
+	return nil
+}
+
+// ======================== Biller Methods ========================
+
+// Register a biller, the account its payments are collected in and the
+// rules its bill references follow. checkDigit is NONE, LUHN or MOD11.
+func (s *SmartContract) RegisterBiller(
+	ctx contractapi.TransactionContextInterface,
+	billerID string, name string, collectionAccount string, referencePattern string, checkDigit string,
+) (*Biller, error) {
+
+	if err := requireRole(ctx, "SuperAdmin", "Admin"); err != nil {
+		return nil, err
+	}
+	if name == "" || referencePattern == "" {
+		return nil, fmt.Errorf("name and reference pattern required")
+	}
+	if _, err := referenceRule(referencePattern); err != nil {
+		return nil, err
+	}
+	if checkDigit == "" {
+		checkDigit = checkDigitNone
+	}
+	switch checkDigit {
+	case checkDigitNone, checkDigitLuhn, checkDigitMod11:
+	default:
+		return nil, fmt.Errorf("check digit must be %s, %s or %s", checkDigitNone, checkDigitLuhn, checkDigitMod11)
+	}
+	if _, found, err := getBiller(ctx, billerID); err != nil {
+		return nil, err
+	} else if found {
+		return nil, fmt.Errorf("biller %s already exists", billerID)
+	}
+	a, err := getAccount(ctx, collectionAccount)
+	if err != nil {
+		return nil, err
+	}
+	if a.Status != accountActive {
+		return nil, fmt.Errorf("account %s is %s", a.ID, a.Status)
+	}
+
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cn, _ := getCallerCN(ctx)
+	b := &Biller{
+		ID:                billerID,
+		Name:              name,
+		CollectionAccount: a.ID,
+		ReferencePattern:  referencePattern,
+		CheckDigit:        checkDigit,
+		Status:            billerActive,
+		RegisteredBy:      cn,
+		RegisteredAt:      now.Format(time.RFC3339),
+	}
+	key, err := makeKey(ctx, billerObjectType, b.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := putJSON(ctx, key, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Fetch biller
+func (s *SmartContract) GetBiller(ctx contractapi.TransactionContextInterface, billerID string) (*Biller, error) {
+	b, found, err := getBiller(ctx, billerID)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("biller %s not found", billerID)
+	}
+	return b, nil
+}
+
+// Pay a bill at the branch from a customer's account to the biller's
+// collection account
+func (s *SmartContract) PayBill(
+	ctx contractapi.TransactionContextInterface,
+	account string, billerID string, reference string, amount int64,
+) (*BillPayment, error) {
+
+	if err := requireRole(ctx, cashRoles...); err != nil {
+		return nil, err
+	}
+	if amount <= 0 {
+		return nil, fmt.Errorf("amount must be positive")
+	}
+	b, found, err := getBiller(ctx, billerID)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("biller %s not found", billerID)
+	}
+	if b.Status != billerActive {
+		return nil, fmt.Errorf("biller %s is %s", b.ID, b.Status)
+	}
+	reference = strings.TrimSpace(reference)
+	if err := validateReference(b, reference); err != nil {
+		return nil, err
+	}
+	from, err := getAccount(ctx, account)
+	if err != nil {
+		return nil, err
+	}
+	if from.ID == b.CollectionAccount {
+		return nil, fmt.Errorf("cannot pay a bill from the biller's collection account")
+	}
+	if err := requireAccountBank(ctx, from); err != nil {
+		return nil, err
+	}
+	collection, err := getAccount(ctx, b.CollectionAccount)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountBank(ctx, collection); err != nil {
+		return nil, err
+	}
+
+	if err := enforceLimits(ctx, &LimitedOperation{Operation: opTransfer, AccountID: from.ID, ToAccount: collection.ID, Amount: amount}); err != nil {
+		return nil, err
+	}
+
+	narrative := "Bill payment " + b.Name + " " + reference
+	record, err := postEntry(ctx, from, -amount, narrative, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := postToAccount(ctx, collection, amount, narrative); err != nil {
+		return nil, err
+	}
+
+	date, err := getBusinessDate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cn, _ := getCallerCN(ctx)
+	p := &BillPayment{
+		ID:           newID(ctx, "BIL"),
+		BillerID:     b.ID,
+		Reference:    reference,
+		Amount:       amount,
+		FromAccount:  from.ID,
+		BusinessDate: date,
+		HistoryHash:  record.HistoryHash,
+		PaidBy:       cn,
+		PaidAt:       now.Format(time.RFC3339),
+	}
+	key, err := makeKey(ctx, billPaymentIndex, b.ID, date, p.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := putJSON(ctx, key, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Summarise the bills paid to a biller on a past business date. The
+// remittance is generated once and announced by a
+// BillerRemittanceGenerated event.
+func (s *SmartContract) GenerateBillerRemittance(ctx contractapi.TransactionContextInterface, billerID string, businessDate string) (*BillerRemittance, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+	if _, err := parseDate(businessDate); err != nil {
+		return nil, err
+	}
+	b, found, err := getBiller(ctx, billerID)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("biller %s not found", billerID)
+	}
+	today, err := getBusinessDate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if businessDate >= today {
+		return nil, fmt.Errorf("business date %s is not over yet", businessDate)
+	}
+	key, err := makeKey(ctx, remittanceObjectType, b.ID, businessDate)
+	if err != nil {
+		return nil, err
+	}
+	var existing BillerRemittance
+	if found, err := getJSON(ctx, key, &existing); err != nil {
+		return nil, err
+	} else if found {
+		return nil, fmt.Errorf("remittance for biller %s on %s was already generated", b.ID, businessDate)
+	}
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(billPaymentIndex, []string{b.ID, businessDate})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	r := &BillerRemittance{
+		BillerID:          b.ID,
+		BusinessDate:      businessDate,
+		CollectionAccount: b.CollectionAccount,
+		Payments:          []*BillPayment{},
+	}
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		var p BillPayment
+		if err := json.Unmarshal(res.Value, &p); err != nil {
+			return nil, fmt.Errorf("corrupt bill payment at %s: %v", res.Key, err)
+		}
+		r.Count++
+		r.Total += p.Amount
+		r.Payments = append(r.Payments, &p)
+	}
+
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r.GeneratedBy, _ = getCallerCN(ctx)
+	r.GeneratedAt = now.Format(time.RFC3339)
+	if err := putJSON(ctx, key, r); err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().SetEvent(remittanceEvent, payload); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Fetch a generated biller remittance
+func (s *SmartContract) GetBillerRemittance(ctx contractapi.TransactionContextInterface, billerID string, businessDate string) (*BillerRemittance, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+	key, err := makeKey(ctx, remittanceObjectType, billerID, businessDate)
+	if err != nil {
+		return nil, err
+	}
+	var r BillerRemittance
+	found, err := getJSON(ctx, key, &r)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("no remittance for biller %s on %s", billerID, businessDate)
+	}
+	return &r, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLuhnValid(t *testing.T) {
+	for digits, want := range map[string]bool{
+		"79927398713":      true,
+		"79927398710":      false,
+		"4539578763621486": true,
+		"4539578763621487": false,
+		"0":                true,
+		"18":               true, // doubled 1 plus 8
+		"59":               true, // doubled 5 is 10, counted as 1
+		"95":               false,
+	} {
+		if got := luhnValid(digits); got != want {
+			t.Errorf("luhnValid(%s) = %v, want %v", digits, got, want)
+		}
+	}
+}
+
+func TestMod11Valid(t *testing.T) {
+	for digits, want := range map[string]bool{
+		"123455":    true,
+		"123454":    false,
+		"123456785": true, // weights wrap back to 2 after 7
+		"123456784": false,
+		"00":        true, // a check digit of 11 is written as 0
+		// A check digit of 10 cannot be written, so no reference is valid
+		"60": false,
+		"61": false,
+	} {
+		if got := mod11Valid(digits); got != want {
+			t.Errorf("mod11Valid(%s) = %v, want %v", digits, got, want)
+		}
+	}
+}
+
+func TestValidateReference(t *testing.T) {
+	tests := []struct {
+		name       string
+		pattern    string
+		checkDigit string
+		reference  string
+		wantErr    string
+	}{
+		{name: "pattern only", pattern: `INV-\d+`, checkDigit: checkDigitNone, reference: "INV-42"},
+		{name: "pattern must match the whole reference", pattern: `\d{4}`, checkDigit: checkDigitNone,
+			reference: "123456", wantErr: "is not a valid"},
+		{name: "luhn", pattern: `\d{11}`, checkDigit: checkDigitLuhn, reference: "79927398713"},
+		{name: "luhn check digit wrong", pattern: `\d{11}`, checkDigit: checkDigitLuhn,
+			reference: "79927398710", wantErr: "invalid check digit"},
+		{name: "mod11", pattern: `\d{6}`, checkDigit: checkDigitMod11, reference: "123455"},
+		{name: "mod11 scored with luhn would fail", pattern: `\d{9}`, checkDigit: checkDigitMod11, reference: "123456785"},
+		{name: "check digit needs digits", pattern: `\w+`, checkDigit: checkDigitLuhn,
+			reference: "ABC0", wantErr: "must be digits"},
+		{name: "check digit needs two digits", pattern: `\d`, checkDigit: checkDigitMod11,
+			reference: "0", wantErr: "must be digits"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &Biller{Name: "Water Board", ReferencePattern: tt.pattern, CheckDigit: tt.checkDigit}
+			err := validateReference(b, tt.reference)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatal(err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,643 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ======================== Structs ==========================
+
+const (
+	calendarKey           = "BusinessCalendar"
+	daySummaryObjectType  = "DaySummary"
+	eodRunObjectType      = "EndOfDayRun"
+	dayClosedEvent        = "BusinessDayClosed"
+	maxDaysToNextBusiness = 366
+
+	// eodPageSize bounds the items one end-of-day step handles per transaction
+	eodPageSize = 100
+)
+
+// Holiday is a date on which the bank does not open
+type Holiday struct {
+	Date string `json:"date"`
+	Name string `json:"name"`
+}
+
+// BusinessCalendar tracks the bank's business date. Postings are dated on
+// CurrentDate rather than the wall clock, and nothing may be posted on or
+// before LastClosedDate. ClosingDate is set from the first page of
+// CloseBusinessDay until the day is closed; only the end-of-day steps post on
+// it meanwhile. Saturdays, Sundays and Holidays are not business days. Until
+// the calendar is initialised postings use the transaction date.
+type BusinessCalendar struct {
+	CurrentDate     string    `json:"currentDate"`
+	ClosingDate     string    `json:"closingDate,omitempty" metadata:",optional"`
+	LastClosedDate  string    `json:"lastClosedDate,omitempty" metadata:",optional"`
+	LastSummaryHash string    `json:"lastSummaryHash,omitempty" metadata:",optional"`
+	Holidays        []Holiday `json:"holidays"`
+	UpdatedBy       string    `json:"updatedBy"`
+}
+
+// EODStepResult is the outcome of one end-of-day step. The counters add up
+// over the pages the step runs in; Summary is set when the step finishes.
+type EODStepResult struct {
+	Step      string   `json:"step"`
+	Summary   string   `json:"summary"`
+	Processed int      `json:"processed"`
+	Failed    int      `json:"failed"`
+	Amount    int64    `json:"amount"`
+	Errors    []string `json:"errors,omitempty" metadata:",optional"`
+}
+
+// EndOfDayRun is the progress of closing a business day, which may take
+// several CloseBusinessDay transactions. Step is the index of the step in
+// progress and Bookmark where its next page starts. Summary is set once the
+// day is closed.
+type EndOfDayRun struct {
+	Date      string          `json:"date"`
+	Step      int             `json:"step"`
+	Bookmark  string          `json:"bookmark,omitempty" metadata:",optional"`
+	Steps     []EODStepResult `json:"steps"`
+	StartedBy string          `json:"startedBy"`
+	StartedAt string          `json:"startedAt"`
+	Closed    bool            `json:"closed"`
+	Summary   *DaySummary     `json:"summary,omitempty" metadata:",optional"`
+}
+
+// DaySummary is written when a business day is closed. SummaryHash covers
+// the previous day's hash, the step results, the day's GL totals and the
+// closer's identity, so the summaries form a chain; the endorsed transaction
+// that writes it carries the closer's signature.
+type DaySummary struct {
+	Date         string          `json:"date"`
+	NextDate     string          `json:"nextDate"`
+	Steps        []EODStepResult `json:"steps"`
+	GLEntries    int             `json:"glEntries"`
+	TotalDebit   int64           `json:"totalDebit"`
+	TotalCredit  int64           `json:"totalCredit"`
+	PreviousHash string          `json:"previousHash,omitempty" metadata:",optional"`
+	SummaryHash  string          `json:"summaryHash"`
+	ClosedBy     string          `json:"closedBy"`
+	SignerID     string          `json:"signerId"`
+	SignerMSP    string          `json:"signerMsp"`
+	ClosedAt     string          `json:"closedAt"`
+	TxID         string          `json:"txId"`
+}
+
+// ClosedDateError is returned for a posting against a business date that
+// has already been closed
+type ClosedDateError struct {
+	Date          string
+	ClosedThrough string
+}
+
+func (e *ClosedDateError) Error() string {
+	return fmt.Sprintf("business date %s is closed: postings are frozen through %s", e.Date, e.ClosedThrough)
+}
+
+// eodStep is an end-of-day job. Steps run in order inside CloseBusinessDay
+// while the closing date is still open, so their postings land on it. run
+// handles one page from bookmark, adds its counts to the result and returns
+// the bookmark of the next page, or "" when the step is done.
+type eodStep struct {
+	name      string
+	run       func(ctx contractapi.TransactionContextInterface, date string, bookmark string, r *EODStepResult) (string, error)
+	summarise func(r *EODStepResult) string
+}
+
+var eodSteps = []eodStep{
+	{name: "loan-aging", run: eodAgeLoans, summarise: func(r *EODStepResult) string {
+		return fmt.Sprintf("aged %d loans, penalty accrued %d", r.Processed, r.Amount)
+	}},
+	{name: "fixed-deposit-maturity", run: eodMatureDeposits, summarise: func(r *EODStepResult) string {
+		return withErrors(fmt.Sprintf("matured %d deposits, %d failed", r.Processed, r.Failed), r.Errors)
+	}},
+	{name: "hold-expiry", run: eodExpireHolds, summarise: func(r *EODStepResult) string {
+		return fmt.Sprintf("expired %d holds", r.Processed)
+	}},
+	{name: "standing-orders", run: eodStandingOrders, summarise: func(r *EODStepResult) string {
+		return fmt.Sprintf("executed %d standing orders, %d failed", r.Processed, r.Failed)
+	}},
+}
+
+// ======================== Business Day Helpers ========================
+
+func getCalendar(ctx contractapi.TransactionContextInterface) (*BusinessCalendar, bool, error) {
+	key, err := makeKey(ctx, calendarKey)
+	if err != nil {
+		return nil, false, err
+	}
+	var cal BusinessCalendar
+	found, err := getJSON(ctx, key, &cal)
+	if err != nil {
+		return nil, false, err
+	}
+	return &cal, found, nil
+}
+
+func putCalendar(ctx contractapi.TransactionContextInterface, cal *BusinessCalendar) error {
+	key, err := makeKey(ctx, calendarKey)
+	if err != nil {
+		return err
+	}
+	return putJSON(ctx, key, cal)
+}
+
+// getBusinessDate returns the current business date, or the transaction
+// date while no calendar has been initialised
+func getBusinessDate(ctx contractapi.TransactionContextInterface) (string, error) {
+	cal, found, err := getCalendar(ctx)
+	if err != nil {
+		return "", err
+	}
+	if found {
+		return cal.CurrentDate, nil
+	}
+	return getTxDate(ctx)
+}
+
+// checkOpenDate fails with a *ClosedDateError if date has been closed, or
+// is being closed and this is not the end-of-day run closing it
+func checkOpenDate(ctx contractapi.TransactionContextInterface, date string) error {
+	if _, err := parseDate(date); err != nil {
+		return err
+	}
+	cal, found, err := getCalendar(ctx)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return nil
+	}
+	if cal.LastClosedDate != "" && date <= cal.LastClosedDate {
+		return &ClosedDateError{Date: date, ClosedThrough: cal.LastClosedDate}
+	}
+	if cal.ClosingDate != "" && date == cal.ClosingDate {
+		if tc, ok := ctx.(*TransactionContext); !ok || !tc.endOfDay {
+			return &ClosedDateError{Date: date, ClosedThrough: cal.ClosingDate}
+		}
+	}
+	return nil
+}
+
+// postingDate is the date ledger postings of this transaction are made on.
+// Every posting reads the calendar, so a transaction endorsed before a close
+// is invalidated at commit rather than landing on the closed date.
+func postingDate(ctx contractapi.TransactionContextInterface) (string, error) {
+	date, err := getBusinessDate(ctx)
+	if err != nil {
+		return "", err
+	}
+	if err := checkOpenDate(ctx, date); err != nil {
+		return "", err
+	}
+	return date, nil
+}
+
+func (c *BusinessCalendar) isHoliday(date string) bool {
+	for _, h := range c.Holidays {
+		if h.Date == date {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *BusinessCalendar) isBusinessDay(date string) (bool, error) {
+	d, err := parseDate(date)
+	if err != nil {
+		return false, err
+	}
+	if d.Weekday() == time.Saturday || d.Weekday() == time.Sunday {
+		return false, nil
+	}
+	return !c.isHoliday(date), nil
+}
+
+// nextBusinessDate returns the first business day after date
+func (c *BusinessCalendar) nextBusinessDate(date string) (string, error) {
+	d, err := parseDate(date)
+	if err != nil {
+		return "", err
+	}
+	for i := 0; i < maxDaysToNextBusiness; i++ {
+		d = d.AddDate(0, 0, 1)
+		next := d.Format(dateLayout)
+		if ok, _ := c.isBusinessDay(next); ok {
+			return next, nil
+		}
+	}
+	return "", fmt.Errorf("no business day within a year of %s", date)
+}
+
+// dayTotals sums the GL entries dated date, including lines still pending
+// in this transaction's journal
+func dayTotals(ctx contractapi.TransactionContextInterface, date string) (int, int64, int64, error) {
+	accounts, err := listGLAccounts(ctx)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	var count int
+	var debit, credit int64
+	for _, a := range accounts {
+		iter, err := ctx.GetStub().GetStateByPartialCompositeKey(glEntryObjectType, []string{a.Code, date})
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		for iter.HasNext() {
+			res, err := iter.Next()
+			if err != nil {
+				iter.Close()
+				return 0, 0, 0, err
+			}
+			var e GLEntry
+			if err := json.Unmarshal(res.Value, &e); err != nil {
+				iter.Close()
+				return 0, 0, 0, fmt.Errorf("corrupt GL entry at %s: %v", res.Key, err)
+			}
+			count++
+			debit += e.Debit
+			credit += e.Credit
+		}
+		iter.Close()
+	}
+
+	if tc, ok := ctx.(*TransactionContext); ok {
+		for _, l := range tc.journal {
+			count++
+			if l.amount > 0 {
+				debit += l.amount
+			} else {
+				credit -= l.amount
+			}
+		}
+	}
+	return count, debit, credit, nil
+}
+
+func withErrors(summary string, errs []string) string {
+	if len(errs) == 0 {
+		return summary
+	}
+	return summary + ": " + strings.Join(errs, "; ")
+}
+
+// addPage adds a page of a paged batch to a step result
+func (r *EODStepResult) addPage(page *BatchResult) string {
+	r.Processed += page.Processed
+	r.Failed += page.Failed
+	r.Errors = append(r.Errors, page.Errors...)
+	return page.Bookmark
+}
+
+// eodAgeLoans ages disbursed loans into delinquency buckets and accrues
+// penalty interest on overdue instalments. Contractual interest is not
+// accrued daily: it is scheduled per instalment when a loan is disbursed.
+func eodAgeLoans(ctx contractapi.TransactionContextInterface, date string, bookmark string, r *EODStepResult) (string, error) {
+	page, err := ageLoans(ctx, date, eodPageSize, bookmark)
+	if err != nil {
+		return "", err
+	}
+	r.Processed += page.Processed
+	r.Amount += page.PenaltyAccrued
+	return page.Bookmark, nil
+}
+
+func eodMatureDeposits(ctx contractapi.TransactionContextInterface, date string, bookmark string, r *EODStepResult) (string, error) {
+	page, err := matureDueDeposits(ctx, date, eodPageSize, bookmark)
+	if err != nil {
+		return "", err
+	}
+	return r.addPage(page), nil
+}
+
+func eodExpireHolds(ctx contractapi.TransactionContextInterface, _ string, bookmark string, r *EODStepResult) (string, error) {
+	page, err := expireHolds(ctx, eodPageSize, bookmark)
+	if err != nil {
+		return "", err
+	}
+	return r.addPage(page), nil
+}
+
+func getEODRun(ctx contractapi.TransactionContextInterface, date string) (*EndOfDayRun, bool, error) {
+	key, err := makeKey(ctx, eodRunObjectType, date)
+	if err != nil {
+		return nil, false, err
+	}
+	var run EndOfDayRun
+	found, err := getJSON(ctx, key, &run)
+	if err != nil {
+		return nil, false, err
+	}
+	return &run, found, nil
+}
+
+func putEODRun(ctx contractapi.TransactionContextInterface, run *EndOfDayRun) error {
+	key, err := makeKey(ctx, eodRunObjectType, run.Date)
+	if err != nil {
+		return err
+	}
+	return putJSON(ctx, key, run)
+}
+
+// closeDay posts the end-of-day journal on the closing date, freezes that
+// date, records its chained day summary and advances the calendar
+func closeDay(
+	ctx contractapi.TransactionContextInterface,
+	cal *BusinessCalendar, date string, next string, steps []EODStepResult,
+) (*DaySummary, error) {
+	count, debit, credit, err := dayTotals(ctx, date)
+	if err != nil {
+		return nil, err
+	}
+	summary := &DaySummary{
+		Date:         date,
+		NextDate:     next,
+		Steps:        steps,
+		GLEntries:    count,
+		TotalDebit:   debit,
+		TotalCredit:  credit,
+		PreviousHash: cal.LastSummaryHash,
+	}
+	// Post the steps' journal now, while the closing date is still current
+	tc, ok := ctx.(*TransactionContext)
+	if !ok {
+		return nil, fmt.Errorf("GL journal is not available in this transaction context")
+	}
+	if err := postJournal(tc); err != nil {
+		return nil, err
+	}
+
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	summary.ClosedBy, _ = getCallerCN(ctx)
+	summary.SignerID, _ = ctx.GetClientIdentity().GetID()
+	summary.SignerMSP, _ = getClientMSP(ctx)
+	summary.ClosedAt = now.Format(time.RFC3339)
+	summary.TxID = ctx.GetStub().GetTxID()
+
+	parts := []string{summary.PreviousHash, summary.Date, summary.NextDate}
+	for _, st := range summary.Steps {
+		parts = append(parts, st.Step, st.Summary)
+	}
+	parts = append(parts,
+		strconv.Itoa(summary.GLEntries),
+		strconv.FormatInt(summary.TotalDebit, 10),
+		strconv.FormatInt(summary.TotalCredit, 10),
+		summary.SignerID, summary.SignerMSP, summary.ClosedAt, summary.TxID,
+	)
+	summary.SummaryHash = hashOf(parts...)
+
+	key, err := makeKey(ctx, daySummaryObjectType, date)
+	if err != nil {
+		return nil, err
+	}
+	if err := putJSON(ctx, key, summary); err != nil {
+		return nil, err
+	}
+
+	cal.ClosingDate = ""
+	cal.LastClosedDate = date
+	cal.LastSummaryHash = summary.SummaryHash
+	cal.CurrentDate = next
+	cal.UpdatedBy = summary.ClosedBy
+	if err := putCalendar(ctx, cal); err != nil {
+		return nil, err
+	}
+
+	payload, err := json.Marshal(summary)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().SetEvent(dayClosedEvent, payload); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// ======================== Business Day Methods ========================
+
+// Start the business calendar at a business date
+func (s *SmartContract) InitBusinessCalendar(ctx contractapi.TransactionContextInterface, startDate string) (*BusinessCalendar, error) {
+
+	if err := requireRole(ctx, "SuperAdmin", "Admin"); err != nil {
+		return nil, err
+	}
+	_, found, err := getCalendar(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		return nil, fmt.Errorf("business calendar already initialised")
+	}
+
+	cn, _ := getCallerCN(ctx)
+	cal := &BusinessCalendar{CurrentDate: startDate, Holidays: []Holiday{}, UpdatedBy: cn}
+	ok, err := cal.isBusinessDay(startDate)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%s is not a business day", startDate)
+	}
+	if err := putCalendar(ctx, cal); err != nil {
+		return nil, err
+	}
+	return cal, nil
+}
+
+// Fetch the business calendar
+func (s *SmartContract) GetBusinessCalendar(ctx contractapi.TransactionContextInterface) (*BusinessCalendar, error) {
+
+	if _, found, err := getClientRole(ctx); err != nil || !found {
+		return nil, fmt.Errorf("caller has no role attribute")
+	}
+
+	cal, found, err := getCalendar(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("business calendar not initialised")
+	}
+	return cal, nil
+}
+
+// Declare a future date a holiday
+func (s *SmartContract) AddHoliday(ctx contractapi.TransactionContextInterface, date string, name string) (*BusinessCalendar, error) {
+
+	if err := requireRole(ctx, "SuperAdmin", "Admin"); err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, fmt.Errorf("holiday name required")
+	}
+	if _, err := parseDate(date); err != nil {
+		return nil, err
+	}
+
+	cal, err := s.GetBusinessCalendar(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if date <= cal.CurrentDate {
+		return nil, fmt.Errorf("holidays must be after the current business date %s", cal.CurrentDate)
+	}
+	if cal.isHoliday(date) {
+		return nil, fmt.Errorf("%s is already a holiday", date)
+	}
+
+	cal.Holidays = append(cal.Holidays, Holiday{Date: date, Name: name})
+	sort.Slice(cal.Holidays, func(i, j int) bool { return cal.Holidays[i].Date < cal.Holidays[j].Date })
+	cal.UpdatedBy, _ = getCallerCN(ctx)
+	if err := putCalendar(ctx, cal); err != nil {
+		return nil, err
+	}
+	return cal, nil
+}
+
+// Remove a future holiday
+func (s *SmartContract) RemoveHoliday(ctx contractapi.TransactionContextInterface, date string) (*BusinessCalendar, error) {
+
+	if err := requireRole(ctx, "SuperAdmin", "Admin"); err != nil {
+		return nil, err
+	}
+
+	cal, err := s.GetBusinessCalendar(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if date <= cal.CurrentDate {
+		return nil, fmt.Errorf("only holidays after the current business date %s can be removed", cal.CurrentDate)
+	}
+
+	holidays := []Holiday{}
+	for _, h := range cal.Holidays {
+		if h.Date != date {
+			holidays = append(holidays, h)
+		}
+	}
+	if len(holidays) == len(cal.Holidays) {
+		return nil, fmt.Errorf("%s is not a holiday", date)
+	}
+	cal.Holidays = holidays
+	cal.UpdatedBy, _ = getCallerCN(ctx)
+	if err := putCalendar(ctx, cal); err != nil {
+		return nil, err
+	}
+	return cal, nil
+}
+
+// Close the current business day. The end-of-day steps run a page at a time
+// and their progress is kept between calls, so CloseBusinessDay is called
+// again until the returned run is Closed. The first call stops every other
+// posting on the date, so no transaction lands on it between pages and is
+// missed by the steps or the summary. Once every step has finished the
+// closing date is frozen, a chained day summary is recorded and the calendar
+// advances to the next business date.
+func (s *SmartContract) CloseBusinessDay(ctx contractapi.TransactionContextInterface, date string) (*EndOfDayRun, error) {
+
+	if err := requireRole(ctx, "SuperAdmin", "Admin"); err != nil {
+		return nil, err
+	}
+	tc, ok := ctx.(*TransactionContext)
+	if !ok {
+		return nil, fmt.Errorf("GL journal is not available in this transaction context")
+	}
+	tc.endOfDay = true
+
+	cal, err := s.GetBusinessCalendar(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if date != cal.CurrentDate {
+		return nil, fmt.Errorf("can only close the current business date %s", cal.CurrentDate)
+	}
+	next, err := cal.nextBusinessDate(date)
+	if err != nil {
+		return nil, err
+	}
+
+	run, found, err := getEODRun(ctx, date)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		now, err := getTxTime(ctx)
+		if err != nil {
+			return nil, err
+		}
+		run = &EndOfDayRun{Date: date, Steps: []EODStepResult{}, StartedAt: now.Format(time.RFC3339)}
+		run.StartedBy, _ = getCallerCN(ctx)
+
+		// From here on only the end-of-day run posts on the closing date
+		cal.ClosingDate = date
+		if err := putCalendar(ctx, cal); err != nil {
+			return nil, err
+		}
+	}
+
+	for run.Step < len(eodSteps) {
+		step := eodSteps[run.Step]
+		if len(run.Steps) == run.Step {
+			run.Steps = append(run.Steps, EODStepResult{Step: step.name})
+		}
+		r := &run.Steps[run.Step]
+		bookmark, err := step.run(ctx, date, run.Bookmark, r)
+		if err != nil {
+			return nil, fmt.Errorf("end-of-day step %s failed: %v", step.name, err)
+		}
+		if bookmark != "" {
+			// More to do: leave the rest of the day to the next call
+			run.Bookmark = bookmark
+			if err := putEODRun(ctx, run); err != nil {
+				return nil, err
+			}
+			return run, nil
+		}
+		r.Summary = step.summarise(r)
+		run.Step++
+		run.Bookmark = ""
+	}
+
+	if run.Summary, err = closeDay(ctx, cal, date, next, run.Steps); err != nil {
+		return nil, err
+	}
+	run.Closed = true
+	if err := putEODRun(ctx, run); err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+// Fetch the summary of a closed business day
+func (s *SmartContract) GetDaySummary(ctx contractapi.TransactionContextInterface, date string) (*DaySummary, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+
+	key, err := makeKey(ctx, daySummaryObjectType, date)
+	if err != nil {
+		return nil, err
+	}
+	var summary DaySummary
+	found, err := getJSON(ctx, key, &summary)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("business day %s has not been closed", date)
+	}
+	return &summary, nil
+}
@@ -1,354 +1,779 @@
-package main
-
-import (
-	"encoding/json"
-	"fmt"
-	"strings"
-
-	"github.com/hyperledger/fabric-contract-api-go/contractapi"
-)
-
-// ======================== Contract ========================
-
-type SmartContract struct {
-	contractapi.Contract
-}
-
-// ======================== Structs ==========================
-
-// User object stored in ledger
-type User struct {
-	ID           string `json:"id"`
-	Username     string `json:"username"`
-	Role         string `json:"role"`
-	Email        string `json:"email"`
-	NationalID   string `json:"nationalId"`
-	BankBranch   string `json:"bankBranch"`
-	IsActive     bool   `json:"isActive"`
-	RegisteredAt string `json:"registeredAt"`
-	CreatedBy    string `json:"createdBy"`
-	DataHash     string `json:"dataHash"`
-}
-
-type TransactionHistory struct {
-	DepositUser  string `json:"depositUser"`
-	Amount       string `json:"amount"`
-	Date         string `json:"date"`
-	Time         string `json:"time"`
-	HistoryHash  string `json:"historyHash"`
-}
-
-// ======================== Identity Helpers ========================
-
-func getClientRole(ctx contractapi.TransactionContextInterface) (string, bool, error) {
-	cid := ctx.GetClientIdentity()
-	role, found, err := cid.GetAttributeValue("role")
-	if err != nil {
-		return "", false, fmt.Errorf("error reading role attribute: %v", err)
-	}
-	return role, found, nil
-}
-
-func getClientMSP(ctx contractapi.TransactionContextInterface) (string, error) {
-	cid := ctx.GetClientIdentity()
-	mspID, err := cid.GetMSPID()
-	if err != nil {
-		return "", fmt.Errorf("failed to get MSP ID: %v", err)
-	}
-	return mspID, nil
-}
-
-func requireRole(ctx contractapi.TransactionContextInterface, allowed ...string) error {
-	role, found, err := getClientRole(ctx)
-	if err != nil {
-		return err
-	}
-	if !found {
-		return fmt.Errorf("caller has no 'role' attribute in certificate")
-	}
-	for _, v := range allowed {
-		if role == v {
-			return nil
-		}
-	}
-	return fmt.Errorf("access denied: caller role '%s' not in allowed set %v", role, allowed)
-}
-
-func getCallerCN(ctx contractapi.TransactionContextInterface) (string, error) {
-	cid := ctx.GetClientIdentity()
-	cert, err := cid.GetX509Certificate()
-	if err == nil && cert != nil {
-		return cert.Subject.CommonName, nil
-	}
-	subject, err := cid.GetID()
-	if err != nil {
-		return "", fmt.Errorf("failed to get caller identity: %v", err)
-	}
-	return extractCN(subject), nil
-}
-
-func extractCN(subject string) string {
-	start := strings.Index(subject, "CN=")
-	if start == -1 {
-		return subject
-	}
-	s := subject[start+3:]
-	end := strings.Index(s, "::")
-	if end == -1 {
-		return s
-	}
-	return s[:end]
-}
-
-// ======================== Chaincode Methods ========================
-
-// Add initial users
-func (s *SmartContract) InitialUser(ctx contractapi.TransactionContextInterface) error {
-
-	if err := requireRole(ctx, "SuperAdmin", "Admin"); err != nil {
-		return fmt.Errorf("permission denied: %v", err)
-	}
-
-	users := []User{
-		{
-			ID:           "user1",
-			Username:     "Vidusha",
-			Role:         "Admin",
-			Email:        "pgvidushadilshan@gmail.com",
-			NationalID:   "993140490v",
-			BankBranch:   "Godakawela",
-			IsActive:     true,
-			RegisteredAt: "2025-07-31",
-		},
-		{
-			ID:           "user2",
-			Username:     "Dilshan",
-			Role:         "User",
-			Email:        "dilshanariyarathna1999@gmail.com",
-			NationalID:   "993140490",
-			BankBranch:   "Godakawela",
-			IsActive:     true,
-			RegisteredAt: "2025-07-31",
-		},
-	}
-
-	cn, _ := getCallerCN(ctx)
-
-	for _, u := range users {
-		u.CreatedBy = cn
-		data, _ := json.Marshal(u)
-		if err := ctx.GetStub().PutState(u.ID, data); err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
-// Check user existence
-func (s *SmartContract) UserExists(ctx contractapi.TransactionContextInterface, id string) (bool, error) {
-	if id == "" {
-		return false, fmt.Errorf("id is required")
-	}
-	data, err := ctx.GetStub().GetState(id)
-	if err != nil {
-		return false, err
-	}
-	return data != nil, nil
-}
-
-// Create user with RBAC
-func (s *SmartContract) CreateUser(
-	ctx contractapi.TransactionContextInterface,
-	id string, username string, role string,
-	email string, nationalID string, bankBranch string, registeredAt string,
-) error {
-
-	if id == "" || username == "" || role == "" {
-		return fmt.Errorf("id, username and role required")
-	}
-
-	callerRole, found, err := getClientRole(ctx)
-	if err != nil {
-		return err
-	}
-	if !found {
-		return fmt.Errorf("no role attribute in certificate")
-	}
-
-	// RBAC Rules
-	switch role {
-	case "Admin":
-		if callerRole != "SuperAdmin" {
-			return fmt.Errorf("only SuperAdmin can create Admin")
-		}
-	case "Manager", "User":
-		if callerRole != "SuperAdmin" && callerRole != "Admin" {
-			return fmt.Errorf("only Admin/SuperAdmin can create Manager/User")
-		}
-	default:
-		return fmt.Errorf("invalid role: %s", role)
-	}
-
-	exists, _ := s.UserExists(ctx, id)
-	if exists {
-		return fmt.Errorf("user %s already exists", id)
-	}
-
-	cn, _ := getCallerCN(ctx)
-
-	user := User{
-		ID:           id,
-		Username:     username,
-		Role:         role,
-		Email:        email,
-		NationalID:   nationalID,
-		BankBranch:   bankBranch,
-		IsActive:     true,
-		RegisteredAt: registeredAt,
-		CreatedBy:    cn,
-	}
-
-	data, _ := json.Marshal(user)
-	return ctx.GetStub().PutState(id, data)
-}
-
-// Fetch user
-func (s *SmartContract) GetUser(ctx contractapi.TransactionContextInterface, id string) (*User, error) {
-	if id == "" {
-		return nil, fmt.Errorf("id required")
-	}
-	data, err := ctx.GetStub().GetState(id)
-	if err != nil || data == nil {
-		return nil, fmt.Errorf("user %s not found", id)
-	}
-
-	var u User
-	json.Unmarshal(data, &u)
-	return &u, nil
-}
-
-// Get all users
-func (s *SmartContract) GetAllUsers(ctx contractapi.TransactionContextInterface) ([]*User, error) {
-
-	if err := requireRole(ctx, "SuperAdmin", "Admin"); err != nil {
-		return nil, err
-	}
-
-	iter, err := ctx.GetStub().GetStateByRange("", "")
-	if err != nil {
-		return nil, err
-	}
-	defer iter.Close()
-
-	var list []*User
-
-	for iter.HasNext() {
-		res, _ := iter.Next()
-		var u User
-		if json.Unmarshal(res.Value, &u) == nil {
-			list = append(list, &u)
-		}
-	}
-
-	return list, nil
-}
-
-// Update user
-func (s *SmartContract) UpdateUser(ctx contractapi.TransactionContextInterface, id, username, email, bankBranch string) error {
-
-	if err := requireRole(ctx, "SuperAdmin", "Admin"); err != nil {
-		return err
-	}
-
-	u, err := s.GetUser(ctx, id)
-	if err != nil {
-		return err
-	}
-
-	if username != "" {
-		u.Username = username
-	}
-	if email != "" {
-		u.Email = email
-	}
-	if bankBranch != "" {
-		u.BankBranch = bankBranch
-	}
-
-	data, _ := json.Marshal(u)
-	return ctx.GetStub().PutState(id, data)
-}
-
-// Deactivate user
-func (s *SmartContract) DeactivateUser(ctx contractapi.TransactionContextInterface, id string) error {
-
-	if err := requireRole(ctx, "SuperAdmin", "Admin"); err != nil {
-		return err
-	}
-
-	u, err := s.GetUser(ctx, id)
-	if err != nil {
-		return err
-	}
-
-	u.IsActive = false
-	data, _ := json.Marshal(u)
-	return ctx.GetStub().PutState(id, data)
-}
-
-// Caller identity info
-func (s *SmartContract) AuthenticateUser(ctx contractapi.TransactionContextInterface) (string, error) {
-	cn, _ := getCallerCN(ctx)
-	role, found, _ := getClientRole(ctx)
-	msp, _ := getClientMSP(ctx)
-
-	if !found {
-		role = "none"
-	}
-
-	return fmt.Sprintf("CN=%s, MSP=%s, role=%s", cn, msp, role), nil
-}
-
-// Create Transaction History
-func (s *SmartContract) CreateTransactionHistory(
-	ctx contractapi.TransactionContextInterface,
-	depositUser string, amount string, date string, time string, historyHash string,
-) error {
-
-	if depositUser == "" || amount == "" || historyHash == "" {
-		return fmt.Errorf("required fields missing")
-	}
-
-	_, found, err := getClientRole(ctx)
-	if err != nil {
-		return err
-	}
-	if !found {
-		return fmt.Errorf("caller has no role attribute")
-	}
-
-	record := TransactionHistory{
-		DepositUser: depositUser,
-		Amount:      amount,
-		Date:        date,
-		Time:        time,
-		HistoryHash: historyHash,
-	}
-
-	data, _ := json.Marshal(record)
-	return ctx.GetStub().PutState(historyHash, data)
-}
-
-// ======================== Main ========================
-
-func main() {
-	cc, err := contractapi.NewChaincode(new(SmartContract))
-	if err != nil {
-		fmt.Println("Error creating chaincode:", err)
-		return
-	}
-	if err := cc.Start(); err != nil {
-		fmt.Println("Error starting chaincode:", err)
-	}
-}
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ======================== Contract ========================
+
+type SmartContract struct {
+	contractapi.Contract
+}
+
+// TransactionContext lets a transaction read back its own pending writes.
+// Fabric's GetState only returns committed state, so without this a batch
+// that posts to the same account twice would silently lose the first update.
+// It also collects the transaction's GL journal for postJournal and tracks the
+// reversible operation being posted, if any.
+type TransactionContext struct {
+	contractapi.TransactionContext
+	stub       *cachingStub
+	journal    []glLine
+	operation  string
+	operations int
+	// endOfDay is set while CloseBusinessDay runs, the only transaction
+	// allowed to post on a date that is being closed
+	endOfDay bool
+}
+
+func (c *TransactionContext) SetStub(stub shim.ChaincodeStubInterface) {
+	c.TransactionContext.SetStub(stub)
+	c.stub = &cachingStub{ChaincodeStubInterface: stub, writes: map[string][]byte{}}
+}
+
+func (c *TransactionContext) GetStub() shim.ChaincodeStubInterface {
+	return c.stub
+}
+
+// cachingStub records writes so later reads in the same transaction see them.
+// A nil entry marks a deleted key.
+type cachingStub struct {
+	shim.ChaincodeStubInterface
+	writes map[string][]byte
+}
+
+func (s *cachingStub) GetState(key string) ([]byte, error) {
+	if v, ok := s.writes[key]; ok {
+		return v, nil
+	}
+	return s.ChaincodeStubInterface.GetState(key)
+}
+
+func (s *cachingStub) PutState(key string, value []byte) error {
+	if err := s.ChaincodeStubInterface.PutState(key, value); err != nil {
+		return err
+	}
+	s.writes[key] = value
+	return nil
+}
+
+func (s *cachingStub) DelState(key string) error {
+	if err := s.ChaincodeStubInterface.DelState(key); err != nil {
+		return err
+	}
+	s.writes[key] = nil
+	return nil
+}
+
+// ======================== Structs ==========================
+
+// User object stored in ledger
+type User struct {
+	ID           string `json:"id"`
+	Username     string `json:"username"`
+	Role         string `json:"role"`
+	Email        string `json:"email"`
+	NationalID   string `json:"nationalId"`
+	BankBranch   string `json:"bankBranch"`
+	IsActive     bool   `json:"isActive"`
+	RegisteredAt string `json:"registeredAt"`
+	CreatedBy    string `json:"createdBy"`
+	DataHash     string `json:"dataHash"`
+}
+
+// TransactionHistory records a single money movement. Entries posted by the
+// chaincode itself carry the account in DepositUser, a Type of CREDIT or DEBIT
+// and the amount in minor units (cents). Records of each DepositUser form a
+// hash chain: Seq numbers them and PrevHash is the previous record's hash.
+type TransactionHistory struct {
+	DepositUser string `json:"depositUser"`
+	Amount      string `json:"amount"`
+	Date        string `json:"date"`
+	Time        string `json:"time"`
+	HistoryHash string `json:"historyHash"`
+	Type        string `json:"type,omitempty" metadata:",optional"`
+	Narrative   string `json:"narrative,omitempty" metadata:",optional"`
+	TxID        string `json:"txId,omitempty" metadata:",optional"`
+	ReversalOf  string `json:"reversalOf,omitempty" metadata:",optional"`
+	Operation   string `json:"operation,omitempty" metadata:",optional"`
+	ClientRef   string `json:"clientRef,omitempty" metadata:",optional"`
+	Seq         int64  `json:"seq,omitempty" metadata:",optional"`
+	PrevHash    string `json:"prevHash,omitempty" metadata:",optional"`
+}
+
+// HistoryBatchItem is one record of a CreateTransactionHistoryBatch call
+type HistoryBatchItem struct {
+	DepositUser string `json:"depositUser"`
+	Amount      string `json:"amount"`
+	Date        string `json:"date"`
+	Time        string `json:"time"`
+}
+
+// HistoryBatchItemResult reports the outcome of one batch item by its
+// position in the submitted array
+type HistoryBatchItemResult struct {
+	Index       int    `json:"index"`
+	Success     bool   `json:"success"`
+	HistoryHash string `json:"historyHash,omitempty" metadata:",optional"`
+	Error       string `json:"error,omitempty" metadata:",optional"`
+}
+
+// HistoryBatchResult reports a CreateTransactionHistoryBatch call
+type HistoryBatchResult struct {
+	Submitted int                       `json:"submitted"`
+	Succeeded int                       `json:"succeeded"`
+	Failed    int                       `json:"failed"`
+	Items     []*HistoryBatchItemResult `json:"items"`
+}
+
+// ======================== Identity Helpers ========================
+
+func getClientRole(ctx contractapi.TransactionContextInterface) (string, bool, error) {
+	cid := ctx.GetClientIdentity()
+	role, found, err := cid.GetAttributeValue("role")
+	if err != nil {
+		return "", false, fmt.Errorf("error reading role attribute: %v", err)
+	}
+	return role, found, nil
+}
+
+func getClientMSP(ctx contractapi.TransactionContextInterface) (string, error) {
+	cid := ctx.GetClientIdentity()
+	mspID, err := cid.GetMSPID()
+	if err != nil {
+		return "", fmt.Errorf("failed to get MSP ID: %v", err)
+	}
+	return mspID, nil
+}
+
+func requireRole(ctx contractapi.TransactionContextInterface, allowed ...string) error {
+	role, found, err := getClientRole(ctx)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("caller has no 'role' attribute in certificate")
+	}
+	for _, v := range allowed {
+		if role == v {
+			return nil
+		}
+	}
+	return fmt.Errorf("access denied: caller role '%s' not in allowed set %v", role, allowed)
+}
+
+func getCallerCN(ctx contractapi.TransactionContextInterface) (string, error) {
+	cid := ctx.GetClientIdentity()
+	cert, err := cid.GetX509Certificate()
+	if err == nil && cert != nil {
+		return cert.Subject.CommonName, nil
+	}
+	subject, err := cid.GetID()
+	if err != nil {
+		return "", fmt.Errorf("failed to get caller identity: %v", err)
+	}
+	return extractCN(subject), nil
+}
+
+func extractCN(subject string) string {
+	start := strings.Index(subject, "CN=")
+	if start == -1 {
+		return subject
+	}
+	s := subject[start+3:]
+	end := strings.Index(s, "::")
+	if end == -1 {
+		return s
+	}
+	return s[:end]
+}
+
+func getUser(ctx contractapi.TransactionContextInterface, id string) (*User, error) {
+	if id == "" {
+		return nil, fmt.Errorf("id required")
+	}
+	data, err := ctx.GetStub().GetState(id)
+	if err != nil || data == nil {
+		return nil, fmt.Errorf("user %s not found", id)
+	}
+
+	var u User
+	json.Unmarshal(data, &u)
+	return &u, nil
+}
+
+// ======================== Ledger Helpers ========================
+
+const (
+	dateLayout = "2006-01-02"
+	timeLayout = "15:04:05"
+
+	historyTxIndex  = "txhistory~txid~hash"
+	historyRefIndex = "txhistory~ref"
+
+	// maxHistoryBatch keeps the write set of a history batch within block limits
+	maxHistoryBatch = 500
+)
+
+// staffRoles may operate on any customer account
+var staffRoles = []string{"SuperAdmin", "Admin", "Manager"}
+
+func isStaff(ctx contractapi.TransactionContextInterface) bool {
+	return requireRole(ctx, staffRoles...) == nil
+}
+
+func getTxTime(ctx contractapi.TransactionContextInterface) (time.Time, error) {
+	ts, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read tx timestamp: %v", err)
+	}
+	return ts.AsTime().UTC(), nil
+}
+
+func getTxDate(ctx contractapi.TransactionContextInterface) (string, error) {
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return "", err
+	}
+	return now.Format(dateLayout), nil
+}
+
+func parseDate(value string) (time.Time, error) {
+	d, err := time.Parse(dateLayout, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q, expected YYYY-MM-DD", value)
+	}
+	return d, nil
+}
+
+// monthsBetween counts whole calendar months elapsed from start to end
+func monthsBetween(start string, end string) (int, error) {
+	s, err := parseDate(start)
+	if err != nil {
+		return 0, err
+	}
+	e, err := parseDate(end)
+	if err != nil {
+		return 0, err
+	}
+	months := (e.Year()-s.Year())*12 + int(e.Month()) - int(s.Month())
+	if e.Day() < s.Day() {
+		months--
+	}
+	if months < 0 {
+		months = 0
+	}
+	return months, nil
+}
+
+func addMonths(date string, months int) (string, error) {
+	d, err := parseDate(date)
+	if err != nil {
+		return "", err
+	}
+	return d.AddDate(0, months, 0).Format(dateLayout), nil
+}
+
+// daysBetween counts calendar days from start to end (negative if end is earlier)
+func daysBetween(start string, end string) (int, error) {
+	s, err := parseDate(start)
+	if err != nil {
+		return 0, err
+	}
+	e, err := parseDate(end)
+	if err != nil {
+		return 0, err
+	}
+	return int(e.Sub(s).Hours() / 24), nil
+}
+
+// newID derives a deterministic identifier from the current transaction
+func newID(ctx contractapi.TransactionContextInterface, prefix string) string {
+	txID := ctx.GetStub().GetTxID()
+	if len(txID) > 16 {
+		txID = txID[:16]
+	}
+	return prefix + "-" + txID
+}
+
+func hashOf(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "|")))
+	return hex.EncodeToString(sum[:])
+}
+
+func makeKey(ctx contractapi.TransactionContextInterface, objectType string, attrs ...string) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(objectType, attrs)
+	if err != nil {
+		return "", fmt.Errorf("failed to build %s key: %v", objectType, err)
+	}
+	return key, nil
+}
+
+func putJSON(ctx contractapi.TransactionContextInterface, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, data)
+}
+
+// getJSON loads key into v and reports whether the key existed
+func getJSON(ctx contractapi.TransactionContextInterface, key string, v interface{}) (bool, error) {
+	data, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return false, err
+	}
+	if data == nil {
+		return false, nil
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("corrupt record at %s: %v", key, err)
+	}
+	return true, nil
+}
+
+// BatchResult reports the progress of a paged batch transaction. An empty
+// Bookmark means the batch has reached the end of its work list.
+type BatchResult struct {
+	Processed int      `json:"processed"`
+	Failed    int      `json:"failed"`
+	Bookmark  string   `json:"bookmark"`
+	Errors    []string `json:"errors,omitempty" metadata:",optional"`
+}
+
+// scanIndex walks the composite keys under objectType/attrs in key order,
+// starting after bookmark, and calls fn for at most pageSize entries. fn
+// returns false to stop early. The returned bookmark is the last key visited,
+// or "" when the index was exhausted. Pagination APIs are not available to
+// submit transactions, so batches resume from the bookmark themselves.
+func scanIndex(
+	ctx contractapi.TransactionContextInterface,
+	objectType string, attrs []string, bookmark string, pageSize int,
+	fn func(key string, parts []string, value []byte) (bool, error),
+) (string, error) {
+	if pageSize <= 0 {
+		return "", fmt.Errorf("pageSize must be positive")
+	}
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(objectType, attrs)
+	if err != nil {
+		return "", err
+	}
+	defer iter.Close()
+
+	visited := 0
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return "", err
+		}
+		if bookmark != "" && res.Key <= bookmark {
+			continue
+		}
+		if visited == pageSize {
+			return bookmark, nil
+		}
+		_, parts, err := ctx.GetStub().SplitCompositeKey(res.Key)
+		if err != nil {
+			return "", err
+		}
+		more, err := fn(res.Key, parts, res.Value)
+		if err != nil {
+			return "", err
+		}
+		bookmark = res.Key
+		visited++
+		if !more {
+			return "", nil
+		}
+	}
+	return "", nil
+}
+
+// recordHistory writes a chaincode-generated TransactionHistory entry for an account
+func recordHistory(
+	ctx contractapi.TransactionContextInterface,
+	accountID string, entryType string, amount int64, narrative string, reversalOf string,
+) (*TransactionHistory, error) {
+	record := &TransactionHistory{
+		DepositUser: accountID,
+		Amount:      fmt.Sprintf("%d", amount),
+		Type:        entryType,
+		Narrative:   narrative,
+		ReversalOf:  reversalOf,
+	}
+	if err := writeHistory(ctx, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// writeHistory stamps a history record with the business date, transaction
+// time and ID and the reversible operation it belongs to, appends it to its account's chain and indexes it under the
+// transaction ID
+func writeHistory(ctx contractapi.TransactionContextInterface, record *TransactionHistory) error {
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+	if record.Date, err = postingDate(ctx); err != nil {
+		return err
+	}
+	record.Time = now.Format(timeLayout)
+	record.TxID = ctx.GetStub().GetTxID()
+	record.Operation = currentOperation(ctx)
+
+	if err := appendHistory(ctx, record); err != nil {
+		return err
+	}
+	indexKey, err := makeKey(ctx, historyTxIndex, record.TxID, record.HistoryHash)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(indexKey, []byte{0x00})
+}
+
+// ======================== Chaincode Methods ========================
+
+// Add initial users
+func (s *SmartContract) InitialUser(ctx contractapi.TransactionContextInterface) error {
+
+	if err := requireRole(ctx, "SuperAdmin", "Admin"); err != nil {
+		return fmt.Errorf("permission denied: %v", err)
+	}
+
+	users := []User{
+		{
+			ID:           "user1",
+			Username:     "Vidusha",
+			Role:         "Admin",
+			Email:        "pgvidushadilshan@gmail.com",
+			NationalID:   "993140490v",
+			BankBranch:   "Godakawela",
+			IsActive:     true,
+			RegisteredAt: "2025-07-31",
+		},
+		{
+			ID:           "user2",
+			Username:     "Dilshan",
+			Role:         "User",
+			Email:        "dilshanariyarathna1999@gmail.com",
+			NationalID:   "993140490",
+			BankBranch:   "Godakawela",
+			IsActive:     true,
+			RegisteredAt: "2025-07-31",
+		},
+	}
+
+	cn, _ := getCallerCN(ctx)
+
+	for _, u := range users {
+		u.CreatedBy = cn
+		data, _ := json.Marshal(u)
+		if err := ctx.GetStub().PutState(u.ID, data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Check user existence
+func (s *SmartContract) UserExists(ctx contractapi.TransactionContextInterface, id string) (bool, error) {
+	if id == "" {
+		return false, fmt.Errorf("id is required")
+	}
+	data, err := ctx.GetStub().GetState(id)
+	if err != nil {
+		return false, err
+	}
+	return data != nil, nil
+}
+
+// Create user with RBAC
+func (s *SmartContract) CreateUser(
+	ctx contractapi.TransactionContextInterface,
+	id string, username string, role string,
+	email string, nationalID string, bankBranch string, registeredAt string,
+) error {
+
+	if id == "" || username == "" || role == "" {
+		return fmt.Errorf("id, username and role required")
+	}
+
+	callerRole, found, err := getClientRole(ctx)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("no role attribute in certificate")
+	}
+
+	// RBAC Rules
+	switch role {
+	case "Admin":
+		if callerRole != "SuperAdmin" {
+			return fmt.Errorf("only SuperAdmin can create Admin")
+		}
+	case "Manager", "Teller", "User":
+		if callerRole != "SuperAdmin" && callerRole != "Admin" {
+			return fmt.Errorf("only Admin/SuperAdmin can create Manager/Teller/User")
+		}
+	default:
+		return fmt.Errorf("invalid role: %s", role)
+	}
+
+	exists, _ := s.UserExists(ctx, id)
+	if exists {
+		return fmt.Errorf("user %s already exists", id)
+	}
+
+	cn, _ := getCallerCN(ctx)
+
+	user := User{
+		ID:           id,
+		Username:     username,
+		Role:         role,
+		Email:        email,
+		NationalID:   nationalID,
+		BankBranch:   bankBranch,
+		IsActive:     true,
+		RegisteredAt: registeredAt,
+		CreatedBy:    cn,
+	}
+
+	data, _ := json.Marshal(user)
+	return ctx.GetStub().PutState(id, data)
+}
+
+// Fetch user
+func (s *SmartContract) GetUser(ctx contractapi.TransactionContextInterface, id string) (*User, error) {
+	return getUser(ctx, id)
+}
+
+// Get all users
+func (s *SmartContract) GetAllUsers(ctx contractapi.TransactionContextInterface) ([]*User, error) {
+
+	if err := requireRole(ctx, "SuperAdmin", "Admin"); err != nil {
+		return nil, err
+	}
+
+	iter, err := ctx.GetStub().GetStateByRange("", "")
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var list []*User
+
+	for iter.HasNext() {
+		res, _ := iter.Next()
+		var u User
+		if json.Unmarshal(res.Value, &u) == nil {
+			list = append(list, &u)
+		}
+	}
+
+	return list, nil
+}
+
+// Update user
+func (s *SmartContract) UpdateUser(ctx contractapi.TransactionContextInterface, id, username, email, bankBranch string) error {
+
+	if err := requireRole(ctx, "SuperAdmin", "Admin"); err != nil {
+		return err
+	}
+
+	u, err := s.GetUser(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if username != "" {
+		u.Username = username
+	}
+	if email != "" {
+		u.Email = email
+	}
+	if bankBranch != "" {
+		u.BankBranch = bankBranch
+	}
+
+	data, _ := json.Marshal(u)
+	return ctx.GetStub().PutState(id, data)
+}
+
+// Deactivate user
+func (s *SmartContract) DeactivateUser(ctx contractapi.TransactionContextInterface, id string) error {
+
+	if err := requireRole(ctx, "SuperAdmin", "Admin"); err != nil {
+		return err
+	}
+
+	u, err := s.GetUser(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	u.IsActive = false
+	data, _ := json.Marshal(u)
+	return ctx.GetStub().PutState(id, data)
+}
+
+// Caller identity info
+func (s *SmartContract) AuthenticateUser(ctx contractapi.TransactionContextInterface) (string, error) {
+	cn, _ := getCallerCN(ctx)
+	role, found, _ := getClientRole(ctx)
+	msp, _ := getClientMSP(ctx)
+
+	if !found {
+		role = "none"
+	}
+
+	return fmt.Sprintf("CN=%s, MSP=%s, role=%s", cn, msp, role), nil
+}
+
+// createManualHistory validates and appends a history record submitted by a
+// client. clientRef, if given, is the client's own unique reference for it.
+func createManualHistory(ctx contractapi.TransactionContextInterface, item *HistoryBatchItem, clientRef string) (*TransactionHistory, error) {
+	if item.DepositUser == "" || item.Amount == "" {
+		return nil, fmt.Errorf("required fields missing")
+	}
+	if item.Date != "" {
+		if err := checkOpenDate(ctx, item.Date); err != nil {
+			return nil, err
+		}
+	}
+
+	var refKey string
+	if clientRef != "" {
+		var err error
+		if refKey, err = makeKey(ctx, historyRefIndex, clientRef); err != nil {
+			return nil, err
+		}
+		existing, err := ctx.GetStub().GetState(refKey)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			return nil, fmt.Errorf("history %s already exists", clientRef)
+		}
+	}
+
+	record := &TransactionHistory{
+		DepositUser: item.DepositUser,
+		Amount:      item.Amount,
+		Date:        item.Date,
+		Time:        item.Time,
+		ClientRef:   clientRef,
+	}
+	if err := appendHistory(ctx, record); err != nil {
+		return nil, err
+	}
+	if refKey != "" {
+		if err := ctx.GetStub().PutState(refKey, []byte(record.HistoryHash)); err != nil {
+			return nil, err
+		}
+	}
+	return record, nil
+}
+
+// Create Transaction History. historyHash is kept as the client's reference
+// for the record and must be unique; the record itself is stored under a hash
+// computed by the chaincode that links it to the previous one for the same
+// deposit user.
+func (s *SmartContract) CreateTransactionHistory(
+	ctx contractapi.TransactionContextInterface,
+	depositUser string, amount string, date string, time string, historyHash string,
+) (*TransactionHistory, error) {
+
+	if historyHash == "" {
+		return nil, fmt.Errorf("required fields missing")
+	}
+	_, found, err := getClientRole(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("caller has no role attribute")
+	}
+	return createManualHistory(ctx, &HistoryBatchItem{DepositUser: depositUser, Amount: amount, Date: date, Time: time}, historyHash)
+}
+
+// Append a transaction history record and return it with its chained hash
+func (s *SmartContract) AppendTransactionHistory(
+	ctx contractapi.TransactionContextInterface,
+	depositUser string, amount string, date string, time string,
+) (*TransactionHistory, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+	return createManualHistory(ctx, &HistoryBatchItem{DepositUser: depositUser, Amount: amount, Date: date, Time: time}, "")
+}
+
+// Create many transaction history records from a JSON array of
+// {depositUser, amount, date, time} objects. Each item is validated and
+// recorded on its own; failed items are reported and do not stop the batch.
+func (s *SmartContract) CreateTransactionHistoryBatch(ctx contractapi.TransactionContextInterface, items string) (*HistoryBatchResult, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+
+	var raw []json.RawMessage
+	if err := json.Unmarshal([]byte(items), &raw); err != nil {
+		return nil, fmt.Errorf("items must be a JSON array: %v", err)
+	}
+	if len(raw) == 0 || len(raw) > maxHistoryBatch {
+		return nil, fmt.Errorf("a batch must have between 1 and %d items", maxHistoryBatch)
+	}
+
+	result := &HistoryBatchResult{Submitted: len(raw), Items: []*HistoryBatchItemResult{}}
+	for i, data := range raw {
+		r := &HistoryBatchItemResult{Index: i}
+		result.Items = append(result.Items, r)
+
+		var item HistoryBatchItem
+		if err := json.Unmarshal(data, &item); err != nil {
+			r.Error = fmt.Sprintf("invalid item: %v", err)
+			result.Failed++
+			continue
+		}
+		record, err := createManualHistory(ctx, &item, "")
+		if err != nil {
+			r.Error = err.Error()
+			result.Failed++
+			continue
+		}
+		r.Success = true
+		r.HistoryHash = record.HistoryHash
+		result.Succeeded++
+	}
+	return result, nil
+}
+
+// ======================== Main ========================
+
+func main() {
+	contract := new(SmartContract)
+	contract.TransactionContextHandler = new(TransactionContext)
+	contract.AfterTransaction = postJournal
+
+	cc, err := contractapi.NewChaincode(contract)
+	if err != nil {
+		fmt.Println("Error creating chaincode:", err)
+		return
+	}
+	if err := startChaincode(&idempotentChaincode{contract: cc}); err != nil {
+		fmt.Println("Error starting chaincode:", err)
+	}
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ======================== Structs ==========================
+
+const (
+	chequeBookObjectType   = "ChequeBook"
+	chequeObjectType       = "Cheque"
+	chequeSerialKey        = "ChequeSerial"
+	clearingItemObjectType = "ClearingItem"
+	clearingPendingIndex   = "chqpending~msp~id"
+	maxChequeBookLeaves    = 100
+	chequeSerialFormat     = "%06d"
+
+	chequeUnused    = "UNUSED"
+	chequeStopped   = "STOPPED"
+	chequePresented = "PRESENTED"
+
+	clearingPending  = "PENDING"
+	clearingHonoured = "HONOURED"
+	clearingReturned = "RETURNED"
+
+	// Reason codes of returned cheques
+	returnInsufficientFunds = "INSUFFICIENT_FUNDS"
+	returnStopped           = "STOPPED"
+	returnSignatureMismatch = "SIGNATURE_MISMATCH"
+)
+
+// ChequeBook is a range of cheque serials issued to an account. Serials
+// increase per account across books.
+type ChequeBook struct {
+	ID          string `json:"id"`
+	AccountID   string `json:"accountId"`
+	FirstSerial int64  `json:"firstSerial"`
+	LastSerial  int64  `json:"lastSerial"`
+	IssuedBy    string `json:"issuedBy"`
+	IssuedAt    string `json:"issuedAt"`
+}
+
+// Cheque is one leaf of a cheque book. ClearingItem is set once the cheque
+// has been presented; a serial can only be presented once.
+type Cheque struct {
+	AccountID    string `json:"accountId"`
+	Serial       int64  `json:"serial"`
+	BookID       string `json:"bookId"`
+	Status       string `json:"status"`
+	StopReason   string `json:"stopReason,omitempty" metadata:",optional"`
+	StoppedBy    string `json:"stoppedBy,omitempty" metadata:",optional"`
+	ClearingItem string `json:"clearingItem,omitempty" metadata:",optional"`
+}
+
+// ClearingItem is a presented cheque. The collecting bank presents it for
+// its customer's payee account; the paying bank, which holds the drawer's
+// account, honours it by debiting the drawer or returns it with a reason code.
+type ClearingItem struct {
+	ID            string `json:"id"`
+	DrawerAccount string `json:"drawerAccount"`
+	Serial        int64  `json:"serial"`
+	Amount        int64  `json:"amount"`
+	PayeeAccount  string `json:"payeeAccount"`
+	CollectingMSP string `json:"collectingMsp"`
+	PayingMSP     string `json:"payingMsp"`
+	Status        string `json:"status"`
+	ReturnReason  string `json:"returnReason,omitempty" metadata:",optional"`
+	ReturnFee     int64  `json:"returnFee,omitempty" metadata:",optional"`
+	PresentedBy   string `json:"presentedBy"`
+	PresentedAt   string `json:"presentedAt"`
+	ResolvedBy    string `json:"resolvedBy,omitempty" metadata:",optional"`
+	ResolvedAt    string `json:"resolvedAt,omitempty" metadata:",optional"`
+}
+
+// ======================== Cheque Helpers ========================
+
+func chequeKey(ctx contractapi.TransactionContextInterface, accountID string, serial int64) (string, error) {
+	return makeKey(ctx, chequeObjectType, accountID, fmt.Sprintf(chequeSerialFormat, serial))
+}
+
+func getCheque(ctx contractapi.TransactionContextInterface, accountID string, serial int64) (*Cheque, error) {
+	key, err := chequeKey(ctx, accountID, serial)
+	if err != nil {
+		return nil, err
+	}
+	var c Cheque
+	found, err := getJSON(ctx, key, &c)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("cheque %d was not issued to account %s", serial, accountID)
+	}
+	return &c, nil
+}
+
+func putCheque(ctx contractapi.TransactionContextInterface, c *Cheque) error {
+	key, err := chequeKey(ctx, c.AccountID, c.Serial)
+	if err != nil {
+		return err
+	}
+	return putJSON(ctx, key, c)
+}
+
+func getClearingItem(ctx contractapi.TransactionContextInterface, id string) (*ClearingItem, error) {
+	if id == "" {
+		return nil, fmt.Errorf("clearing item id required")
+	}
+	key, err := makeKey(ctx, clearingItemObjectType, id)
+	if err != nil {
+		return nil, err
+	}
+	var item ClearingItem
+	found, err := getJSON(ctx, key, &item)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("clearing item %s not found", id)
+	}
+	return &item, nil
+}
+
+func putClearingItem(ctx contractapi.TransactionContextInterface, item *ClearingItem) error {
+	key, err := makeKey(ctx, clearingItemObjectType, item.ID)
+	if err != nil {
+		return err
+	}
+	return putJSON(ctx, key, item)
+}
+
+// resolveClearingItem records the outcome of a clearing item and removes it
+// from the paying bank's pending list. The drawer of a returned cheque is
+// charged the return fee, as far as the available balance covers it.
+func resolveClearingItem(ctx contractapi.TransactionContextInterface, item *ClearingItem, status string, reason string) error {
+	if status == clearingReturned {
+		drawer, err := getAccount(ctx, item.DrawerAccount)
+		if err != nil {
+			return err
+		}
+		fee, _, err := feeFor(ctx, feeChequeReturn, drawer, channelBranch, item.Amount)
+		if err != nil {
+			return err
+		}
+		available, err := availableBalance(ctx, drawer)
+		if err != nil {
+			return err
+		}
+		if fee > available {
+			fee = available
+		}
+		if err := postFee(ctx, drawer, feeChequeReturn, fee); err != nil {
+			return err
+		}
+		item.ReturnFee = fee
+	}
+
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+	item.Status = status
+	item.ReturnReason = reason
+	item.ResolvedBy, _ = getCallerCN(ctx)
+	item.ResolvedAt = now.Format(time.RFC3339)
+	if err := putClearingItem(ctx, item); err != nil {
+		return err
+	}
+	pendingKey, err := makeKey(ctx, clearingPendingIndex, item.PayingMSP, item.ID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().DelState(pendingKey)
+}
+
+// pendingClearingItem loads a pending item for the paying bank's staff
+func pendingClearingItem(ctx contractapi.TransactionContextInterface, id string) (*ClearingItem, error) {
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+	item, err := getClearingItem(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	caller, err := getClientMSP(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if caller != item.PayingMSP {
+		return nil, fmt.Errorf("access denied: only %s can clear item %s", item.PayingMSP, item.ID)
+	}
+	if item.Status != clearingPending {
+		return nil, fmt.Errorf("clearing item %s is %s", item.ID, item.Status)
+	}
+	return item, nil
+}
+
+// ======================== Cheque Methods ========================
+
+// Issue a cheque book of the next leaves serials to an account
+func (s *SmartContract) IssueChequeBook(ctx contractapi.TransactionContextInterface, accountID string, leaves int) (*ChequeBook, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+	if leaves < 1 || leaves > maxChequeBookLeaves {
+		return nil, fmt.Errorf("leaves must be between 1 and %d", maxChequeBookLeaves)
+	}
+	a, err := getAccount(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountBank(ctx, a); err != nil {
+		return nil, err
+	}
+	if a.Status != accountActive {
+		return nil, fmt.Errorf("account %s is %s", a.ID, a.Status)
+	}
+
+	serialKey, err := makeKey(ctx, chequeSerialKey, a.ID)
+	if err != nil {
+		return nil, err
+	}
+	var last int64
+	if _, err := getJSON(ctx, serialKey, &last); err != nil {
+		return nil, err
+	}
+
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cn, _ := getCallerCN(ctx)
+	book := &ChequeBook{
+		ID:          newID(ctx, "CHQ"),
+		AccountID:   a.ID,
+		FirstSerial: last + 1,
+		LastSerial:  last + int64(leaves),
+		IssuedBy:    cn,
+		IssuedAt:    now.Format(time.RFC3339),
+	}
+	for serial := book.FirstSerial; serial <= book.LastSerial; serial++ {
+		if err := putCheque(ctx, &Cheque{AccountID: a.ID, Serial: serial, BookID: book.ID, Status: chequeUnused}); err != nil {
+			return nil, err
+		}
+	}
+	if err := putJSON(ctx, serialKey, book.LastSerial); err != nil {
+		return nil, err
+	}
+	key, err := makeKey(ctx, chequeBookObjectType, book.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := putJSON(ctx, key, book); err != nil {
+		return nil, err
+	}
+	return book, nil
+}
+
+// Stop payment of an unused cheque
+func (s *SmartContract) StopCheque(ctx contractapi.TransactionContextInterface, accountID string, serial int64, reason string) (*Cheque, error) {
+
+	if reason == "" {
+		return nil, fmt.Errorf("reason required")
+	}
+	a, err := getAccount(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountAccess(ctx, a); err != nil {
+		return nil, err
+	}
+	c, err := getCheque(ctx, a.ID, serial)
+	if err != nil {
+		return nil, err
+	}
+	if c.Status != chequeUnused {
+		return nil, fmt.Errorf("cheque %d of account %s is %s", serial, a.ID, c.Status)
+	}
+
+	c.Status = chequeStopped
+	c.StopReason = reason
+	c.StoppedBy, _ = getCallerCN(ctx)
+	if err := putCheque(ctx, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Present a cheque for clearing as the collecting bank of the payee
+// account. A stopped cheque is returned at once; otherwise the item waits
+// for the paying bank.
+func (s *SmartContract) PresentCheque(
+	ctx contractapi.TransactionContextInterface,
+	drawerAccount string, serial int64, amount int64, payeeAccount string,
+) (*ClearingItem, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+	if amount <= 0 {
+		return nil, fmt.Errorf("amount must be positive")
+	}
+	collectingMSP, err := getClientMSP(ctx)
+	if err != nil {
+		return nil, err
+	}
+	payee, err := getAccount(ctx, payeeAccount)
+	if err != nil {
+		return nil, err
+	}
+	if payee.BankMSP != collectingMSP {
+		return nil, fmt.Errorf("account %s is not held at %s", payee.ID, collectingMSP)
+	}
+	drawer, err := getAccount(ctx, drawerAccount)
+	if err != nil {
+		return nil, err
+	}
+	if drawer.ID == payee.ID {
+		return nil, fmt.Errorf("drawer and payee accounts must differ")
+	}
+	if drawer.BankMSP == "" {
+		return nil, fmt.Errorf("account %s is not held at a member bank", drawer.ID)
+	}
+	c, err := getCheque(ctx, drawer.ID, serial)
+	if err != nil {
+		return nil, err
+	}
+	if c.ClearingItem != "" {
+		return nil, fmt.Errorf("cheque %d of account %s was already presented as %s", serial, drawer.ID, c.ClearingItem)
+	}
+
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cn, _ := getCallerCN(ctx)
+	item := &ClearingItem{
+		ID:            newID(ctx, "CLR"),
+		DrawerAccount: drawer.ID,
+		Serial:        serial,
+		Amount:        amount,
+		PayeeAccount:  payee.ID,
+		CollectingMSP: collectingMSP,
+		PayingMSP:     drawer.BankMSP,
+		Status:        clearingPending,
+		PresentedBy:   cn,
+		PresentedAt:   now.Format(time.RFC3339),
+	}
+	stopped := c.Status == chequeStopped
+	c.ClearingItem = item.ID
+	if !stopped {
+		c.Status = chequePresented
+	}
+	if err := putCheque(ctx, c); err != nil {
+		return nil, err
+	}
+	if err := putClearingItem(ctx, item); err != nil {
+		return nil, err
+	}
+	if item.PayingMSP != item.CollectingMSP {
+		// Clearing between two banks needs the endorsement of both
+		key, err := makeKey(ctx, clearingItemObjectType, item.ID)
+		if err != nil {
+			return nil, err
+		}
+		policy, err := orgsPolicy(item.CollectingMSP, item.PayingMSP)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build endorsement policy: %v", err)
+		}
+		if err := ctx.GetStub().SetStateValidationParameter(key, policy); err != nil {
+			return nil, err
+		}
+	}
+	pendingKey, err := makeKey(ctx, clearingPendingIndex, item.PayingMSP, item.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(pendingKey, []byte{0x00}); err != nil {
+		return nil, err
+	}
+
+	if stopped {
+		if err := resolveClearingItem(ctx, item, clearingReturned, returnStopped); err != nil {
+			return nil, err
+		}
+	}
+	return item, nil
+}
+
+// Honour a pending cheque as the paying bank: debit the drawer and credit
+// the payee. Without sufficient available funds the item is returned. A
+// cheque drawn on another bank is booked as an accepted interbank transfer
+// for the next settlement cycle.
+func (s *SmartContract) HonourCheque(ctx contractapi.TransactionContextInterface, id string) (*ClearingItem, error) {
+
+	item, err := pendingClearingItem(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	drawer, err := getAccount(ctx, item.DrawerAccount)
+	if err != nil {
+		return nil, err
+	}
+	available, err := availableBalance(ctx, drawer)
+	if err != nil {
+		return nil, err
+	}
+	if available < item.Amount {
+		if err := resolveClearingItem(ctx, item, clearingReturned, returnInsufficientFunds); err != nil {
+			return nil, err
+		}
+		return item, nil
+	}
+
+	payee, err := getAccount(ctx, item.PayeeAccount)
+	if err != nil {
+		return nil, err
+	}
+	serial := fmt.Sprintf(chequeSerialFormat, item.Serial)
+	if err := postToAccount(ctx, drawer, -item.Amount, "Cheque "+serial+" to "+payee.ID); err != nil {
+		return nil, err
+	}
+	if err := postToAccount(ctx, payee, item.Amount, "Cheque "+serial+" from "+drawer.ID); err != nil {
+		return nil, err
+	}
+	if drawer.BankMSP != payee.BankMSP {
+		// The paying bank owes the collecting bank until the next settlement cycle
+		if _, err := bookInterbankCredit(ctx, drawer, payee, item.Amount, "Cheque "+serial+" "+item.ID); err != nil {
+			return nil, err
+		}
+	}
+	if err := resolveClearingItem(ctx, item, clearingHonoured, ""); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// Return a pending cheque unpaid as the paying bank, with a reason code
+func (s *SmartContract) ReturnCheque(ctx contractapi.TransactionContextInterface, id string, reasonCode string) (*ClearingItem, error) {
+
+	switch reasonCode {
+	case returnInsufficientFunds, returnStopped, returnSignatureMismatch:
+	default:
+		return nil, fmt.Errorf("invalid reason code: %s", reasonCode)
+	}
+	item, err := pendingClearingItem(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := resolveClearingItem(ctx, item, clearingReturned, reasonCode); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// Fetch a clearing item. Staff of either bank and the drawer can see it.
+func (s *SmartContract) GetClearingItem(ctx contractapi.TransactionContextInterface, id string) (*ClearingItem, error) {
+	item, err := getClearingItem(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if isStaff(ctx) {
+		return item, nil
+	}
+	drawer, err := getAccount(ctx, item.DrawerAccount)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountAccess(ctx, drawer); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// Fetch the state of a cheque
+func (s *SmartContract) GetCheque(ctx contractapi.TransactionContextInterface, accountID string, serial int64) (*Cheque, error) {
+	a, err := getAccount(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountAccess(ctx, a); err != nil {
+		return nil, err
+	}
+	return getCheque(ctx, a.ID, serial)
+}
+
+// List cheques waiting for the caller's bank to honour or return them
+func (s *SmartContract) ListPendingClearingItems(ctx contractapi.TransactionContextInterface) ([]*ClearingItem, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+	caller, err := getClientMSP(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(clearingPendingIndex, []string{caller})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var list []*ClearingItem
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, parts, err := ctx.GetStub().SplitCompositeKey(res.Key)
+		if err != nil || len(parts) != 2 {
+			continue
+		}
+		item, err := getClearingItem(ctx, parts[1])
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, item)
+	}
+	return list, nil
+}
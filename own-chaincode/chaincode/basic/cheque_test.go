@@ -0,0 +1,130 @@
+package main
+
+import "testing"
+
+// chequeLedger has alice's account A1 with a cheque book of serials 1 to 3
+// and bob's account B1 at the same bank
+func chequeLedger(t *testing.T, balance int64) *testLedger {
+	l := newTestLedger(t)
+	l.openAccount("A1", "alice", balance)
+	l.openAccount("B1", "bob", 0)
+	_, err := l.cc.IssueChequeBook(l.staff(), "A1", 3)
+	l.check(err)
+	return l
+}
+
+func presentCheque(l *testLedger, serial int64, amount int64) *ClearingItem {
+	l.t.Helper()
+	item, err := l.cc.PresentCheque(l.staff(), "A1", serial, amount, "B1")
+	l.check(err)
+	return item
+}
+
+func expectCheque(l *testLedger, serial int64, status string) {
+	l.t.Helper()
+	c, err := l.cc.GetCheque(l.staff(), "A1", serial)
+	l.check(err)
+	if c.Status != status {
+		l.t.Fatalf("cheque %d is %s, want %s", serial, c.Status, status)
+	}
+}
+
+func TestHonourCheque(t *testing.T) {
+	l := chequeLedger(t, 500)
+	item := presentCheque(l, 1, 200)
+	expectCheque(l, 1, chequePresented)
+	// Presenting does not touch the drawer's funds
+	l.expectBalances("A1", 500, 500)
+
+	item, err := l.cc.HonourCheque(l.staff(), item.ID)
+	l.check(err)
+	if item.Status != clearingHonoured {
+		t.Fatalf("item is %s, want %s", item.Status, clearingHonoured)
+	}
+	l.expectBalances("A1", 300, 300)
+	l.expectBalances("B1", 200, 200)
+
+	_, err = l.cc.HonourCheque(l.staff(), item.ID)
+	l.checkFails(err, "is HONOURED")
+	_, err = l.cc.PresentCheque(l.staff(), "A1", 1, 200, "B1")
+	l.checkFails(err, "was already presented")
+
+	pending, err := l.cc.ListPendingClearingItems(l.staff())
+	l.check(err)
+	if len(pending) != 0 {
+		t.Fatalf("%d items still pending", len(pending))
+	}
+}
+
+func TestChequeReturns(t *testing.T) {
+	tests := []struct {
+		name    string
+		balance int64
+		stop    bool
+		resolve func(l *testLedger, id string) (*ClearingItem, error)
+		reason  string
+		fee     int64
+	}{
+		{name: "insufficient funds", balance: 120, reason: returnInsufficientFunds, fee: 25,
+			resolve: func(l *testLedger, id string) (*ClearingItem, error) { return l.cc.HonourCheque(l.staff(), id) }},
+		{name: "fee capped at available funds", balance: 10, reason: returnInsufficientFunds, fee: 10,
+			resolve: func(l *testLedger, id string) (*ClearingItem, error) { return l.cc.HonourCheque(l.staff(), id) }},
+		{name: "signature mismatch", balance: 500, reason: returnSignatureMismatch, fee: 25,
+			resolve: func(l *testLedger, id string) (*ClearingItem, error) {
+				return l.cc.ReturnCheque(l.staff(), id, returnSignatureMismatch)
+			}},
+		{name: "stopped cheque", balance: 500, stop: true, reason: returnStopped, fee: 25},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := chequeLedger(t, tt.balance)
+			l.setFlatFee(feeChequeReturn, 25)
+			if tt.stop {
+				_, err := l.cc.StopCheque(l.as("alice", "User"), "A1", 2, "lost")
+				l.check(err)
+			}
+
+			// A stopped cheque is returned as soon as it is presented
+			item := presentCheque(l, 2, 200)
+			if tt.resolve != nil {
+				var err error
+				item, err = tt.resolve(l, item.ID)
+				l.check(err)
+			}
+			if item.Status != clearingReturned || item.ReturnReason != tt.reason || item.ReturnFee != tt.fee {
+				t.Fatalf("item is %s (%s) with fee %d, want RETURNED (%s) with fee %d",
+					item.Status, item.ReturnReason, item.ReturnFee, tt.reason, tt.fee)
+			}
+			l.expectBalances("A1", tt.balance-tt.fee, tt.balance-tt.fee)
+			l.expectBalances("B1", 0, 0)
+			if tt.stop {
+				expectCheque(l, 2, chequeStopped)
+			} else {
+				expectCheque(l, 2, chequePresented)
+			}
+		})
+	}
+}
+
+func TestChequeClearingChecks(t *testing.T) {
+	l := chequeLedger(t, 500)
+
+	_, err := l.cc.PresentCheque(l.staff(), "A1", 4, 100, "B1")
+	l.checkFails(err, "was not issued")
+	_, err = l.cc.PresentCheque(l.staff(), "A1", 1, 100, "A1")
+	l.checkFails(err, "must differ")
+	item := presentCheque(l, 1, 100)
+	_, err = l.cc.ReturnCheque(l.staff(), item.ID, "NO_REASON")
+	l.checkFails(err, "invalid reason code")
+
+	// Only the paying bank can clear the item
+	item = presentCheque(l, 3, 100)
+	l.atBank("Org2MSP", func() {
+		_, err := l.cc.HonourCheque(l.staff(), item.ID)
+		l.checkFails(err, "only Org1MSP can clear")
+	})
+
+	_, err = l.cc.StopCheque(l.as("alice", "User"), "A1", 3, "changed my mind")
+	l.checkFails(err, "is PRESENTED")
+}
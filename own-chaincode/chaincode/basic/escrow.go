@@ -0,0 +1,321 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ======================== Structs ==========================
+
+const (
+	escrowObjectType = "Escrow"
+
+	escrowFunded   = "FUNDED"
+	escrowReleased = "RELEASED"
+	escrowRefunded = "REFUNDED"
+
+	// Parties that can decide an escrow
+	partyBuyer   = "BUYER"
+	partySeller  = "SELLER"
+	partyArbiter = "ARBITER"
+	partyExpiry  = "EXPIRY"
+)
+
+// Escrow holds a buyer's payment in the escrow GL account until it is
+// released to the seller, on the buyer's confirmation or the arbiter's
+// decision, or refunded to the buyer, with the seller's consent, on the
+// arbiter's decision or once ExpiresAt (RFC3339) has passed. Arbiter is an
+// optional user ID.
+type Escrow struct {
+	ID            string            `json:"id"`
+	BuyerAccount  string            `json:"buyerAccount"`
+	SellerAccount string            `json:"sellerAccount"`
+	Arbiter       string            `json:"arbiter,omitempty" metadata:",optional"`
+	Amount        int64             `json:"amount"`
+	Conditions    string            `json:"conditions"`
+	ExpiresAt     string            `json:"expiresAt"`
+	Status        string            `json:"status"`
+	Decisions     []*EscrowDecision `json:"decisions"`
+	CreatedBy     string            `json:"createdBy"`
+	CreatedAt     string            `json:"createdAt"`
+}
+
+// EscrowDecision records who decided an escrow, in which capacity, and the
+// outcome
+type EscrowDecision struct {
+	Outcome   string `json:"outcome"`
+	Party     string `json:"party"`
+	DecidedBy string `json:"decidedBy"`
+	DecidedAt string `json:"decidedAt"`
+	Note      string `json:"note,omitempty" metadata:",optional"`
+}
+
+// ======================== Escrow Helpers ========================
+
+func getEscrow(ctx contractapi.TransactionContextInterface, id string) (*Escrow, error) {
+	if id == "" {
+		return nil, fmt.Errorf("escrow id required")
+	}
+	key, err := makeKey(ctx, escrowObjectType, id)
+	if err != nil {
+		return nil, err
+	}
+	var e Escrow
+	found, err := getJSON(ctx, key, &e)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("escrow %s not found", id)
+	}
+	return &e, nil
+}
+
+func putEscrow(ctx contractapi.TransactionContextInterface, e *Escrow) error {
+	key, err := makeKey(ctx, escrowObjectType, e.ID)
+	if err != nil {
+		return err
+	}
+	return putJSON(ctx, key, e)
+}
+
+// escrowParty reports in which capacity the caller may act on an escrow:
+// BUYER or SELLER as an owner of that account, or ARBITER
+func escrowParty(ctx contractapi.TransactionContextInterface, e *Escrow) (string, string, error) {
+	cn, err := getCallerCN(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	if e.Arbiter != "" && cn == e.Arbiter {
+		return partyArbiter, cn, nil
+	}
+	buyer, err := getAccount(ctx, e.BuyerAccount)
+	if err != nil {
+		return "", "", err
+	}
+	if isAccountOwner(buyer, cn) {
+		return partyBuyer, cn, nil
+	}
+	seller, err := getAccount(ctx, e.SellerAccount)
+	if err != nil {
+		return "", "", err
+	}
+	if isAccountOwner(seller, cn) {
+		return partySeller, cn, nil
+	}
+	return "", cn, nil
+}
+
+// settleEscrow pays the escrowed amount out to an account and records the decision
+func settleEscrow(ctx contractapi.TransactionContextInterface, e *Escrow, outcome string, party string, cn string, note string, accountID string) error {
+	a, err := getAccount(ctx, accountID)
+	if err != nil {
+		return err
+	}
+	if a.ID != e.BuyerAccount {
+		buyer, err := getAccount(ctx, e.BuyerAccount)
+		if err != nil {
+			return err
+		}
+		if err := requireSameBank(buyer, a); err != nil {
+			return err
+		}
+	}
+	narrative := "Escrow " + e.ID + " " + outcome
+	if err := glDebit(ctx, glEscrow, e.Amount, narrative); err != nil {
+		return err
+	}
+	if err := postToAccount(ctx, a, e.Amount, narrative); err != nil {
+		return err
+	}
+
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+	e.Status = outcome
+	e.Decisions = append(e.Decisions, &EscrowDecision{
+		Outcome:   outcome,
+		Party:     party,
+		DecidedBy: cn,
+		DecidedAt: now.Format(time.RFC3339),
+		Note:      note,
+	})
+	return putEscrow(ctx, e)
+}
+
+// ======================== Escrow Methods ========================
+
+// Move a buyer's payment into escrow for a seller until release conditions are met
+func (s *SmartContract) CreateEscrow(
+	ctx contractapi.TransactionContextInterface,
+	buyerAccount string, sellerAccount string, arbiter string, amount int64, conditions string, expiresAt string,
+) (*Escrow, error) {
+
+	if amount <= 0 || conditions == "" {
+		return nil, fmt.Errorf("positive amount and conditions required")
+	}
+	if buyerAccount == sellerAccount {
+		return nil, fmt.Errorf("buyer and seller accounts must differ")
+	}
+	expiry, err := time.Parse(time.RFC3339, expiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expiresAt %q, expected RFC3339", expiresAt)
+	}
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !expiry.After(now) {
+		return nil, fmt.Errorf("expiresAt must be in the future")
+	}
+
+	buyer, err := getAccount(ctx, buyerAccount)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireDebitAuthority(ctx, buyer); err != nil {
+		return nil, err
+	}
+	seller, err := getAccount(ctx, sellerAccount)
+	if err != nil {
+		return nil, err
+	}
+	if seller.Status != accountActive {
+		return nil, fmt.Errorf("account %s is %s", seller.ID, seller.Status)
+	}
+	if err := requireSameBank(buyer, seller); err != nil {
+		return nil, err
+	}
+	if arbiter != "" {
+		u, err := getUser(ctx, arbiter)
+		if err != nil {
+			return nil, err
+		}
+		if !u.IsActive {
+			return nil, fmt.Errorf("arbiter %s is not active", arbiter)
+		}
+		if isAccountOwner(buyer, arbiter) || isAccountOwner(seller, arbiter) {
+			return nil, fmt.Errorf("arbiter must not be the buyer or the seller")
+		}
+	}
+	if err := checkBeneficiary(ctx, buyer, seller, amount); err != nil {
+		return nil, err
+	}
+	if err := enforceLimits(ctx, &LimitedOperation{Operation: opTransfer, AccountID: buyer.ID, ToAccount: seller.ID, Amount: amount}); err != nil {
+		return nil, err
+	}
+
+	id := newID(ctx, "ESC")
+	narrative := "Escrow " + id + " for " + seller.ID
+	if err := postToAccount(ctx, buyer, -amount, narrative); err != nil {
+		return nil, err
+	}
+	if err := glCredit(ctx, glEscrow, amount, narrative); err != nil {
+		return nil, err
+	}
+
+	cn, _ := getCallerCN(ctx)
+	e := &Escrow{
+		ID:            id,
+		BuyerAccount:  buyer.ID,
+		SellerAccount: seller.ID,
+		Arbiter:       arbiter,
+		Amount:        amount,
+		Conditions:    conditions,
+		ExpiresAt:     expiry.UTC().Format(time.RFC3339),
+		Status:        escrowFunded,
+		Decisions:     []*EscrowDecision{},
+		CreatedBy:     cn,
+		CreatedAt:     now.Format(time.RFC3339),
+	}
+	if err := putEscrow(ctx, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Release escrowed funds to the seller, as the buyer confirming the
+// conditions are met or as the arbiter
+func (s *SmartContract) ReleaseEscrow(ctx contractapi.TransactionContextInterface, id string, note string) (*Escrow, error) {
+
+	e, err := getEscrow(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if e.Status != escrowFunded {
+		return nil, fmt.Errorf("escrow %s is %s", e.ID, e.Status)
+	}
+	party, cn, err := escrowParty(ctx, e)
+	if err != nil {
+		return nil, err
+	}
+	if party != partyBuyer && party != partyArbiter {
+		return nil, fmt.Errorf("access denied: only the buyer or the arbiter can release escrow %s", e.ID)
+	}
+
+	if err := settleEscrow(ctx, e, escrowReleased, party, cn, note, e.SellerAccount); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Refund escrowed funds to the buyer, as the seller consenting or as the
+// arbiter, or as any party once the escrow has expired
+func (s *SmartContract) RefundEscrow(ctx contractapi.TransactionContextInterface, id string, note string) (*Escrow, error) {
+
+	e, err := getEscrow(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if e.Status != escrowFunded {
+		return nil, fmt.Errorf("escrow %s is %s", e.ID, e.Status)
+	}
+	party, cn, err := escrowParty(ctx, e)
+	if err != nil {
+		return nil, err
+	}
+	if party == partyBuyer || (party == "" && isStaff(ctx)) {
+		expiry, err := time.Parse(time.RFC3339, e.ExpiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("escrow %s has invalid expiry: %v", e.ID, err)
+		}
+		now, err := getTxTime(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if now.Before(expiry) {
+			return nil, fmt.Errorf("escrow %s cannot be refunded without the seller or arbiter before %s", e.ID, e.ExpiresAt)
+		}
+		party = partyExpiry
+	}
+	if party == "" {
+		return nil, fmt.Errorf("access denied: %s is not a party to escrow %s", cn, e.ID)
+	}
+
+	if err := settleEscrow(ctx, e, escrowRefunded, party, cn, note, e.BuyerAccount); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Fetch escrow
+func (s *SmartContract) GetEscrow(ctx contractapi.TransactionContextInterface, id string) (*Escrow, error) {
+	e, err := getEscrow(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if isStaff(ctx) {
+		return e, nil
+	}
+	party, cn, err := escrowParty(ctx, e)
+	if err != nil {
+		return nil, err
+	}
+	if party == "" {
+		return nil, fmt.Errorf("access denied: %s is not a party to escrow %s", cn, e.ID)
+	}
+	return e, nil
+}
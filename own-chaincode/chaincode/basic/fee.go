@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ======================== Structs ==========================
+
+const (
+	tariffObjectType = "Tariff"
+
+	// Transaction types charged besides opTransfer and opWithdrawal
+	feeChequeReturn = "CHEQUE_RETURN"
+	feeStatement    = "STATEMENT"
+
+	channelBranch = "BRANCH"
+	channelOnline = "ONLINE"
+
+	// tariffAny matches any product or channel
+	tariffAny = "*"
+
+	feeFlat    = "FLAT"
+	feePercent = "PERCENT"
+	feeTiered  = "TIERED"
+)
+
+// feeTxTypes are the transaction types that are charged fees. The transfer
+// fee is charged on transfers, standing orders, interbank transfers, hashed
+// time locks and payment batches. Merchant payments are priced by the
+// merchant's MDR instead, and bill payments, direct debit collections and
+// escrow are not charged.
+var feeTxTypes = []string{opTransfer, opWithdrawal, feeChequeReturn, feeStatement}
+
+// Tariff prices one transaction type for a product and channel at a bank
+// from EffectiveFrom (a business date) until a later tariff takes over.
+// BankMSP is the bank that set it; its tariffs price its own accounts. Product
+// and Channel may be "*"; the most specific tariff in force applies, the
+// product before the channel. A FLAT fee is FlatFee, a PERCENT fee is
+// RateBps basis points of the amount and a TIERED fee is FlatFee plus
+// RateBps of the first tier whose UpTo covers the amount. MinFee and MaxFee
+// bound the result when non-zero.
+type Tariff struct {
+	BankMSP       string        `json:"bankMsp,omitempty" metadata:",optional"`
+	TxType        string        `json:"txType"`
+	Product       string        `json:"product"`
+	Channel       string        `json:"channel"`
+	EffectiveFrom string        `json:"effectiveFrom"`
+	Method        string        `json:"method"`
+	FlatFee       int64         `json:"flatFee,omitempty" metadata:",optional"`
+	RateBps       int           `json:"rateBps,omitempty" metadata:",optional"`
+	Tiers         []*TariffTier `json:"tiers,omitempty" metadata:",optional"`
+	MinFee        int64         `json:"minFee,omitempty" metadata:",optional"`
+	MaxFee        int64         `json:"maxFee,omitempty" metadata:",optional"`
+	UpdatedBy     string        `json:"updatedBy,omitempty" metadata:",optional"`
+	UpdatedAt     string        `json:"updatedAt,omitempty" metadata:",optional"`
+}
+
+// TariffTier is one band of a tiered tariff covering amounts up to UpTo.
+// The last tier may leave UpTo zero to cover any larger amount.
+type TariffTier struct {
+	UpTo    int64 `json:"upTo"`
+	FlatFee int64 `json:"flatFee"`
+	RateBps int   `json:"rateBps"`
+}
+
+// FeeQuote is the fee a transaction would be charged today
+type FeeQuote struct {
+	TxType    string  `json:"txType"`
+	AccountID string  `json:"accountId"`
+	Channel   string  `json:"channel"`
+	Amount    int64   `json:"amount"`
+	Fee       int64   `json:"fee"`
+	Tariff    *Tariff `json:"tariff,omitempty" metadata:",optional"`
+}
+
+// ======================== Fee Helpers ========================
+
+// basisPoints is bps of an amount, rounded half up to the nearest cent
+func basisPoints(amount int64, bps int) int64 {
+	return (amount*int64(bps) + 5000) / 10000
+}
+
+// channelForRole is the channel a caller with role transacts through:
+// staff and tellers at the branch, customers online
+func channelForRole(role string) string {
+	for _, r := range cashRoles {
+		if role == r {
+			return channelBranch
+		}
+	}
+	return channelOnline
+}
+
+func feeChannel(ctx contractapi.TransactionContextInterface) string {
+	role, _, _ := getClientRole(ctx)
+	return channelForRole(role)
+}
+
+// validateTariff checks a tariff's pricing
+func validateTariff(t *Tariff) error {
+	known := false
+	for _, tx := range feeTxTypes {
+		known = known || t.TxType == tx
+	}
+	if !known {
+		return fmt.Errorf("transaction type must be one of %v", feeTxTypes)
+	}
+	if t.Product == "" || t.Channel == "" {
+		return fmt.Errorf("product and channel required, %q for any", tariffAny)
+	}
+	if t.Channel != tariffAny && t.Channel != channelBranch && t.Channel != channelOnline {
+		return fmt.Errorf("channel must be %s, %s or %s", channelBranch, channelOnline, tariffAny)
+	}
+	if _, err := parseDate(t.EffectiveFrom); err != nil {
+		return err
+	}
+	if t.FlatFee < 0 || t.RateBps < 0 || t.RateBps > 10000 || t.MinFee < 0 || t.MaxFee < 0 {
+		return fmt.Errorf("fees and rates cannot be negative, and rates cannot exceed 10000 basis points")
+	}
+	if t.MaxFee > 0 && t.MinFee > t.MaxFee {
+		return fmt.Errorf("minFee cannot exceed maxFee")
+	}
+
+	switch t.Method {
+	case feeFlat, feePercent:
+		if len(t.Tiers) > 0 {
+			return fmt.Errorf("tiers are only used by %s tariffs", feeTiered)
+		}
+	case feeTiered:
+		if len(t.Tiers) == 0 {
+			return fmt.Errorf("a %s tariff needs tiers", feeTiered)
+		}
+		var last int64
+		for i, tier := range t.Tiers {
+			if tier.FlatFee < 0 || tier.RateBps < 0 || tier.RateBps > 10000 {
+				return fmt.Errorf("tier %d: fees and rates cannot be negative, and rates cannot exceed 10000 basis points", i+1)
+			}
+			if tier.UpTo == 0 && i == len(t.Tiers)-1 {
+				continue
+			}
+			if tier.UpTo <= last {
+				return fmt.Errorf("tier %d: upTo must be positive and above the previous tier's", i+1)
+			}
+			last = tier.UpTo
+		}
+	default:
+		return fmt.Errorf("method must be %s, %s or %s", feeFlat, feePercent, feeTiered)
+	}
+	return nil
+}
+
+// compute prices an amount under the tariff
+func (t *Tariff) compute(amount int64) int64 {
+	var fee int64
+	switch t.Method {
+	case feeFlat:
+		fee = t.FlatFee
+	case feePercent:
+		fee = basisPoints(amount, t.RateBps)
+	case feeTiered:
+		tier := t.Tiers[len(t.Tiers)-1]
+		for _, candidate := range t.Tiers {
+			if candidate.UpTo == 0 || amount <= candidate.UpTo {
+				tier = candidate
+				break
+			}
+		}
+		fee = t.FlatFee + tier.FlatFee + basisPoints(amount, tier.RateBps)
+	}
+	if t.MinFee > 0 && fee < t.MinFee {
+		fee = t.MinFee
+	}
+	if t.MaxFee > 0 && fee > t.MaxFee {
+		fee = t.MaxFee
+	}
+	return fee
+}
+
+// tariffInForce finds a bank's tariff for a transaction on a business date:
+// the latest one effective by then at the most specific product and channel
+func tariffInForce(ctx contractapi.TransactionContextInterface, bankMSP string, txType string, product string, channel string, date string) (*Tariff, error) {
+	scopes := [][2]string{{product, channel}, {product, tariffAny}, {tariffAny, channel}, {tariffAny, tariffAny}}
+	for _, scope := range scopes {
+		iter, err := ctx.GetStub().GetStateByPartialCompositeKey(tariffObjectType, []string{bankMSP, txType, scope[0], scope[1]})
+		if err != nil {
+			return nil, err
+		}
+		var found *Tariff
+		for iter.HasNext() {
+			res, err := iter.Next()
+			if err != nil {
+				iter.Close()
+				return nil, err
+			}
+			var t Tariff
+			if err := json.Unmarshal(res.Value, &t); err != nil {
+				iter.Close()
+				return nil, fmt.Errorf("corrupt tariff at %s: %v", res.Key, err)
+			}
+			// Keys sort by effective date, so the last one in force wins
+			if t.EffectiveFrom <= date {
+				found = &t
+			}
+		}
+		iter.Close()
+		if found != nil {
+			return found, nil
+		}
+	}
+	return nil, nil
+}
+
+// feeFor computes the fee for a transaction on an account under the tariffs
+// of the account's bank, and the tariff that set it. Without a tariff in
+// force the transaction is free.
+func feeFor(ctx contractapi.TransactionContextInterface, txType string, a *Account, channel string, amount int64) (int64, *Tariff, error) {
+	date, err := getBusinessDate(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	t, err := tariffInForce(ctx, a.BankMSP, txType, a.Product, channel, date)
+	if err != nil || t == nil {
+		return 0, nil, err
+	}
+	return t.compute(amount), t, nil
+}
+
+// postFee debits a fee from an account to fee income
+func postFee(ctx contractapi.TransactionContextInterface, a *Account, txType string, fee int64) error {
+	if fee <= 0 {
+		return nil
+	}
+	narrative := "Fee: " + txType
+	if err := postToAccount(ctx, a, -fee, narrative); err != nil {
+		return err
+	}
+	return glCredit(ctx, glFeeIncome, fee, narrative)
+}
+
+// chargeFee computes and debits the fee for a transaction. The account must
+// be able to pay it as well as the transaction.
+func chargeFee(ctx contractapi.TransactionContextInterface, a *Account, txType string, channel string, amount int64) error {
+	fee, _, err := feeFor(ctx, txType, a, channel, amount)
+	if err != nil {
+		return err
+	}
+	return postFee(ctx, a, txType, fee)
+}
+
+// ======================== Fee Methods ========================
+
+// Set the caller's bank's tariff for a transaction type, product and channel
+// from its effective date. Tariffs already in force cannot be changed;
+// schedule a new one instead.
+func (s *SmartContract) SetTariff(ctx contractapi.TransactionContextInterface, tariff Tariff) (*Tariff, error) {
+
+	if err := requireRole(ctx, "SuperAdmin"); err != nil {
+		return nil, err
+	}
+	if err := validateTariff(&tariff); err != nil {
+		return nil, err
+	}
+	msp, err := getClientMSP(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tariff.BankMSP = msp
+	today, err := getBusinessDate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if tariff.EffectiveFrom < today {
+		return nil, fmt.Errorf("effectiveFrom cannot be before the business date %s", today)
+	}
+	key, err := makeKey(ctx, tariffObjectType, tariff.BankMSP, tariff.TxType, tariff.Product, tariff.Channel, tariff.EffectiveFrom)
+	if err != nil {
+		return nil, err
+	}
+	var existing Tariff
+	if found, err := getJSON(ctx, key, &existing); err != nil {
+		return nil, err
+	} else if found && existing.EffectiveFrom <= today {
+		return nil, fmt.Errorf("the tariff effective from %s is already in force", existing.EffectiveFrom)
+	}
+
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tariff.UpdatedBy, _ = getCallerCN(ctx)
+	tariff.UpdatedAt = now.Format(time.RFC3339)
+	if err := putJSON(ctx, key, tariff); err != nil {
+		return nil, err
+	}
+	return &tariff, nil
+}
+
+// Withdraw one of the caller's bank's tariffs that has not come into force yet
+func (s *SmartContract) RemoveTariff(
+	ctx contractapi.TransactionContextInterface,
+	txType string, product string, channel string, effectiveFrom string,
+) error {
+
+	if err := requireRole(ctx, "SuperAdmin"); err != nil {
+		return err
+	}
+	today, err := getBusinessDate(ctx)
+	if err != nil {
+		return err
+	}
+	if effectiveFrom <= today {
+		return fmt.Errorf("the tariff effective from %s is already in force", effectiveFrom)
+	}
+	msp, err := getClientMSP(ctx)
+	if err != nil {
+		return err
+	}
+	key, err := makeKey(ctx, tariffObjectType, msp, txType, product, channel, effectiveFrom)
+	if err != nil {
+		return err
+	}
+	var t Tariff
+	found, err := getJSON(ctx, key, &t)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("no %s tariff for %s/%s effective from %s", txType, product, channel, effectiveFrom)
+	}
+	return ctx.GetStub().DelState(key)
+}
+
+// List the caller's bank's tariffs of a transaction type, past and scheduled
+func (s *SmartContract) ListTariffs(ctx contractapi.TransactionContextInterface, txType string) ([]*Tariff, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+	msp, err := getClientMSP(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(tariffObjectType, []string{msp, txType})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var list []*Tariff
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		var t Tariff
+		if err := json.Unmarshal(res.Value, &t); err != nil {
+			return nil, fmt.Errorf("corrupt tariff at %s: %v", res.Key, err)
+		}
+		list = append(list, &t)
+	}
+	return list, nil
+}
+
+// Quote the fee the caller would be charged today for a transaction on an
+// account
+func (s *SmartContract) QuoteFee(ctx contractapi.TransactionContextInterface, txType string, accountID string, amount int64) (*FeeQuote, error) {
+	a, err := getAccount(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountAccess(ctx, a); err != nil {
+		return nil, err
+	}
+	channel := feeChannel(ctx)
+	fee, t, err := feeFor(ctx, txType, a, channel, amount)
+	if err != nil {
+		return nil, err
+	}
+	return &FeeQuote{TxType: txType, AccountID: a.ID, Channel: channel, Amount: amount, Fee: fee, Tariff: t}, nil
+}
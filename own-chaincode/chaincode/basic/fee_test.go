@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestTariffCompute(t *testing.T) {
+	tiered := Tariff{Method: feeTiered, FlatFee: 10, Tiers: []*TariffTier{
+		{UpTo: 10000},
+		{UpTo: 100000, RateBps: 50},
+		{FlatFee: 100, RateBps: 25},
+	}}
+	tests := []struct {
+		name   string
+		tariff Tariff
+		amount int64
+		want   int64
+	}{
+		{name: "flat", tariff: Tariff{Method: feeFlat, FlatFee: 25}, amount: 1000000, want: 25},
+		{name: "percent", tariff: Tariff{Method: feePercent, RateBps: 100}, amount: 12345, want: 123},
+		{name: "percent rounds half up", tariff: Tariff{Method: feePercent, RateBps: 50}, amount: 101, want: 1},
+		{name: "percent below the minimum", tariff: Tariff{Method: feePercent, RateBps: 100, MinFee: 20}, amount: 1000, want: 20},
+		{name: "percent above the maximum", tariff: Tariff{Method: feePercent, RateBps: 100, MaxFee: 500}, amount: 100000, want: 500},
+		{name: "first tier", tariff: tiered, amount: 10000, want: 10},
+		{name: "second tier", tariff: tiered, amount: 50000, want: 260},
+		{name: "open last tier", tariff: tiered, amount: 500000, want: 1360},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.tariff.compute(tt.amount); got != tt.want {
+				t.Fatalf("fee %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTariffInForce(t *testing.T) {
+	l := newTestLedger(t)
+	l.openAccount("A1", "alice", 10000)
+	for _, tariff := range []Tariff{
+		{TxType: opTransfer, Product: tariffAny, Channel: tariffAny, EffectiveFrom: "2025-08-01", Method: feeFlat, FlatFee: 5},
+		{TxType: opTransfer, Product: tariffAny, Channel: tariffAny, EffectiveFrom: "2025-08-03", Method: feeFlat, FlatFee: 7},
+		{TxType: opTransfer, Product: tariffAny, Channel: channelOnline, EffectiveFrom: "2025-08-01", Method: feeFlat, FlatFee: 15},
+		{TxType: opTransfer, Product: "SAVINGS", Channel: tariffAny, EffectiveFrom: "2025-08-02", Method: feeFlat, FlatFee: 30},
+		{TxType: opTransfer, Product: "SAVINGS", Channel: channelOnline, EffectiveFrom: "2025-08-04", Method: feeFlat, FlatFee: 40},
+	} {
+		_, err := l.cc.SetTariff(l.as("admin", "SuperAdmin"), tariff)
+		l.check(err)
+	}
+	// Another bank's tariffs price only its own accounts
+	l.msp = "Org2MSP"
+	_, err := l.cc.SetTariff(l.as("admin", "SuperAdmin"), Tariff{
+		TxType: feeStatement, Product: tariffAny, Channel: tariffAny, EffectiveFrom: "2025-08-01", Method: feeFlat, FlatFee: 50,
+	})
+	l.check(err)
+	l.msp = "Org1MSP"
+
+	tests := []struct {
+		name   string
+		days   int
+		role   string
+		txType string
+		want   int64
+	}{
+		{name: "any product, branch", role: "Teller", txType: opTransfer, want: 5},
+		{name: "channel before any", role: "User", txType: opTransfer, want: 15},
+		{name: "product before channel", days: 1, role: "User", txType: opTransfer, want: 30},
+		{name: "product and channel", days: 3, role: "User", txType: opTransfer, want: 40},
+		{name: "later tariff takes over", days: 2, role: "Manager", txType: opTransfer, want: 30},
+		{name: "no tariff is free", role: "User", txType: opWithdrawal, want: 0},
+		{name: "another bank's tariff", role: "User", txType: feeStatement, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l.stub.txTime = time.Date(2025, 8, 1+tt.days, 10, 0, 0, 0, time.UTC)
+			q, err := l.cc.QuoteFee(l.as("alice", tt.role), tt.txType, "A1", 1000)
+			l.check(err)
+			if q.Fee != tt.want {
+				t.Fatalf("fee %d, want %d", q.Fee, tt.want)
+			}
+		})
+	}
+}
+
+// TestFeeCallSites checks that every way of paying from an account charges
+// the fee of its channel: transfers pay 20 online and 5 at a branch, and
+// withdrawals 30. An interbank payee is credited only on acceptance.
+func TestFeeCallSites(t *testing.T) {
+	preimage := []byte("secret")
+	hashlock := sha256.Sum256(preimage)
+
+	tests := []struct {
+		name      string
+		balance   int64
+		payeeBank string
+		pay       func(l *testLedger) error
+		debited   int64
+		paid      int64
+		fee       int64
+	}{
+		{name: "online transfer", balance: 10000, pay: func(l *testLedger) error {
+			return l.cc.Transfer(l.as("alice", "User"), "A1", "B1", 1000)
+		}, debited: 1020, paid: 1000, fee: 20},
+		{name: "branch transfer", balance: 10000, pay: func(l *testLedger) error {
+			return l.cc.Transfer(l.staff(), "A1", "B1", 1000)
+		}, debited: 1005, paid: 1000, fee: 5},
+		{name: "withdrawal", balance: 10000, pay: func(l *testLedger) error {
+			_, err := l.cc.Withdraw(l.as("teller", "Teller"), "A1", 1000)
+			return err
+		}, debited: 1030, fee: 30},
+		{name: "standing order", balance: 10000, pay: func(l *testLedger) error {
+			return executeStandingOrderOf(l, 1000)
+		}, debited: 1020, paid: 1000, fee: 20},
+		{name: "standing order short of the fee", balance: 1010, pay: func(l *testLedger) error {
+			return executeStandingOrderOf(l, 1000)
+		}},
+		{name: "interbank transfer", balance: 10000, payeeBank: "Org2MSP", pay: func(l *testLedger) error {
+			_, err := l.cc.InitiateInterbankTransfer(l.as("alice", "User"), "A1", "Org2MSP", "B1", 1000, "invoice 1")
+			return err
+		}, debited: 1020, fee: 20},
+		{name: "hashed time lock", balance: 10000, pay: func(l *testLedger) error {
+			timeout := l.stub.txTime.Add(time.Hour).Format(time.RFC3339)
+			lock, err := l.cc.LockFunds(l.as("alice", "User"), "A1", "B1", 1000, hex.EncodeToString(hashlock[:]), timeout)
+			if err != nil {
+				return err
+			}
+			_, err = l.cc.ClaimWithPreimage(l.as("bob", "User"), lock.ID, hex.EncodeToString(preimage))
+			return err
+		}, debited: 1020, paid: 1000, fee: 20},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLedger(t)
+			l.openAccount("A1", "alice", tt.balance)
+			if tt.payeeBank != "" {
+				l.msp = tt.payeeBank
+			}
+			l.openAccount("B1", "bob", 0)
+			l.msp = "Org1MSP"
+			l.addBeneficiary("alice", "B1")
+			for _, tariff := range []Tariff{
+				{TxType: opTransfer, Product: tariffAny, Channel: channelOnline, Method: feeFlat, FlatFee: 20},
+				{TxType: opTransfer, Product: tariffAny, Channel: channelBranch, Method: feeFlat, FlatFee: 5},
+				{TxType: opWithdrawal, Product: tariffAny, Channel: tariffAny, Method: feeFlat, FlatFee: 30},
+			} {
+				tariff.EffectiveFrom = "2025-08-01"
+				_, err := l.cc.SetTariff(l.as("admin", "SuperAdmin"), tariff)
+				l.check(err)
+			}
+
+			l.check(tt.pay(l))
+
+			if debited := tt.balance - l.account("A1").Balance; debited != tt.debited {
+				t.Fatalf("debited %d, want %d", debited, tt.debited)
+			}
+			if got := l.account("B1").Balance; got != tt.paid {
+				t.Fatalf("payee credited %d, want %d", got, tt.paid)
+			}
+			if got := l.glBalance(glFeeIncome); got != -tt.fee {
+				t.Fatalf("fee income %d, want %d", -got, tt.fee)
+			}
+		})
+	}
+}
+
+// executeStandingOrderOf pays a monthly order from A1 to B1 due today
+func executeStandingOrderOf(l *testLedger, amount int64) error {
+	if _, err := l.cc.CreateStandingOrder(l.as("alice", "User"), "A1", "B1", amount, "MONTHLY", "2025-08-01", ""); err != nil {
+		return err
+	}
+	_, err := l.cc.ExecuteDueStandingOrders(l.staff(), "2025-08-01", "")
+	return err
+}
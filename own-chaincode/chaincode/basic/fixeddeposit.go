@@ -0,0 +1,504 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ======================== Structs ==========================
+
+const (
+	fixedDepositObjectType = "FixedDeposit"
+	fdMaturityIndex        = "fdmaturity~date~id"
+	fdConfigKey            = "FixedDepositConfig"
+	fdRateObjectType       = "FixedDepositRate"
+
+	fdActive  = "ACTIVE"
+	fdMatured = "MATURED"
+	fdBroken  = "BROKEN"
+
+	// Maturity instructions
+	fdPayout         = "PAYOUT"
+	fdRenewPrincipal = "RENEW_PRINCIPAL"
+	fdRenewAll       = "RENEW_ALL"
+
+	defaultFDPenaltyRate = 200
+)
+
+// FixedDeposit locks funds taken from SourceAccount for a fixed term. Rates
+// are annual and expressed in basis points (1250 = 12.50%); amounts are in
+// minor units like Account balances.
+type FixedDeposit struct {
+	ID                  string `json:"id"`
+	SourceAccount       string `json:"sourceAccount"`
+	OwnerID             string `json:"ownerId"`
+	Principal           int64  `json:"principal"`
+	Rate                int64  `json:"rate"`
+	TermMonths          int    `json:"termMonths"`
+	StartDate           string `json:"startDate"`
+	MaturityDate        string `json:"maturityDate"`
+	MaturityInstruction string `json:"maturityInstruction"`
+	Status              string `json:"status"`
+	Renewals            int    `json:"renewals"`
+	InterestPaid        int64  `json:"interestPaid"`
+	PenaltyApplied      int64  `json:"penaltyApplied"`
+	ClosedAt            string `json:"closedAt,omitempty" metadata:",optional"`
+	CreatedBy           string `json:"createdBy"`
+}
+
+// FixedDepositConfig holds bank-wide fixed deposit settings
+type FixedDepositConfig struct {
+	PenaltyRate int64  `json:"penaltyRate"`
+	UpdatedBy   string `json:"updatedBy"`
+}
+
+// FixedDepositRate is the published annual rate in basis points for a term
+type FixedDepositRate struct {
+	TermMonths int    `json:"termMonths"`
+	Rate       int64  `json:"rate"`
+	UpdatedBy  string `json:"updatedBy"`
+	UpdatedAt  string `json:"updatedAt"`
+}
+
+// ======================== Fixed Deposit Helpers ========================
+
+func getFixedDeposit(ctx contractapi.TransactionContextInterface, id string) (*FixedDeposit, error) {
+	if id == "" {
+		return nil, fmt.Errorf("fixed deposit id required")
+	}
+	key, err := makeKey(ctx, fixedDepositObjectType, id)
+	if err != nil {
+		return nil, err
+	}
+	var fd FixedDeposit
+	found, err := getJSON(ctx, key, &fd)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("fixed deposit %s not found", id)
+	}
+	return &fd, nil
+}
+
+func putFixedDeposit(ctx contractapi.TransactionContextInterface, fd *FixedDeposit) error {
+	key, err := makeKey(ctx, fixedDepositObjectType, fd.ID)
+	if err != nil {
+		return err
+	}
+	return putJSON(ctx, key, fd)
+}
+
+func setMaturityIndex(ctx contractapi.TransactionContextInterface, fd *FixedDeposit, present bool) error {
+	key, err := makeKey(ctx, fdMaturityIndex, fd.MaturityDate, fd.ID)
+	if err != nil {
+		return err
+	}
+	if present {
+		return ctx.GetStub().PutState(key, []byte{0x00})
+	}
+	return ctx.GetStub().DelState(key)
+}
+
+func getFixedDepositConfig(ctx contractapi.TransactionContextInterface) (*FixedDepositConfig, error) {
+	key, err := makeKey(ctx, fdConfigKey)
+	if err != nil {
+		return nil, err
+	}
+	cfg := FixedDepositConfig{PenaltyRate: defaultFDPenaltyRate}
+	if _, err := getJSON(ctx, key, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func getFixedDepositRate(ctx contractapi.TransactionContextInterface, termMonths int) (*FixedDepositRate, error) {
+	key, err := makeKey(ctx, fdRateObjectType, fmt.Sprintf("%03d", termMonths))
+	if err != nil {
+		return nil, err
+	}
+	var r FixedDepositRate
+	found, err := getJSON(ctx, key, &r)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("no fixed deposit rate published for %d months", termMonths)
+	}
+	return &r, nil
+}
+
+// simpleInterest returns principal * rate * months / 12 in minor units,
+// truncated. The product is formed in big.Int so renewed principals cannot wrap.
+func simpleInterest(principal int64, rateBps int64, months int) int64 {
+	if rateBps <= 0 || months <= 0 {
+		return 0
+	}
+	n := new(big.Int).Mul(big.NewInt(principal), big.NewInt(rateBps))
+	n.Mul(n, big.NewInt(int64(months)))
+	return n.Quo(n, big.NewInt(12*10000)).Int64()
+}
+
+// matureFixedDeposit pays out or renews a deposit that has reached maturity.
+// Everything that can refuse the maturity is checked before the first write,
+// so a refused deposit leaves neither state nor journal lines behind.
+func matureFixedDeposit(ctx contractapi.TransactionContextInterface, fd *FixedDeposit, today string) error {
+	if fd.Status != fdActive {
+		return fmt.Errorf("fixed deposit %s is %s", fd.ID, fd.Status)
+	}
+	if today < fd.MaturityDate {
+		return fmt.Errorf("fixed deposit %s matures on %s", fd.ID, fd.MaturityDate)
+	}
+	switch fd.MaturityInstruction {
+	case fdPayout, fdRenewPrincipal, fdRenewAll:
+	default:
+		return fmt.Errorf("unknown maturity instruction %s", fd.MaturityInstruction)
+	}
+
+	source, err := getAccount(ctx, fd.SourceAccount)
+	if err != nil {
+		return err
+	}
+	if source.Status != accountActive {
+		return fmt.Errorf("account %s is %s", source.ID, source.Status)
+	}
+	// Renewals start a fresh term from the old maturity date
+	renewal, err := addMonths(fd.MaturityDate, fd.TermMonths)
+	if err != nil {
+		return err
+	}
+	interest := simpleInterest(fd.Principal, fd.Rate, fd.TermMonths)
+
+	if err := setMaturityIndex(ctx, fd, false); err != nil {
+		return err
+	}
+
+	narrative := "Fixed deposit maturity " + fd.ID
+	if err := glDebit(ctx, glInterestExpense, interest, narrative); err != nil {
+		return err
+	}
+
+	switch fd.MaturityInstruction {
+	case fdPayout:
+		if err := postToAccount(ctx, source, fd.Principal+interest, narrative); err != nil {
+			return err
+		}
+		if err := glDebit(ctx, glFixedDeposits, fd.Principal, narrative); err != nil {
+			return err
+		}
+		fd.InterestPaid += interest
+		fd.Status = fdMatured
+		fd.ClosedAt = today
+		return putFixedDeposit(ctx, fd)
+
+	case fdRenewPrincipal:
+		if interest > 0 {
+			if err := postToAccount(ctx, source, interest, "Fixed deposit interest "+fd.ID); err != nil {
+				return err
+			}
+		}
+		fd.InterestPaid += interest
+
+	case fdRenewAll:
+		if err := glCredit(ctx, glFixedDeposits, interest, narrative); err != nil {
+			return err
+		}
+		fd.Principal += interest
+	}
+
+	fd.StartDate = fd.MaturityDate
+	fd.MaturityDate = renewal
+	fd.Renewals++
+	if err := setMaturityIndex(ctx, fd, true); err != nil {
+		return err
+	}
+	return putFixedDeposit(ctx, fd)
+}
+
+// matureDueDeposits matures one page of deposits due on or before asOfDate.
+// A deposit that is refused, e.g. because its account is closed, is counted
+// and skipped; matureFixedDeposit refuses before posting anything for it.
+func matureDueDeposits(
+	ctx contractapi.TransactionContextInterface,
+	asOfDate string, pageSize int, bookmark string,
+) (*BatchResult, error) {
+	result := &BatchResult{}
+	next, err := scanIndex(ctx, fdMaturityIndex, nil, bookmark, pageSize,
+		func(key string, parts []string, _ []byte) (bool, error) {
+			if len(parts) != 2 || parts[0] > asOfDate {
+				return false, nil
+			}
+			fd, err := getFixedDeposit(ctx, parts[1])
+			if err == nil {
+				err = matureFixedDeposit(ctx, fd, asOfDate)
+			}
+			if err != nil {
+				result.Failed++
+				result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", parts[1], err))
+				return true, nil
+			}
+			result.Processed++
+			return true, nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	result.Bookmark = next
+	return result, nil
+}
+
+// ======================== Fixed Deposit Methods ========================
+
+// Open a fixed deposit funded from a customer account. rate must be the
+// published rate for the term; only staff can open at a negotiated rate.
+func (s *SmartContract) OpenFixedDeposit(
+	ctx contractapi.TransactionContextInterface,
+	sourceAccount string, amount int64, termMonths int, rate int64, maturityInstruction string,
+) (*FixedDeposit, error) {
+
+	if amount <= 0 || termMonths <= 0 || rate < 0 {
+		return nil, fmt.Errorf("amount and termMonths must be positive and rate non-negative")
+	}
+	if rate > 0 && amount > math.MaxInt64/rate/int64(termMonths) {
+		return nil, fmt.Errorf("amount %d at %d basis points over %d months is too large", amount, rate, termMonths)
+	}
+	switch maturityInstruction {
+	case fdPayout, fdRenewPrincipal, fdRenewAll:
+	default:
+		return nil, fmt.Errorf("invalid maturity instruction: %s", maturityInstruction)
+	}
+
+	source, err := getAccount(ctx, sourceAccount)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireDebitAuthority(ctx, source); err != nil {
+		return nil, err
+	}
+	if !isStaff(ctx) {
+		published, err := getFixedDepositRate(ctx, termMonths)
+		if err != nil {
+			return nil, err
+		}
+		if rate != published.Rate {
+			return nil, fmt.Errorf("the rate for %d months is %d basis points", termMonths, published.Rate)
+		}
+	}
+
+	today, err := getBusinessDate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	maturity, err := addMonths(today, termMonths)
+	if err != nil {
+		return nil, err
+	}
+	cn, _ := getCallerCN(ctx)
+
+	fd := &FixedDeposit{
+		ID:                  newID(ctx, "FD"),
+		SourceAccount:       source.ID,
+		OwnerID:             source.OwnerID,
+		Principal:           amount,
+		Rate:                rate,
+		TermMonths:          termMonths,
+		StartDate:           today,
+		MaturityDate:        maturity,
+		MaturityInstruction: maturityInstruction,
+		Status:              fdActive,
+		CreatedBy:           cn,
+	}
+
+	if err := postToAccount(ctx, source, -amount, "Fixed deposit placement "+fd.ID); err != nil {
+		return nil, err
+	}
+	if err := glCredit(ctx, glFixedDeposits, amount, "Fixed deposit placement "+fd.ID); err != nil {
+		return nil, err
+	}
+	if err := setMaturityIndex(ctx, fd, true); err != nil {
+		return nil, err
+	}
+	if err := putFixedDeposit(ctx, fd); err != nil {
+		return nil, err
+	}
+	return fd, nil
+}
+
+// Fetch fixed deposit
+func (s *SmartContract) GetFixedDeposit(ctx contractapi.TransactionContextInterface, id string) (*FixedDeposit, error) {
+	fd, err := getFixedDeposit(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	source, err := getAccount(ctx, fd.SourceAccount)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountAccess(ctx, source); err != nil {
+		return nil, err
+	}
+	return fd, nil
+}
+
+// Mature a single fixed deposit on or after its maturity date
+func (s *SmartContract) MatureFixedDeposit(ctx contractapi.TransactionContextInterface, id string) (*FixedDeposit, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+
+	fd, err := getFixedDeposit(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	today, err := getBusinessDate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := matureFixedDeposit(ctx, fd, today); err != nil {
+		return nil, err
+	}
+	return fd, nil
+}
+
+// Break a fixed deposit before maturity, paying interest at the penalised rate
+func (s *SmartContract) BreakFixedDeposit(ctx contractapi.TransactionContextInterface, id string) (*FixedDeposit, error) {
+
+	fd, err := getFixedDeposit(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if fd.Status != fdActive {
+		return nil, fmt.Errorf("fixed deposit %s is %s", fd.ID, fd.Status)
+	}
+
+	source, err := getAccount(ctx, fd.SourceAccount)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountAccess(ctx, source); err != nil {
+		return nil, err
+	}
+
+	today, err := getBusinessDate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if today >= fd.MaturityDate {
+		return nil, fmt.Errorf("fixed deposit %s has matured, use MatureFixedDeposit", fd.ID)
+	}
+
+	cfg, err := getFixedDepositConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	elapsed, err := monthsBetween(fd.StartDate, today)
+	if err != nil {
+		return nil, err
+	}
+
+	effectiveRate := fd.Rate - cfg.PenaltyRate
+	if effectiveRate < 0 {
+		effectiveRate = 0
+	}
+	interest := simpleInterest(fd.Principal, effectiveRate, elapsed)
+
+	narrative := "Fixed deposit premature withdrawal " + fd.ID
+	if err := postToAccount(ctx, source, fd.Principal+interest, narrative); err != nil {
+		return nil, err
+	}
+	if err := glDebit(ctx, glFixedDeposits, fd.Principal, narrative); err != nil {
+		return nil, err
+	}
+	if err := glDebit(ctx, glInterestExpense, interest, narrative); err != nil {
+		return nil, err
+	}
+	if err := setMaturityIndex(ctx, fd, false); err != nil {
+		return nil, err
+	}
+
+	fd.InterestPaid += interest
+	fd.PenaltyApplied = simpleInterest(fd.Principal, fd.Rate, elapsed) - interest
+	fd.Status = fdBroken
+	fd.ClosedAt = today
+	if err := putFixedDeposit(ctx, fd); err != nil {
+		return nil, err
+	}
+	return fd, nil
+}
+
+// Set the premature withdrawal penalty rate in basis points
+func (s *SmartContract) SetFixedDepositPenaltyRate(ctx contractapi.TransactionContextInterface, penaltyRate int64) error {
+
+	if err := requireRole(ctx, "SuperAdmin", "Admin"); err != nil {
+		return err
+	}
+	if penaltyRate < 0 {
+		return fmt.Errorf("penalty rate cannot be negative")
+	}
+
+	key, err := makeKey(ctx, fdConfigKey)
+	if err != nil {
+		return err
+	}
+	cn, _ := getCallerCN(ctx)
+	return putJSON(ctx, key, FixedDepositConfig{PenaltyRate: penaltyRate, UpdatedBy: cn})
+}
+
+// Publish the fixed deposit rate for a term in basis points
+func (s *SmartContract) SetFixedDepositRate(ctx contractapi.TransactionContextInterface, termMonths int, rate int64) (*FixedDepositRate, error) {
+
+	if err := requireRole(ctx, "SuperAdmin", "Admin"); err != nil {
+		return nil, err
+	}
+	if termMonths <= 0 || rate < 0 {
+		return nil, fmt.Errorf("termMonths must be positive and rate non-negative")
+	}
+
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cn, _ := getCallerCN(ctx)
+	r := &FixedDepositRate{TermMonths: termMonths, Rate: rate, UpdatedBy: cn, UpdatedAt: now.Format(time.RFC3339)}
+	key, err := makeKey(ctx, fdRateObjectType, fmt.Sprintf("%03d", termMonths))
+	if err != nil {
+		return nil, err
+	}
+	if err := putJSON(ctx, key, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Fetch the published fixed deposit rate for a term
+func (s *SmartContract) GetFixedDepositRate(ctx contractapi.TransactionContextInterface, termMonths int) (*FixedDepositRate, error) {
+	return getFixedDepositRate(ctx, termMonths)
+}
+
+// Mature all deposits due on or before asOfDate, one page per transaction
+func (s *SmartContract) ProcessMaturedDeposits(
+	ctx contractapi.TransactionContextInterface,
+	asOfDate string, pageSize int, bookmark string,
+) (*BatchResult, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+	if _, err := parseDate(asOfDate); err != nil {
+		return nil, err
+	}
+	today, err := getBusinessDate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if asOfDate > today {
+		return nil, fmt.Errorf("cannot mature deposits ahead of %s", today)
+	}
+
+	return matureDueDeposits(ctx, asOfDate, pageSize, bookmark)
+}
@@ -0,0 +1,133 @@
+package main
+
+import "testing"
+
+// openFixedDeposit places a 12 month deposit of 120000 at 12% from account
+func openFixedDeposit(l *testLedger, owner string, account string, instruction string) *FixedDeposit {
+	l.t.Helper()
+	fd, err := l.cc.OpenFixedDeposit(l.as(owner, "User"), account, 120000, 12, 1200, instruction)
+	l.check(err)
+	return fd
+}
+
+func TestMatureFixedDeposit(t *testing.T) {
+	tests := []struct {
+		name        string
+		instruction string
+		days        int
+		frozen      bool
+		wantErr     string
+		balance     int64
+		status      string
+		principal   int64
+		maturity    string
+		interest    int64
+	}{
+		{name: "payout", instruction: fdPayout, days: 365,
+			balance: 214400, status: fdMatured, principal: 120000, maturity: "2026-08-01", interest: 14400},
+		{name: "renew principal", instruction: fdRenewPrincipal, days: 365,
+			balance: 94400, status: fdActive, principal: 120000, maturity: "2027-08-01", interest: 14400},
+		{name: "renew all", instruction: fdRenewAll, days: 365,
+			balance: 80000, status: fdActive, principal: 134400, maturity: "2027-08-01", interest: 14400},
+		{name: "before maturity", instruction: fdPayout, days: 364, wantErr: "matures on 2026-08-01",
+			balance: 80000, status: fdActive, principal: 120000, maturity: "2026-08-01"},
+		{name: "source account not active", instruction: fdPayout, days: 365, frozen: true, wantErr: "is FROZEN",
+			balance: 80000, status: fdActive, principal: 120000, maturity: "2026-08-01"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLedger(t)
+			l.openAccount("A1", "alice", 200000)
+			_, err := l.cc.SetFixedDepositRate(l.as("admin", "Admin"), 12, 1200)
+			l.check(err)
+			fd := openFixedDeposit(l, "alice", "A1", tt.instruction)
+			if tt.frozen {
+				a := l.account("A1")
+				a.Status = "FROZEN"
+				l.check(putAccount(l.last, a))
+			}
+			l.advance(tt.days)
+
+			_, err = l.cc.MatureFixedDeposit(l.staff(), fd.ID)
+			if tt.wantErr != "" {
+				l.checkFails(err, tt.wantErr)
+			} else {
+				l.check(err)
+			}
+
+			if got := l.account("A1").Balance; got != tt.balance {
+				t.Fatalf("balance %d, want %d", got, tt.balance)
+			}
+			got, err := getFixedDeposit(l.staff(), fd.ID)
+			l.check(err)
+			if got.Status != tt.status || got.Principal != tt.principal || got.MaturityDate != tt.maturity {
+				t.Fatalf("deposit is %s with %d maturing %s, want %s with %d maturing %s",
+					got.Status, got.Principal, got.MaturityDate, tt.status, tt.principal, tt.maturity)
+			}
+			if got := l.glBalance(glInterestExpense); got != tt.interest {
+				t.Fatalf("interest expense %d, want %d", got, tt.interest)
+			}
+			held := int64(0)
+			if tt.status == fdActive {
+				held = -tt.principal
+			}
+			if got := l.glBalance(glFixedDeposits); got != held {
+				t.Fatalf("fixed deposits GL %d, want %d", got, held)
+			}
+		})
+	}
+}
+
+func TestProcessMaturedDepositsInPages(t *testing.T) {
+	l := newTestLedger(t)
+	l.openAccount("A1", "alice", 300000)
+	l.openAccount("B1", "bob", 200000)
+	_, err := l.cc.SetFixedDepositRate(l.as("admin", "Admin"), 12, 1200)
+	l.check(err)
+	paid := openFixedDeposit(l, "alice", "A1", fdPayout)
+	renewed := openFixedDeposit(l, "alice", "A1", fdRenewAll)
+	refused := openFixedDeposit(l, "bob", "B1", fdPayout)
+	b := l.account("B1")
+	b.Status = "FROZEN"
+	l.check(putAccount(l.last, b))
+	l.advance(365)
+
+	var processed, failed, pages int
+	bookmark := ""
+	for {
+		r, err := l.cc.ProcessMaturedDeposits(l.staff(), "2026-08-01", 1, bookmark)
+		l.check(err)
+		processed += r.Processed
+		failed += r.Failed
+		pages++
+		if r.Bookmark == "" {
+			break
+		}
+		bookmark = r.Bookmark
+		if pages > 10 {
+			t.Fatal("paging did not finish")
+		}
+	}
+	if processed != 2 || failed != 1 {
+		t.Fatalf("processed %d and failed %d, want 2 and 1", processed, failed)
+	}
+
+	for _, want := range []struct {
+		id     string
+		status string
+	}{{paid.ID, fdMatured}, {renewed.ID, fdActive}, {refused.ID, fdActive}} {
+		fd, err := getFixedDeposit(l.staff(), want.id)
+		l.check(err)
+		if fd.Status != want.status {
+			t.Fatalf("deposit %s is %s, want %s", fd.ID, fd.Status, want.status)
+		}
+	}
+	// The refused deposit posted nothing: only two deposits paid interest
+	if got := l.glBalance(glInterestExpense); got != 2*14400 {
+		t.Fatalf("interest expense %d, want %d", got, 2*14400)
+	}
+	if got := l.account("A1").Balance; got != 300000-240000+134400 {
+		t.Fatalf("balance %d", got)
+	}
+}
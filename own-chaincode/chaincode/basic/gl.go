@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ======================== Structs ==========================
+
+const (
+	glAccountObjectType = "GLAccount"
+	glEntryObjectType   = "glentry~code~date~txid~seq"
+	glTxIndex           = "gltx~txid~seq"
+
+	glAsset     = "ASSET"
+	glLiability = "LIABILITY"
+	glEquity    = "EQUITY"
+	glIncome    = "INCOME"
+	glExpense   = "EXPENSE"
+
+	// Chart of accounts codes the chaincode posts to
+	glCash              = "1000"
+	glLoans             = "1100"
+	glSettlementAccount = "1200"
+	glCustomerDeposits  = "2000"
+	glFixedDeposits     = "2100"
+	glEscrow            = "2200"
+	glMerchantPayable   = "2300"
+	glSuspense          = "2900"
+	glRetainedEarnings  = "3000"
+	glInterestIncome    = "4000"
+	glPenaltyIncome     = "4100"
+	glFeeIncome         = "4200"
+	glInterestExpense   = "5000"
+	glWriteOffExpense   = "5100"
+)
+
+// GLAccount is a general ledger account in the chart of accounts
+type GLAccount struct {
+	Code      string `json:"code"`
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	CreatedBy string `json:"createdBy,omitempty" metadata:",optional"`
+}
+
+// defaultChart is the built-in chart of accounts. Further accounts can be
+// added with CreateGLAccount.
+var defaultChart = []GLAccount{
+	{Code: glCash, Name: "Cash in vault", Type: glAsset},
+	{Code: glLoans, Name: "Loans receivable", Type: glAsset},
+	{Code: glSettlementAccount, Name: "Interbank settlement", Type: glAsset},
+	{Code: glCustomerDeposits, Name: "Customer deposits", Type: glLiability},
+	{Code: glFixedDeposits, Name: "Fixed deposits", Type: glLiability},
+	{Code: glEscrow, Name: "Escrow deposits", Type: glLiability},
+	{Code: glMerchantPayable, Name: "Merchant settlements payable", Type: glLiability},
+	{Code: glSuspense, Name: "Suspense", Type: glLiability},
+	{Code: glRetainedEarnings, Name: "Retained earnings", Type: glEquity},
+	{Code: glInterestIncome, Name: "Interest income", Type: glIncome},
+	{Code: glPenaltyIncome, Name: "Penalty interest income", Type: glIncome},
+	{Code: glFeeIncome, Name: "Fee income", Type: glIncome},
+	{Code: glInterestExpense, Name: "Interest expense", Type: glExpense},
+	{Code: glWriteOffExpense, Name: "Loan write-off expense", Type: glExpense},
+}
+
+// glLine is one pending journal line. Amount is signed: debits positive,
+// credits negative.
+type glLine struct {
+	code      string
+	amount    int64
+	narrative string
+	operation string
+}
+
+// GLEntry is a posted journal line
+type GLEntry struct {
+	GLCode    string `json:"glCode"`
+	Date      string `json:"date"`
+	TxID      string `json:"txId"`
+	Seq       int    `json:"seq"`
+	Debit     int64  `json:"debit"`
+	Credit    int64  `json:"credit"`
+	Narrative string `json:"narrative"`
+	Operation string `json:"operation,omitempty" metadata:",optional"`
+}
+
+// TrialBalanceLine is the net position of one GL account
+type TrialBalanceLine struct {
+	Code   string `json:"code"`
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Debit  int64  `json:"debit"`
+	Credit int64  `json:"credit"`
+}
+
+// TrialBalance lists every GL account with activity up to AsOfDate
+type TrialBalance struct {
+	AsOfDate    string             `json:"asOfDate"`
+	Lines       []TrialBalanceLine `json:"lines"`
+	TotalDebit  int64              `json:"totalDebit"`
+	TotalCredit int64              `json:"totalCredit"`
+	Balanced    bool               `json:"balanced"`
+}
+
+// GLActivity lists the entries of one GL account over a date range
+type GLActivity struct {
+	GLCode         string     `json:"glCode"`
+	From           string     `json:"from"`
+	To             string     `json:"to"`
+	OpeningBalance int64      `json:"openingBalance"`
+	Entries        []*GLEntry `json:"entries"`
+	ClosingBalance int64      `json:"closingBalance"`
+}
+
+// ======================== GL Helpers ========================
+
+func getGLAccount(ctx contractapi.TransactionContextInterface, code string) (*GLAccount, error) {
+	for _, a := range defaultChart {
+		if a.Code == code {
+			acct := a
+			return &acct, nil
+		}
+	}
+	key, err := makeKey(ctx, glAccountObjectType, code)
+	if err != nil {
+		return nil, err
+	}
+	var a GLAccount
+	found, err := getJSON(ctx, key, &a)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("GL account %s not found", code)
+	}
+	return &a, nil
+}
+
+// glPost adds a line to the transaction's journal. Lines are validated and
+// written by postJournal once the transaction function has returned.
+func glPost(ctx contractapi.TransactionContextInterface, code string, amount int64, narrative string) error {
+	tc, ok := ctx.(*TransactionContext)
+	if !ok {
+		return fmt.Errorf("GL journal is not available in this transaction context")
+	}
+	if amount == 0 {
+		return nil
+	}
+	tc.journal = append(tc.journal, glLine{code: code, amount: amount, narrative: narrative, operation: tc.operation})
+	return nil
+}
+
+func glDebit(ctx contractapi.TransactionContextInterface, code string, amount int64, narrative string) error {
+	return glPost(ctx, code, amount, narrative)
+}
+
+func glCredit(ctx contractapi.TransactionContextInterface, code string, amount int64, narrative string) error {
+	return glPost(ctx, code, -amount, narrative)
+}
+
+// postJournal runs after every transaction function. It refuses the whole
+// transaction if the journal lines do not net to zero, otherwise it writes
+// them as GL entries.
+func postJournal(ctx *TransactionContext) error {
+	if len(ctx.journal) == 0 {
+		return nil
+	}
+
+	var debits, credits int64
+	for _, l := range ctx.journal {
+		if _, err := getGLAccount(ctx, l.code); err != nil {
+			return err
+		}
+		if l.amount > 0 {
+			debits += l.amount
+		} else {
+			credits -= l.amount
+		}
+	}
+	if debits != credits {
+		return fmt.Errorf("unbalanced GL posting: debits %d, credits %d", debits, credits)
+	}
+
+	date, err := postingDate(ctx)
+	if err != nil {
+		return err
+	}
+	txID := ctx.GetStub().GetTxID()
+
+	for i, l := range ctx.journal {
+		entry := GLEntry{GLCode: l.code, Date: date, TxID: txID, Seq: i, Narrative: l.narrative, Operation: l.operation}
+		if l.amount > 0 {
+			entry.Debit = l.amount
+		} else {
+			entry.Credit = -l.amount
+		}
+
+		seq := fmt.Sprintf("%04d", i)
+		key, err := makeKey(ctx, glEntryObjectType, l.code, date, txID, seq)
+		if err != nil {
+			return err
+		}
+		if err := putJSON(ctx, key, entry); err != nil {
+			return err
+		}
+		indexKey, err := makeKey(ctx, glTxIndex, txID, seq)
+		if err != nil {
+			return err
+		}
+		if err := ctx.GetStub().PutState(indexKey, []byte(key)); err != nil {
+			return err
+		}
+	}
+	ctx.journal = nil
+	return nil
+}
+
+// glEntriesOfTx loads the GL entries posted by a transaction
+func glEntriesOfTx(ctx contractapi.TransactionContextInterface, txID string) ([]*GLEntry, error) {
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(glTxIndex, []string{txID})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var entries []*GLEntry
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		var e GLEntry
+		found, err := getJSON(ctx, string(res.Value), &e)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			entries = append(entries, &e)
+		}
+	}
+	return entries, nil
+}
+
+// glWalk calls fn for every entry of a GL account dated on or before to
+func glWalk(ctx contractapi.TransactionContextInterface, code string, to string, fn func(e *GLEntry)) error {
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(glEntryObjectType, []string{code})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return err
+		}
+		var e GLEntry
+		if err := json.Unmarshal(res.Value, &e); err != nil {
+			return fmt.Errorf("corrupt GL entry at %s: %v", res.Key, err)
+		}
+		if e.Date > to {
+			break
+		}
+		fn(&e)
+	}
+	return nil
+}
+
+func listGLAccounts(ctx contractapi.TransactionContextInterface) ([]GLAccount, error) {
+	accounts := append([]GLAccount{}, defaultChart...)
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(glAccountObjectType, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		var a GLAccount
+		if err := json.Unmarshal(res.Value, &a); err != nil {
+			return nil, fmt.Errorf("corrupt GL account at %s: %v", res.Key, err)
+		}
+		accounts = append(accounts, a)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Code < accounts[j].Code })
+	return accounts, nil
+}
+
+// ======================== GL Methods ========================
+
+// Add an account to the chart of accounts
+func (s *SmartContract) CreateGLAccount(ctx contractapi.TransactionContextInterface, code string, name string, accountType string) (*GLAccount, error) {
+
+	if err := requireRole(ctx, "SuperAdmin", "Admin"); err != nil {
+		return nil, err
+	}
+	if code == "" || name == "" {
+		return nil, fmt.Errorf("code and name required")
+	}
+	switch accountType {
+	case glAsset, glLiability, glEquity, glIncome, glExpense:
+	default:
+		return nil, fmt.Errorf("invalid GL account type: %s", accountType)
+	}
+	if _, err := getGLAccount(ctx, code); err == nil {
+		return nil, fmt.Errorf("GL account %s already exists", code)
+	}
+
+	cn, _ := getCallerCN(ctx)
+	a := &GLAccount{Code: code, Name: name, Type: accountType, CreatedBy: cn}
+	key, err := makeKey(ctx, glAccountObjectType, code)
+	if err != nil {
+		return nil, err
+	}
+	if err := putJSON(ctx, key, a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// List the chart of accounts
+func (s *SmartContract) GetChartOfAccounts(ctx contractapi.TransactionContextInterface) ([]GLAccount, error) {
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+	return listGLAccounts(ctx)
+}
+
+// Trial balance of all GL accounts as of a date
+func (s *SmartContract) GetTrialBalance(ctx contractapi.TransactionContextInterface, asOfDate string) (*TrialBalance, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+	if _, err := parseDate(asOfDate); err != nil {
+		return nil, err
+	}
+
+	accounts, err := listGLAccounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tb := &TrialBalance{AsOfDate: asOfDate, Lines: []TrialBalanceLine{}}
+	for _, a := range accounts {
+		var net int64
+		active := false
+		err := glWalk(ctx, a.Code, asOfDate, func(e *GLEntry) {
+			net += e.Debit - e.Credit
+			active = true
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !active {
+			continue
+		}
+
+		line := TrialBalanceLine{Code: a.Code, Name: a.Name, Type: a.Type}
+		if net >= 0 {
+			line.Debit = net
+		} else {
+			line.Credit = -net
+		}
+		tb.TotalDebit += line.Debit
+		tb.TotalCredit += line.Credit
+		tb.Lines = append(tb.Lines, line)
+	}
+	tb.Balanced = tb.TotalDebit == tb.TotalCredit
+	return tb, nil
+}
+
+// Entries of one GL account between two dates, inclusive. Balances are
+// debit-positive.
+func (s *SmartContract) GetGLAccountActivity(ctx contractapi.TransactionContextInterface, glCode string, from string, to string) (*GLActivity, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+	if _, err := getGLAccount(ctx, glCode); err != nil {
+		return nil, err
+	}
+	if _, err := parseDate(from); err != nil {
+		return nil, err
+	}
+	if _, err := parseDate(to); err != nil {
+		return nil, err
+	}
+	if from > to {
+		return nil, fmt.Errorf("from must not be after to")
+	}
+
+	activity := &GLActivity{GLCode: glCode, From: from, To: to, Entries: []*GLEntry{}}
+	err := glWalk(ctx, glCode, to, func(e *GLEntry) {
+		if e.Date < from {
+			activity.OpeningBalance += e.Debit - e.Credit
+			return
+		}
+		activity.Entries = append(activity.Entries, e)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	activity.ClosingBalance = activity.OpeningBalance
+	for _, e := range activity.Entries {
+		activity.ClosingBalance += e.Debit - e.Credit
+	}
+	return activity, nil
+}
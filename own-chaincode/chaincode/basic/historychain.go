@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ======================== Structs ==========================
+
+const (
+	chainHeadObjectType = "HistoryChain"
+	chainIndex          = "histchain~account~seq~hash"
+)
+
+// HistoryChainHead is the latest record of a deposit user's history chain
+type HistoryChainHead struct {
+	AccountID string `json:"accountId"`
+	Seq       int64  `json:"seq"`
+	HeadHash  string `json:"headHash"`
+}
+
+// ChainVerification reports the result of walking a history chain. When the
+// chain is broken, BrokenAt is the sequence number of the first bad record.
+type ChainVerification struct {
+	AccountID string `json:"accountId"`
+	Checked   int64  `json:"checked"`
+	Valid     bool   `json:"valid"`
+	BrokenAt  int64  `json:"brokenAt,omitempty" metadata:",optional"`
+	Hash      string `json:"hash,omitempty" metadata:",optional"`
+	Reason    string `json:"reason,omitempty" metadata:",optional"`
+	HeadHash  string `json:"headHash"`
+}
+
+// ======================== History Chain Helpers ========================
+
+// chainHash is the hash of a record's canonical content, including the hash
+// of the record before it
+func chainHash(h *TransactionHistory) string {
+	return hashOf(
+		h.PrevHash, h.DepositUser, strconv.FormatInt(h.Seq, 10),
+		h.Type, h.Amount, h.Date, h.Time, h.Narrative, h.TxID, h.ReversalOf, h.Operation, h.ClientRef,
+	)
+}
+
+func getChainHead(ctx contractapi.TransactionContextInterface, accountID string) (*HistoryChainHead, error) {
+	key, err := makeKey(ctx, chainHeadObjectType, accountID)
+	if err != nil {
+		return nil, err
+	}
+	head := HistoryChainHead{AccountID: accountID}
+	if _, err := getJSON(ctx, key, &head); err != nil {
+		return nil, err
+	}
+	return &head, nil
+}
+
+// appendHistory links a record to the end of its deposit user's chain,
+// computes its hash and stores it under that hash
+func appendHistory(ctx contractapi.TransactionContextInterface, record *TransactionHistory) error {
+	head, err := getChainHead(ctx, record.DepositUser)
+	if err != nil {
+		return err
+	}
+	record.Seq = head.Seq + 1
+	record.PrevHash = head.HeadHash
+	record.HistoryHash = chainHash(record)
+
+	existing, err := ctx.GetStub().GetState(record.HistoryHash)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("history %s already exists", record.HistoryHash)
+	}
+	if err := putJSON(ctx, record.HistoryHash, record); err != nil {
+		return err
+	}
+
+	indexKey, err := makeKey(ctx, chainIndex, record.DepositUser, fmt.Sprintf("%012d", record.Seq), record.HistoryHash)
+	if err != nil {
+		return err
+	}
+	if err := ctx.GetStub().PutState(indexKey, []byte{0x00}); err != nil {
+		return err
+	}
+
+	head.Seq = record.Seq
+	head.HeadHash = record.HistoryHash
+	key, err := makeKey(ctx, chainHeadObjectType, record.DepositUser)
+	if err != nil {
+		return err
+	}
+	return putJSON(ctx, key, head)
+}
+
+// ======================== History Chain Methods ========================
+
+// Walk an account's history chain from the first record and report the
+// first record whose hash, sequence or link does not check out
+func (s *SmartContract) VerifyHistoryChain(ctx contractapi.TransactionContextInterface, accountID string) (*ChainVerification, error) {
+
+	if a, err := getAccount(ctx, accountID); err == nil {
+		if err := requireAccountAccess(ctx, a); err != nil {
+			return nil, err
+		}
+	} else if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+
+	head, err := getChainHead(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	result := &ChainVerification{AccountID: accountID, Valid: true, HeadHash: head.HeadHash}
+	broken := func(seq int64, hash string, reason string) {
+		result.Valid = false
+		result.BrokenAt = seq
+		result.Hash = hash
+		result.Reason = reason
+	}
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(chainIndex, []string{accountID})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	prev := ""
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		expected := result.Checked + 1
+		_, parts, err := ctx.GetStub().SplitCompositeKey(res.Key)
+		if err != nil || len(parts) != 3 {
+			broken(expected, "", "malformed chain index entry")
+			return result, nil
+		}
+		hash := parts[2]
+
+		var h TransactionHistory
+		found, err := getJSON(ctx, hash, &h)
+		switch {
+		case err != nil:
+			broken(expected, hash, err.Error())
+		case !found:
+			broken(expected, hash, "record missing")
+		case h.Seq != expected || parts[1] != fmt.Sprintf("%012d", expected):
+			broken(expected, hash, fmt.Sprintf("sequence %d out of order", h.Seq))
+		case h.PrevHash != prev:
+			broken(expected, hash, "previous hash does not match")
+		case h.HistoryHash != hash || chainHash(&h) != hash:
+			broken(expected, hash, "content does not match hash")
+		}
+		if !result.Valid {
+			return result, nil
+		}
+		result.Checked = expected
+		prev = hash
+	}
+
+	if result.Checked != head.Seq || prev != head.HeadHash {
+		broken(result.Checked+1, head.HeadHash, "chain head does not match the last record")
+	}
+	return result, nil
+}
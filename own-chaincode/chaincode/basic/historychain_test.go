@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// chainRecords lists the history hashes of an account's chain in order
+func chainRecords(l *testLedger, accountID string) []string {
+	l.t.Helper()
+	l.commit()
+	iter, err := l.stub.GetStateByPartialCompositeKey(chainIndex, []string{accountID})
+	l.check(err)
+	var hashes []string
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		l.check(err)
+		_, parts, err := l.stub.SplitCompositeKey(kv.Key)
+		l.check(err)
+		hashes = append(hashes, parts[2])
+	}
+	return hashes
+}
+
+// rewriteHistory edits a committed history record in place, as someone with
+// write access to the state database might
+func rewriteHistory(l *testLedger, hash string, edit func(h *TransactionHistory)) {
+	l.t.Helper()
+	var h TransactionHistory
+	l.check(json.Unmarshal(l.stub.state[hash], &h))
+	edit(&h)
+	data, err := json.Marshal(h)
+	l.check(err)
+	l.stub.state[hash] = data
+}
+
+func TestVerifyHistoryChain(t *testing.T) {
+	tests := []struct {
+		name     string
+		tamper   func(l *testLedger, hashes []string)
+		brokenAt int64
+		reason   string
+	}{
+		{name: "intact"},
+		{name: "amount edited", brokenAt: 2, reason: "content does not match hash",
+			tamper: func(l *testLedger, hashes []string) {
+				rewriteHistory(l, hashes[1], func(h *TransactionHistory) { h.Amount = "1" })
+			}},
+		{name: "record and hash rewritten", brokenAt: 3, reason: "previous hash does not match",
+			tamper: func(l *testLedger, hashes []string) {
+				// Re-hashing record 2 and re-indexing it still breaks the link from record 3
+				var h TransactionHistory
+				l.check(json.Unmarshal(l.stub.state[hashes[1]], &h))
+				h.Amount = "1"
+				h.HistoryHash = chainHash(&h)
+				data, err := json.Marshal(h)
+				l.check(err)
+				oldKey, err := l.stub.CreateCompositeKey(chainIndex, []string{"A1", "000000000002", hashes[1]})
+				l.check(err)
+				newKey, err := l.stub.CreateCompositeKey(chainIndex, []string{"A1", "000000000002", h.HistoryHash})
+				l.check(err)
+				delete(l.stub.state, oldKey)
+				delete(l.stub.state, hashes[1])
+				l.stub.state[newKey] = []byte{0x00}
+				l.stub.state[h.HistoryHash] = data
+			}},
+		{name: "record deleted", brokenAt: 2, reason: "record missing",
+			tamper: func(l *testLedger, hashes []string) { delete(l.stub.state, hashes[1]) }},
+		{name: "last record dropped", brokenAt: 3, reason: "chain head does not match",
+			tamper: func(l *testLedger, hashes []string) {
+				key, err := l.stub.CreateCompositeKey(chainIndex, []string{"A1", "000000000003", hashes[2]})
+				l.check(err)
+				delete(l.stub.state, key)
+			}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLedger(t)
+			l.openAccount("A1", "alice", 500)
+			_, err := l.cc.Deposit(l.staff(), "A1", 200)
+			l.check(err)
+			_, err = l.cc.Withdraw(l.staff(), "A1", 50)
+			l.check(err)
+			hashes := chainRecords(l, "A1")
+			if len(hashes) != 3 {
+				t.Fatalf("chain has %d records, want 3", len(hashes))
+			}
+			if tt.tamper != nil {
+				tt.tamper(l, hashes)
+			}
+
+			got, err := l.cc.VerifyHistoryChain(l.as("alice", "User"), "A1")
+			l.check(err)
+			if tt.reason == "" {
+				if !got.Valid || got.Checked != 3 || got.HeadHash != hashes[2] {
+					t.Fatalf("intact chain reported as %+v", got)
+				}
+				return
+			}
+			if got.Valid || got.BrokenAt != tt.brokenAt || !strings.HasPrefix(got.Reason, tt.reason) {
+				t.Fatalf("got %+v, want broken at %d: %s", got, tt.brokenAt, tt.reason)
+			}
+		})
+	}
+}
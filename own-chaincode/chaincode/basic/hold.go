@@ -0,0 +1,475 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ======================== Structs ==========================
+
+const (
+	holdObjectType = "Hold"
+	holdIndex      = "hold~account~id"
+
+	holdActive   = "ACTIVE"
+	holdReleased = "RELEASED"
+	holdCaptured = "CAPTURED"
+	holdExpired  = "EXPIRED"
+)
+
+// Hold blocks part of an account balance, e.g. for a card authorisation, a
+// court order or loan collateral. ExpiresAt is RFC3339; empty means the hold
+// stays until it is released or captured. Owner is the hashed time lock or
+// payment batch a hold was placed for; such holds are resolved only through
+// their owner.
+type Hold struct {
+	ID         string `json:"id"`
+	AccountID  string `json:"accountId"`
+	Amount     int64  `json:"amount"`
+	Reason     string `json:"reason"`
+	Owner      string `json:"owner,omitempty" metadata:",optional"`
+	ExpiresAt  string `json:"expiresAt,omitempty" metadata:",optional"`
+	Status     string `json:"status"`
+	Captured   int64  `json:"captured"`
+	PlacedBy   string `json:"placedBy"`
+	PlacedAt   string `json:"placedAt"`
+	ResolvedBy string `json:"resolvedBy,omitempty" metadata:",optional"`
+	ResolvedAt string `json:"resolvedAt,omitempty" metadata:",optional"`
+}
+
+// ======================== Hold Helpers ========================
+
+func getHold(ctx contractapi.TransactionContextInterface, id string) (*Hold, error) {
+	if id == "" {
+		return nil, fmt.Errorf("hold id required")
+	}
+	key, err := makeKey(ctx, holdObjectType, id)
+	if err != nil {
+		return nil, err
+	}
+	var h Hold
+	found, err := getJSON(ctx, key, &h)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("hold %s not found", id)
+	}
+	return &h, nil
+}
+
+func putHold(ctx contractapi.TransactionContextInterface, h *Hold) error {
+	key, err := makeKey(ctx, holdObjectType, h.ID)
+	if err != nil {
+		return err
+	}
+	return putJSON(ctx, key, h)
+}
+
+// closeHold resolves an active hold and removes it from the account's active index
+func closeHold(ctx contractapi.TransactionContextInterface, a *Account, h *Hold, status string) error {
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+	if h.Status != holdActive {
+		return fmt.Errorf("hold %s is %s", h.ID, h.Status)
+	}
+	cn, _ := getCallerCN(ctx)
+
+	a.HeldAmount -= h.Amount
+	h.Status = status
+	if status != holdExpired {
+		h.ResolvedBy = cn
+	}
+	h.ResolvedAt = now.Format(time.RFC3339)
+
+	key, err := makeKey(ctx, holdIndex, a.ID, h.ID)
+	if err != nil {
+		return err
+	}
+	if err := ctx.GetStub().DelState(key); err != nil {
+		return err
+	}
+	return putHold(ctx, h)
+}
+
+// holdExpiredAt reports whether an active hold has expired at now
+func holdExpiredAt(h *Hold, now time.Time) (bool, error) {
+	if h.Status != holdActive || h.ExpiresAt == "" {
+		return false, nil
+	}
+	expiry, err := time.Parse(time.RFC3339, h.ExpiresAt)
+	if err != nil {
+		return false, fmt.Errorf("hold %s has invalid expiry: %v", h.ID, err)
+	}
+	return !now.Before(expiry), nil
+}
+
+// releaseExpiredHolds lazily expires holds whose ExpiresAt has passed, so that
+// no scheduler is needed. The account is saved if any hold expired.
+func releaseExpiredHolds(ctx contractapi.TransactionContextInterface, a *Account) error {
+	if a.HeldAmount == 0 {
+		return nil
+	}
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(holdIndex, []string{a.ID})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	anyExpired := false
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return err
+		}
+		_, parts, err := ctx.GetStub().SplitCompositeKey(res.Key)
+		if err != nil || len(parts) != 2 {
+			continue
+		}
+		h, err := getHold(ctx, parts[1])
+		if err != nil {
+			return err
+		}
+		expired, err := holdExpiredAt(h, now)
+		if err != nil {
+			return err
+		}
+		if expired {
+			if err := closeHold(ctx, a, h, holdExpired); err != nil {
+				return err
+			}
+			anyExpired = true
+		}
+	}
+	if !anyExpired {
+		return nil
+	}
+	return putAccount(ctx, a)
+}
+
+// expireHolds expires one page of active holds whose ExpiresAt has passed,
+// resuming after bookmark
+func expireHolds(ctx contractapi.TransactionContextInterface, pageSize int, bookmark string) (*BatchResult, error) {
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &BatchResult{}
+	next, err := scanIndex(ctx, holdIndex, nil, bookmark, pageSize,
+		func(_ string, parts []string, _ []byte) (bool, error) {
+			if len(parts) != 2 {
+				return true, nil
+			}
+			h, err := getHold(ctx, parts[1])
+			if err != nil {
+				return false, err
+			}
+			expired, err := holdExpiredAt(h, now)
+			if err != nil {
+				return false, err
+			}
+			if !expired {
+				return true, nil
+			}
+			a, err := getAccount(ctx, h.AccountID)
+			if err != nil {
+				return false, err
+			}
+			if err := closeHold(ctx, a, h, holdExpired); err != nil {
+				return false, err
+			}
+			result.Processed++
+			return true, putAccount(ctx, a)
+		})
+	if err != nil {
+		return nil, err
+	}
+	result.Bookmark = next
+	return result, nil
+}
+
+// availableBalance is the ledger balance less active holds
+func availableBalance(ctx contractapi.TransactionContextInterface, a *Account) (int64, error) {
+	if err := releaseExpiredHolds(ctx, a); err != nil {
+		return 0, err
+	}
+	return a.Balance - a.HeldAmount, nil
+}
+
+// placeHold blocks amount of the available balance of an account and saves it
+func placeHold(
+	ctx contractapi.TransactionContextInterface,
+	a *Account, amount int64, reason string, owner string, expiresAt string,
+) (*Hold, error) {
+	if a.Status != accountActive {
+		return nil, fmt.Errorf("account %s is %s", a.ID, a.Status)
+	}
+	available, err := availableBalance(ctx, a)
+	if err != nil {
+		return nil, err
+	}
+	if available < amount {
+		return nil, fmt.Errorf("insufficient available balance in account %s", a.ID)
+	}
+
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cn, _ := getCallerCN(ctx)
+	h := &Hold{
+		ID:        newID(ctx, "HLD"),
+		AccountID: a.ID,
+		Amount:    amount,
+		Reason:    reason,
+		Owner:     owner,
+		ExpiresAt: expiresAt,
+		Status:    holdActive,
+		PlacedBy:  cn,
+		PlacedAt:  now.Format(time.RFC3339),
+	}
+	a.HeldAmount += amount
+
+	key, err := makeKey(ctx, holdIndex, a.ID, h.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(key, []byte{0x00}); err != nil {
+		return nil, err
+	}
+	if err := putHold(ctx, h); err != nil {
+		return nil, err
+	}
+	if err := putAccount(ctx, a); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// ======================== Hold Methods ========================
+
+// Place a hold on part of an account balance
+func (s *SmartContract) PlaceHold(
+	ctx contractapi.TransactionContextInterface,
+	accountID string, amount int64, reason string, expiresAt string,
+) (*Hold, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+	if amount <= 0 || reason == "" {
+		return nil, fmt.Errorf("positive amount and reason required")
+	}
+
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if expiresAt != "" {
+		expiry, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expiresAt %q, expected RFC3339", expiresAt)
+		}
+		if !expiry.After(now) {
+			return nil, fmt.Errorf("expiresAt must be in the future")
+		}
+	}
+
+	a, err := getAccount(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountBank(ctx, a); err != nil {
+		return nil, err
+	}
+	return placeHold(ctx, a, amount, reason, "", expiresAt)
+}
+
+// Release a hold without moving funds
+func (s *SmartContract) ReleaseHold(ctx contractapi.TransactionContextInterface, id string) (*Hold, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+
+	h, err := getHold(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	a, err := getAccount(ctx, h.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountBank(ctx, a); err != nil {
+		return nil, err
+	}
+	if err := releaseExpiredHolds(ctx, a); err != nil {
+		return nil, err
+	}
+	if h, err = getHold(ctx, id); err != nil {
+		return nil, err
+	}
+	if h.Status != holdActive {
+		return nil, fmt.Errorf("hold %s is %s", h.ID, h.Status)
+	}
+	if h.Owner != "" {
+		return nil, fmt.Errorf("hold %s belongs to %s and is released through it", h.ID, h.Owner)
+	}
+
+	if err := closeHold(ctx, a, h, holdReleased); err != nil {
+		return nil, err
+	}
+	if err := putAccount(ctx, a); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Capture some or all of a held amount, debiting the account and crediting
+// either another account or, if none is given, the suspense GL account. Any
+// uncaptured remainder is released.
+func (s *SmartContract) CaptureHold(
+	ctx contractapi.TransactionContextInterface,
+	id string, amount int64, creditAccount string,
+) (*Hold, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+
+	h, err := getHold(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if amount <= 0 || amount > h.Amount {
+		return nil, fmt.Errorf("capture amount must be between 1 and %d", h.Amount)
+	}
+	a, err := getAccount(ctx, h.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountBank(ctx, a); err != nil {
+		return nil, err
+	}
+	if creditAccount == a.ID {
+		return nil, fmt.Errorf("cannot capture into the held account")
+	}
+	if err := releaseExpiredHolds(ctx, a); err != nil {
+		return nil, err
+	}
+	if h, err = getHold(ctx, id); err != nil {
+		return nil, err
+	}
+	if h.Status != holdActive {
+		return nil, fmt.Errorf("hold %s is %s", h.ID, h.Status)
+	}
+	if h.Owner != "" {
+		return nil, fmt.Errorf("hold %s belongs to %s and is captured through it", h.ID, h.Owner)
+	}
+
+	// Free the hold first so the debit can use the funds it was blocking
+	if err := closeHold(ctx, a, h, holdCaptured); err != nil {
+		return nil, err
+	}
+	h.Captured = amount
+	if err := putHold(ctx, h); err != nil {
+		return nil, err
+	}
+	if err := postToAccount(ctx, a, -amount, "Hold capture "+h.ID+": "+h.Reason); err != nil {
+		return nil, err
+	}
+
+	if creditAccount == "" {
+		// No beneficiary account: park the funds until they are paid away
+		if err := glCredit(ctx, glSuspense, amount, "Hold capture "+h.ID); err != nil {
+			return nil, err
+		}
+		return h, nil
+	}
+	to, err := getAccount(ctx, creditAccount)
+	if err != nil {
+		return nil, err
+	}
+	if err := postToAccount(ctx, to, amount, "Hold capture "+h.ID+" from "+a.ID); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Fetch hold
+func (s *SmartContract) GetHold(ctx contractapi.TransactionContextInterface, id string) (*Hold, error) {
+	h, err := getHold(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	a, err := getAccount(ctx, h.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountAccess(ctx, a); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// List active holds on an account
+func (s *SmartContract) ListHolds(ctx contractapi.TransactionContextInterface, accountID string) ([]*Hold, error) {
+	a, err := getAccount(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountAccess(ctx, a); err != nil {
+		return nil, err
+	}
+	if err := releaseExpiredHolds(ctx, a); err != nil {
+		return nil, err
+	}
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(holdIndex, []string{a.ID})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var list []*Hold
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, parts, err := ctx.GetStub().SplitCompositeKey(res.Key)
+		if err != nil || len(parts) != 2 {
+			continue
+		}
+		h, err := getHold(ctx, parts[1])
+		if err != nil {
+			return nil, err
+		}
+		if h.Status == holdActive {
+			list = append(list, h)
+		}
+	}
+	return list, nil
+}
+
+// Available balance of an account: ledger balance less active holds
+func (s *SmartContract) GetAvailableBalance(ctx contractapi.TransactionContextInterface, accountID string) (int64, error) {
+	a, err := getAccount(ctx, accountID)
+	if err != nil {
+		return 0, err
+	}
+	if err := requireAccountAccess(ctx, a); err != nil {
+		return 0, err
+	}
+	return availableBalance(ctx, a)
+}
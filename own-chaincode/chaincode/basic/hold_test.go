@@ -0,0 +1,130 @@
+package main
+
+import "testing"
+
+func TestCaptureHold(t *testing.T) {
+	tests := []struct {
+		name      string
+		expiresAt string
+		release   bool
+		advance   int
+		capture   int64
+		credit    string
+		wantErr   string
+		balance   int64
+		available int64
+		credited  int64
+		suspense  int64
+		status    string
+	}{
+		{name: "full capture to an account", capture: 6000, credit: "B1",
+			balance: 4000, available: 4000, credited: 6000, status: holdCaptured},
+		{name: "partial capture releases the rest", capture: 2500, credit: "B1",
+			balance: 7500, available: 7500, credited: 2500, status: holdCaptured},
+		{name: "capture without an account goes to suspense", capture: 6000,
+			balance: 4000, available: 4000, suspense: -6000, status: holdCaptured},
+		{name: "more than held", capture: 6001, credit: "B1", wantErr: "capture amount must be between",
+			balance: 10000, available: 4000, status: holdActive},
+		{name: "into the held account", capture: 100, credit: "A1", wantErr: "held account",
+			balance: 10000, available: 4000, status: holdActive},
+		{name: "released hold", release: true, capture: 100, credit: "B1", wantErr: "is RELEASED",
+			balance: 10000, available: 10000, status: holdReleased},
+		{name: "expired hold", expiresAt: "2025-08-02T10:00:00Z", advance: 2, capture: 100, credit: "B1", wantErr: "is EXPIRED",
+			balance: 10000, available: 10000, status: holdExpired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLedger(t)
+			l.openAccount("A1", "alice", 10000)
+			l.openAccount("B1", "bob", 0)
+			h, err := l.cc.PlaceHold(l.staff(), "A1", 6000, "card authorisation", tt.expiresAt)
+			l.check(err)
+			if tt.release {
+				_, err = l.cc.ReleaseHold(l.staff(), h.ID)
+				l.check(err)
+			}
+			l.advance(tt.advance)
+
+			_, err = l.cc.CaptureHold(l.staff(), h.ID, tt.capture, tt.credit)
+			if tt.wantErr != "" {
+				l.checkFails(err, tt.wantErr)
+			} else {
+				l.check(err)
+			}
+
+			l.expectBalances("A1", tt.balance, tt.available)
+			l.expectBalances("B1", tt.credited, tt.credited)
+			if got := l.glBalance(glSuspense); got != tt.suspense {
+				t.Fatalf("suspense %d, want %d", got, tt.suspense)
+			}
+			got, err := getHold(l.staff(), h.ID)
+			l.check(err)
+			if got.Status != tt.status {
+				t.Fatalf("hold is %s, want %s", got.Status, tt.status)
+			}
+			if tt.wantErr == "" && got.Captured != tt.capture {
+				t.Fatalf("captured %d, want %d", got.Captured, tt.capture)
+			}
+		})
+	}
+}
+
+func TestCloseHold(t *testing.T) {
+	tests := []struct {
+		name    string
+		owner   string
+		close   func(l *testLedger, id string) (*Hold, error)
+		wantErr string
+		status  string
+	}{
+		{name: "release", close: func(l *testLedger, id string) (*Hold, error) {
+			return l.cc.ReleaseHold(l.staff(), id)
+		}, status: holdReleased},
+		{name: "release twice", close: func(l *testLedger, id string) (*Hold, error) {
+			if _, err := l.cc.ReleaseHold(l.staff(), id); err != nil {
+				return nil, err
+			}
+			return l.cc.ReleaseHold(l.staff(), id)
+		}, wantErr: "is RELEASED", status: holdReleased},
+		{name: "customer cannot release", close: func(l *testLedger, id string) (*Hold, error) {
+			return l.cc.ReleaseHold(l.as("alice", "User"), id)
+		}, wantErr: "access denied", status: holdActive},
+		{name: "owned hold is not released directly", owner: "HTL1", close: func(l *testLedger, id string) (*Hold, error) {
+			return l.cc.ReleaseHold(l.staff(), id)
+		}, wantErr: "belongs to HTL1", status: holdActive},
+		{name: "owned hold is not captured directly", owner: "BATCH1", close: func(l *testLedger, id string) (*Hold, error) {
+			return l.cc.CaptureHold(l.staff(), id, 100, "")
+		}, wantErr: "belongs to BATCH1", status: holdActive},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLedger(t)
+			l.openAccount("A1", "alice", 10000)
+			ctx := l.staff()
+			a, err := getAccount(ctx, "A1")
+			l.check(err)
+			h, err := placeHold(ctx, a, 6000, "lien", tt.owner, "")
+			l.check(err)
+
+			_, err = tt.close(l, h.ID)
+			if tt.wantErr != "" {
+				l.checkFails(err, tt.wantErr)
+			} else {
+				l.check(err)
+			}
+
+			got, err := getHold(l.staff(), h.ID)
+			l.check(err)
+			if got.Status != tt.status {
+				t.Fatalf("hold is %s, want %s", got.Status, tt.status)
+			}
+			available := int64(10000)
+			if tt.status == holdActive {
+				available = 4000
+			}
+			l.expectBalances("A1", 10000, available)
+		})
+	}
+}
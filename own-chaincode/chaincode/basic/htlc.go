@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ======================== Structs ==========================
+
+const (
+	lockObjectType = "HashedTimeLock"
+
+	lockActive   = "LOCKED"
+	lockClaimed  = "CLAIMED"
+	lockRefunded = "REFUNDED"
+)
+
+// HashedTimeLock is a conditional transfer. The amount is held on the
+// sender's account until someone reveals the preimage whose SHA-256 is
+// Hashlock, which pays the recipient, or until TimeoutAt (RFC3339) has
+// passed, after which it can be refunded. Preimage is published on claim so
+// that the counterparty of a swap can use it. Fee is the transfer fee,
+// charged when the funds are locked so that it can never block a claim; it
+// is not refunded on timeout.
+type HashedTimeLock struct {
+	ID          string `json:"id"`
+	FromAccount string `json:"fromAccount"`
+	ToAccount   string `json:"toAccount"`
+	Amount      int64  `json:"amount"`
+	Fee         int64  `json:"fee,omitempty" metadata:",optional"`
+	Hashlock    string `json:"hashlock"`
+	TimeoutAt   string `json:"timeoutAt"`
+	HoldID      string `json:"holdId"`
+	Status      string `json:"status"`
+	Preimage    string `json:"preimage,omitempty" metadata:",optional"`
+	LockedBy    string `json:"lockedBy"`
+	LockedAt    string `json:"lockedAt"`
+	ResolvedBy  string `json:"resolvedBy,omitempty" metadata:",optional"`
+	ResolvedAt  string `json:"resolvedAt,omitempty" metadata:",optional"`
+}
+
+// ======================== Hashed Time Lock Helpers ========================
+
+func getLock(ctx contractapi.TransactionContextInterface, id string) (*HashedTimeLock, error) {
+	if id == "" {
+		return nil, fmt.Errorf("lock id required")
+	}
+	key, err := makeKey(ctx, lockObjectType, id)
+	if err != nil {
+		return nil, err
+	}
+	var l HashedTimeLock
+	found, err := getJSON(ctx, key, &l)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("lock %s not found", id)
+	}
+	return &l, nil
+}
+
+func putLock(ctx contractapi.TransactionContextInterface, l *HashedTimeLock) error {
+	key, err := makeKey(ctx, lockObjectType, l.ID)
+	if err != nil {
+		return err
+	}
+	return putJSON(ctx, key, l)
+}
+
+// unlock frees the hold of a lock on its sender's account and records how
+// the lock was resolved. The account is returned for the claim to debit.
+func unlock(ctx contractapi.TransactionContextInterface, l *HashedTimeLock, status string, holdStatus string) (*Account, error) {
+	from, err := getAccount(ctx, l.FromAccount)
+	if err != nil {
+		return nil, err
+	}
+	h, err := getHold(ctx, l.HoldID)
+	if err != nil {
+		return nil, err
+	}
+	if err := closeHold(ctx, from, h, holdStatus); err != nil {
+		return nil, err
+	}
+	if err := putAccount(ctx, from); err != nil {
+		return nil, err
+	}
+
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	l.Status = status
+	l.ResolvedBy, _ = getCallerCN(ctx)
+	l.ResolvedAt = now.Format(time.RFC3339)
+	return from, putLock(ctx, l)
+}
+
+// ======================== Hashed Time Lock Methods ========================
+
+// Lock funds on an account for a recipient until the preimage of hashlock
+// (hex SHA-256) is revealed or timeoutAt (RFC3339) passes
+func (s *SmartContract) LockFunds(
+	ctx contractapi.TransactionContextInterface,
+	from string, to string, amount int64, hashlock string, timeoutAt string,
+) (*HashedTimeLock, error) {
+
+	if amount <= 0 {
+		return nil, fmt.Errorf("amount must be positive")
+	}
+	if from == to {
+		return nil, fmt.Errorf("cannot lock funds for the same account")
+	}
+	hashlock = strings.ToLower(hashlock)
+	if h, err := hex.DecodeString(hashlock); err != nil || len(h) != sha256.Size {
+		return nil, fmt.Errorf("hashlock must be a hex SHA-256 digest")
+	}
+	timeout, err := time.Parse(time.RFC3339, timeoutAt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timeoutAt %q, expected RFC3339", timeoutAt)
+	}
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !timeout.After(now) {
+		return nil, fmt.Errorf("timeoutAt must be in the future")
+	}
+
+	source, err := getAccount(ctx, from)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireDebitAuthority(ctx, source); err != nil {
+		return nil, err
+	}
+	recipient, err := getAccount(ctx, to)
+	if err != nil {
+		return nil, err
+	}
+	if recipient.Status != accountActive {
+		return nil, fmt.Errorf("account %s is %s", recipient.ID, recipient.Status)
+	}
+	if err := requireSameBank(source, recipient); err != nil {
+		return nil, err
+	}
+	if err := checkBeneficiary(ctx, source, recipient, amount); err != nil {
+		return nil, err
+	}
+	if err := enforceLimits(ctx, &LimitedOperation{Operation: opTransfer, AccountID: source.ID, ToAccount: recipient.ID, Amount: amount}); err != nil {
+		return nil, err
+	}
+
+	id := newID(ctx, "HTL")
+	h, err := placeHold(ctx, source, amount, "Hashed time lock "+id, id, "")
+	if err != nil {
+		return nil, err
+	}
+	fee, _, err := feeFor(ctx, opTransfer, source, feeChannel(ctx), amount)
+	if err != nil {
+		return nil, err
+	}
+	if err := postFee(ctx, source, opTransfer, fee); err != nil {
+		return nil, err
+	}
+	cn, _ := getCallerCN(ctx)
+	l := &HashedTimeLock{
+		ID:          id,
+		FromAccount: source.ID,
+		ToAccount:   recipient.ID,
+		Amount:      amount,
+		Fee:         fee,
+		Hashlock:    hashlock,
+		TimeoutAt:   timeout.UTC().Format(time.RFC3339),
+		HoldID:      h.ID,
+		Status:      lockActive,
+		LockedBy:    cn,
+		LockedAt:    now.Format(time.RFC3339),
+	}
+	if err := putLock(ctx, l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Pay a locked amount to its recipient by revealing the hex preimage of the
+// hashlock before the timeout
+func (s *SmartContract) ClaimWithPreimage(ctx contractapi.TransactionContextInterface, lockID string, preimage string) (*HashedTimeLock, error) {
+
+	l, err := getLock(ctx, lockID)
+	if err != nil {
+		return nil, err
+	}
+	if l.Status != lockActive {
+		return nil, fmt.Errorf("lock %s is %s", l.ID, l.Status)
+	}
+	secret, err := hex.DecodeString(preimage)
+	if err != nil {
+		return nil, fmt.Errorf("preimage must be hex encoded")
+	}
+	sum := sha256.Sum256(secret)
+	if hex.EncodeToString(sum[:]) != l.Hashlock {
+		return nil, fmt.Errorf("preimage does not match the hashlock of lock %s", l.ID)
+	}
+	timeout, err := time.Parse(time.RFC3339, l.TimeoutAt)
+	if err != nil {
+		return nil, fmt.Errorf("lock %s has invalid timeout: %v", l.ID, err)
+	}
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !now.Before(timeout) {
+		return nil, fmt.Errorf("lock %s timed out at %s", l.ID, l.TimeoutAt)
+	}
+
+	l.Preimage = strings.ToLower(preimage)
+	from, err := unlock(ctx, l, lockClaimed, holdCaptured)
+	if err != nil {
+		return nil, err
+	}
+	to, err := getAccount(ctx, l.ToAccount)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireSameBank(from, to); err != nil {
+		return nil, err
+	}
+	if err := postToAccount(ctx, from, -l.Amount, "Hashed time lock "+l.ID+" to "+to.ID); err != nil {
+		return nil, err
+	}
+	if err := postToAccount(ctx, to, l.Amount, "Hashed time lock "+l.ID+" from "+from.ID); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Return locked funds to the sender once the timeout has passed
+func (s *SmartContract) RefundAfterTimeout(ctx contractapi.TransactionContextInterface, lockID string) (*HashedTimeLock, error) {
+
+	l, err := getLock(ctx, lockID)
+	if err != nil {
+		return nil, err
+	}
+	if l.Status != lockActive {
+		return nil, fmt.Errorf("lock %s is %s", l.ID, l.Status)
+	}
+	timeout, err := time.Parse(time.RFC3339, l.TimeoutAt)
+	if err != nil {
+		return nil, fmt.Errorf("lock %s has invalid timeout: %v", l.ID, err)
+	}
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if now.Before(timeout) {
+		return nil, fmt.Errorf("lock %s cannot be refunded before %s", l.ID, l.TimeoutAt)
+	}
+
+	if _, err := unlock(ctx, l, lockRefunded, holdReleased); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Fetch hashed time lock
+func (s *SmartContract) GetLock(ctx contractapi.TransactionContextInterface, id string) (*HashedTimeLock, error) {
+	l, err := getLock(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	from, err := getAccount(ctx, l.FromAccount)
+	if err != nil {
+		return nil, err
+	}
+	if requireAccountAccess(ctx, from) == nil {
+		return l, nil
+	}
+	to, err := getAccount(ctx, l.ToAccount)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountAccess(ctx, to); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestHashedTimeLock(t *testing.T) {
+	preimage := hex.EncodeToString([]byte("swap secret"))
+	sum := sha256.Sum256([]byte("swap secret"))
+	hashlock := hex.EncodeToString(sum[:])
+
+	claim := func(p string) func(l *testLedger, id string) error {
+		return func(l *testLedger, id string) error {
+			_, err := l.cc.ClaimWithPreimage(l.as("bob", "User"), id, p)
+			return err
+		}
+	}
+	refund := func(l *testLedger, id string) error {
+		_, err := l.cc.RefundAfterTimeout(l.as("alice", "User"), id)
+		return err
+	}
+
+	tests := []struct {
+		name      string
+		days      int // after locking, against a timeout one day out
+		steps     []func(l *testLedger, id string) error
+		wantErr   string
+		status    string
+		balance   int64 // of the sender
+		available int64
+		to        int64
+	}{
+		{name: "claim before timeout", steps: []func(*testLedger, string) error{claim(preimage)},
+			status: lockClaimed, balance: 700, available: 700, to: 300},
+		{name: "preimage in upper case", steps: []func(*testLedger, string) error{claim(strings.ToUpper(preimage))},
+			status: lockClaimed, balance: 700, available: 700, to: 300},
+		{name: "wrong preimage", steps: []func(*testLedger, string) error{claim(hex.EncodeToString([]byte("guess")))},
+			wantErr: "does not match the hashlock", status: lockActive, balance: 1000, available: 700},
+		{name: "claim at timeout", days: 1, steps: []func(*testLedger, string) error{claim(preimage)},
+			wantErr: "timed out", status: lockActive, balance: 1000, available: 700},
+		{name: "refund before timeout", steps: []func(*testLedger, string) error{refund},
+			wantErr: "cannot be refunded before", status: lockActive, balance: 1000, available: 700},
+		{name: "refund at timeout", days: 1, steps: []func(*testLedger, string) error{refund},
+			status: lockRefunded, balance: 1000, available: 1000},
+		{name: "claim after refund", days: 1, steps: []func(*testLedger, string) error{refund, claim(preimage)},
+			wantErr: "is REFUNDED", status: lockRefunded, balance: 1000, available: 1000},
+		{name: "claim twice", steps: []func(*testLedger, string) error{claim(preimage), claim(preimage)},
+			wantErr: "is CLAIMED", status: lockClaimed, balance: 700, available: 700, to: 300},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLedger(t)
+			l.openAccount("A1", "alice", 1000)
+			l.openAccount("B1", "bob", 0)
+			l.addBeneficiary("alice", "B1")
+			lock, err := l.cc.LockFunds(l.as("alice", "User"), "A1", "B1", 300, strings.ToUpper(hashlock), "2025-08-02T10:00:00Z")
+			l.check(err)
+			l.expectBalances("A1", 1000, 700)
+			l.advance(tt.days)
+
+			for i, step := range tt.steps {
+				err = step(l, lock.ID)
+				if i < len(tt.steps)-1 {
+					l.check(err)
+				}
+			}
+			if tt.wantErr != "" {
+				l.checkFails(err, tt.wantErr)
+			} else {
+				l.check(err)
+			}
+
+			got, err := l.cc.GetLock(l.as("alice", "User"), lock.ID)
+			l.check(err)
+			if got.Status != tt.status {
+				t.Fatalf("lock is %s, want %s", got.Status, tt.status)
+			}
+			l.expectBalances("A1", tt.balance, tt.available)
+			l.expectBalances("B1", tt.to, tt.to)
+			if tt.status == lockClaimed && got.Preimage != preimage {
+				t.Fatalf("published preimage %q, want %q", got.Preimage, preimage)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// ======================== Structs ==========================
+
+const (
+	idempotencyObjectType   = "Idempotency"
+	idempotencyTransientKey = "idempotencyKey"
+)
+
+// IdempotencyRecord remembers the result of a transaction submitted with an
+// idempotency key. TxID references the records it created: history and GL
+// entries are indexed by transaction ID.
+type IdempotencyRecord struct {
+	Key         string `json:"key"`
+	Function    string `json:"function"`
+	PayloadHash string `json:"payloadHash"`
+	TxID        string `json:"txId"`
+	Result      string `json:"result"`
+	CreatedAt   string `json:"createdAt"`
+}
+
+// idempotentChaincode wraps the contract chaincode. A client may pass an
+// idempotency key in the transient map under "idempotencyKey"; keys are
+// scoped to the client identity. The first successful call with a key is
+// recorded. A retry with the same function and arguments returns the
+// recorded result without running again, and reuse of the key for a
+// different call is rejected.
+type idempotentChaincode struct {
+	contract *contractapi.ContractChaincode
+}
+
+// ======================== Idempotency Helpers ========================
+
+// payloadHash fingerprints the function name and arguments of an invocation
+func payloadHash(args [][]byte) string {
+	h := sha256.New()
+	for _, arg := range args {
+		var size [8]byte
+		binary.BigEndian.PutUint64(size[:], uint64(len(arg)))
+		h.Write(size[:])
+		h.Write(arg)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotencyKeyOf builds the state key of a client's idempotency key
+func idempotencyKeyOf(stub shim.ChaincodeStubInterface, msp string, clientID string, key string) (string, error) {
+	return stub.CreateCompositeKey(idempotencyObjectType, []string{msp, hashOf(clientID), key})
+}
+
+func (c *idempotentChaincode) Init(stub shim.ChaincodeStubInterface) peer.Response {
+	return c.contract.Init(stub)
+}
+
+func (c *idempotentChaincode) Invoke(stub shim.ChaincodeStubInterface) peer.Response {
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to read transient data: %v", err))
+	}
+	key := string(transient[idempotencyTransientKey])
+	if key == "" {
+		return c.contract.Invoke(stub)
+	}
+
+	msp, err := cid.GetMSPID(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to read client MSP: %v", err))
+	}
+	clientID, err := cid.GetID(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to read client identity: %v", err))
+	}
+	stateKey, err := idempotencyKeyOf(stub, msp, clientID, key)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	args := stub.GetArgs()
+	fingerprint := payloadHash(args)
+
+	data, err := stub.GetState(stateKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if data != nil {
+		var record IdempotencyRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return shim.Error(fmt.Sprintf("corrupt idempotency record for %s: %v", key, err))
+		}
+		if record.PayloadHash != fingerprint {
+			return shim.Error(fmt.Sprintf("idempotency key %s was already used for a different request", key))
+		}
+		return shim.Success([]byte(record.Result))
+	}
+
+	res := c.contract.Invoke(stub)
+	if res.Status >= shim.ERRORTHRESHOLD {
+		return res
+	}
+
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to read tx timestamp: %v", err))
+	}
+	record := IdempotencyRecord{
+		Key:         key,
+		PayloadHash: fingerprint,
+		TxID:        stub.GetTxID(),
+		Result:      string(res.Payload),
+		CreatedAt:   ts.AsTime().UTC().Format(time.RFC3339),
+	}
+	if len(args) > 0 {
+		record.Function = string(args[0])
+	}
+	data, err = json.Marshal(record)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := stub.PutState(stateKey, data); err != nil {
+		return shim.Error(err.Error())
+	}
+	return res
+}
+
+// startChaincode starts cc as an external chaincode server when the
+// chaincode-as-a-service variables are set, as ContractChaincode.Start does,
+// and under the peer otherwise
+func startChaincode(cc shim.Chaincode) error {
+	address := os.Getenv("CHAINCODE_SERVER_ADDRESS")
+	ccid := os.Getenv("CORE_CHAINCODE_ID_NAME")
+	if address == "" || ccid == "" {
+		return shim.Start(cc)
+	}
+
+	tlsProps := shim.TLSProperties{Disabled: true}
+	if enabled, _ := strconv.ParseBool(os.Getenv("CORE_PEER_TLS_ENABLED")); enabled {
+		key, err := os.ReadFile(os.Getenv("CORE_TLS_CLIENT_KEY_FILE"))
+		if err != nil {
+			return fmt.Errorf("error while reading the crypto file: %v", err)
+		}
+		cert, err := os.ReadFile(os.Getenv("CORE_TLS_CLIENT_CERT_FILE"))
+		if err != nil {
+			return fmt.Errorf("error while reading the crypto file: %v", err)
+		}
+		tlsProps = shim.TLSProperties{Key: key, Cert: cert}
+		if root := os.Getenv("CORE_PEER_TLS_ROOTCERT_FILE"); root != "" {
+			if tlsProps.ClientCACerts, err = os.ReadFile(root); err != nil {
+				return fmt.Errorf("error while reading the crypto file: %v", err)
+			}
+		}
+	}
+
+	server := &shim.ChaincodeServer{CCID: ccid, Address: address, CC: cc, TLSProps: tlsProps}
+	return server.Start()
+}
+
+// ======================== Idempotency Methods ========================
+
+// Fetch the caller's record of an idempotency key
+func (s *SmartContract) GetIdempotencyRecord(ctx contractapi.TransactionContextInterface, key string) (*IdempotencyRecord, error) {
+
+	msp, err := getClientMSP(ctx)
+	if err != nil {
+		return nil, err
+	}
+	clientID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, err
+	}
+	stateKey, err := idempotencyKeyOf(ctx.GetStub(), msp, clientID, key)
+	if err != nil {
+		return nil, err
+	}
+	var record IdempotencyRecord
+	found, err := getJSON(ctx, stateKey, &record)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("idempotency key %s not found", key)
+	}
+	return &record, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/msp"
+)
+
+// invokeStub is a proposal as the peer hands it to the chaincode: the
+// function and arguments, transient data and a serialized creator identity
+type invokeStub struct {
+	*mockStub
+	args      [][]byte
+	transient map[string][]byte
+	creator   []byte
+}
+
+func (s *invokeStub) GetArgs() [][]byte                        { return s.args }
+func (s *invokeStub) GetTransient() (map[string][]byte, error) { return s.transient, nil }
+func (s *invokeStub) GetCreator() ([]byte, error)              { return s.creator, nil }
+func (s *invokeStub) GetFunctionAndParameters() (string, []string) {
+	params := make([]string, 0, len(s.args))
+	for _, arg := range s.args[1:] {
+		params = append(params, string(arg))
+	}
+	return string(s.args[0]), params
+}
+
+// serializedIdentity builds a creator identity with a self-signed
+// certificate carrying a CN and a Fabric CA role attribute
+func serializedIdentity(t *testing.T, mspID string, cn string, role string) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{{
+			Id:    asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1},
+			Value: []byte(`{"attrs":{"role":"` + role + `"}}`),
+		}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := proto.Marshal(&msp.SerializedIdentity{
+		Mspid:   mspID,
+		IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// idempotencyHarness submits transactions through the idempotency wrapper
+// around the contract chaincode, committing the writes of each successful one
+type idempotencyHarness struct {
+	l  *testLedger
+	cc *idempotentChaincode
+}
+
+func newIdempotencyHarness(l *testLedger) *idempotencyHarness {
+	l.t.Helper()
+	contract := new(SmartContract)
+	contract.TransactionContextHandler = new(TransactionContext)
+	contract.AfterTransaction = postJournal
+	cc, err := contractapi.NewChaincode(contract)
+	l.check(err)
+	return &idempotencyHarness{l: l, cc: &idempotentChaincode{contract: cc}}
+}
+
+func (h *idempotencyHarness) invoke(creator []byte, key string, args ...string) (string, error) {
+	h.l.commit()
+	h.l.n++
+	h.l.stub.txID = fmt.Sprintf("tx%06d", h.l.n)
+	stub := &invokeStub{mockStub: h.l.stub, transient: map[string][]byte{}, creator: creator}
+	for _, arg := range args {
+		stub.args = append(stub.args, []byte(arg))
+	}
+	if key != "" {
+		stub.transient[idempotencyTransientKey] = []byte(key)
+	}
+	res := h.cc.Invoke(stub)
+	if res.Status >= shim.ERRORTHRESHOLD {
+		h.l.stub.rollbackTx()
+		return "", errors.New(res.Message)
+	}
+	h.l.stub.commitTx()
+	return string(res.Payload), nil
+}
+
+func TestPayloadHashSeparatesArguments(t *testing.T) {
+	a := payloadHash([][]byte{[]byte("Deposit"), []byte("A1"), []byte("100")})
+	b := payloadHash([][]byte{[]byte("Deposit"), []byte("A11"), []byte("00")})
+	c := payloadHash([][]byte{[]byte("Deposit"), []byte("A1100")})
+	if a == b || a == c || b == c {
+		t.Fatal("argument boundaries do not change the payload hash")
+	}
+	if a != payloadHash([][]byte{[]byte("Deposit"), []byte("A1"), []byte("100")}) {
+		t.Fatal("payload hash is not deterministic")
+	}
+}
+
+func TestIdempotentRetry(t *testing.T) {
+	l := newTestLedger(t)
+	l.openAccount("A1", "alice", 500)
+	h := newIdempotencyHarness(l)
+	teller := serializedIdentity(t, "Org1MSP", "teller", "Manager")
+	other := serializedIdentity(t, "Org1MSP", "teller2", "Manager")
+
+	first, err := h.invoke(teller, "k1", "Deposit", "A1", "100")
+	l.check(err)
+	l.expectBalances("A1", 600, 600)
+
+	// A retry returns the recorded result and does not deposit again
+	retry, err := h.invoke(teller, "k1", "Deposit", "A1", "100")
+	l.check(err)
+	if retry != first {
+		t.Fatalf("retry returned %s, want %s", retry, first)
+	}
+	l.expectBalances("A1", 600, 600)
+
+	_, err = h.invoke(teller, "k1", "Deposit", "A1", "200")
+	if err == nil || !strings.Contains(err.Error(), "already used for a different request") {
+		t.Fatalf("reusing a key for another request: %v", err)
+	}
+	l.expectBalances("A1", 600, 600)
+
+	// Keys are scoped to the client, so another teller's k1 is a new request
+	_, err = h.invoke(other, "k1", "Deposit", "A1", "100")
+	l.check(err)
+	l.expectBalances("A1", 700, 700)
+
+	// Calls without a key are never deduplicated
+	for i := 0; i < 2; i++ {
+		_, err = h.invoke(teller, "", "Deposit", "A1", "100")
+		l.check(err)
+	}
+	l.expectBalances("A1", 900, 900)
+}
+
+func TestFailedCallIsNotRecorded(t *testing.T) {
+	l := newTestLedger(t)
+	l.openAccount("A1", "alice", 50)
+	h := newIdempotencyHarness(l)
+	teller := serializedIdentity(t, "Org1MSP", "teller", "Manager")
+
+	_, err := h.invoke(teller, "k1", "Withdraw", "A1", "100")
+	if err == nil || !strings.Contains(err.Error(), "insufficient") {
+		t.Fatalf("overdrawing withdrawal: %v", err)
+	}
+	_, err = h.invoke(teller, "", "GetIdempotencyRecord", "k1")
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("failed call left a record: %v", err)
+	}
+
+	// Once funds arrive, the same request with the same key goes through
+	_, err = h.invoke(teller, "", "Deposit", "A1", "100")
+	l.check(err)
+	_, err = h.invoke(teller, "k1", "Withdraw", "A1", "100")
+	l.check(err)
+	l.expectBalances("A1", 50, 50)
+
+	record, err := h.invoke(teller, "", "GetIdempotencyRecord", "k1")
+	l.check(err)
+	if !strings.Contains(record, `"function":"Withdraw"`) {
+		t.Fatalf("record %s", record)
+	}
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/msp"
+)
+
+// ======================== Structs ==========================
+
+const (
+	interbankObjectType   = "InterbankTransfer"
+	interbankPendingIndex = "ibtpending~msp~id"
+	interbankUnsettled    = "ibtunsettled~id"
+	settlementObjectType  = "SettlementCycle"
+	interbankEvent        = "InterbankTransferInitiated"
+
+	interbankPending  = "PENDING"
+	interbankAccepted = "ACCEPTED"
+	interbankRejected = "REJECTED"
+)
+
+// InterbankTransfer is a payment from an account at one member bank to an
+// account at another. The sender is debited when it is initiated; the
+// receiving bank then accepts it, crediting the beneficiary, or rejects it,
+// refunding the sender. Both banks must endorse the resolution. Fee is the
+// sending bank's transfer fee, charged on initiation and kept on rejection.
+type InterbankTransfer struct {
+	ID          string `json:"id"`
+	FromMSP     string `json:"fromMsp"`
+	FromAccount string `json:"fromAccount"`
+	ToMSP       string `json:"toMsp"`
+	ToAccount   string `json:"toAccount"`
+	Amount      int64  `json:"amount"`
+	Fee         int64  `json:"fee,omitempty" metadata:",optional"`
+	Reference   string `json:"reference"`
+	Status      string `json:"status"`
+	InitiatedBy string `json:"initiatedBy"`
+	InitiatedAt string `json:"initiatedAt"`
+	ResolvedBy  string `json:"resolvedBy,omitempty" metadata:",optional"`
+	ResolvedAt  string `json:"resolvedAt,omitempty" metadata:",optional"`
+	Reason      string `json:"reason,omitempty" metadata:",optional"`
+}
+
+// SettlementPosition is the netted obligation between two banks in a
+// settlement cycle: PayerMSP owes PayeeMSP Net, which is Gross sent to the
+// payee less Offset received from it
+type SettlementPosition struct {
+	PayerMSP string `json:"payerMsp"`
+	PayeeMSP string `json:"payeeMsp"`
+	Gross    int64  `json:"gross"`
+	Offset   int64  `json:"offset"`
+	Net      int64  `json:"net"`
+}
+
+// SettlementCycle records the accepted transfers settled together and the
+// resulting positions between banks
+type SettlementCycle struct {
+	ID           string                `json:"id"`
+	BusinessDate string                `json:"businessDate"`
+	TransferIDs  []string              `json:"transferIds"`
+	GrossAmount  int64                 `json:"grossAmount"`
+	Positions    []*SettlementPosition `json:"positions"`
+	RunBy        string                `json:"runBy"`
+	RunAt        string                `json:"runAt"`
+}
+
+// ======================== Interbank Helpers ========================
+
+func getInterbankTransfer(ctx contractapi.TransactionContextInterface, id string) (*InterbankTransfer, error) {
+	if id == "" {
+		return nil, fmt.Errorf("transfer id required")
+	}
+	key, err := makeKey(ctx, interbankObjectType, id)
+	if err != nil {
+		return nil, err
+	}
+	var t InterbankTransfer
+	found, err := getJSON(ctx, key, &t)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("interbank transfer %s not found", id)
+	}
+	return &t, nil
+}
+
+func putInterbankTransfer(ctx contractapi.TransactionContextInterface, t *InterbankTransfer) error {
+	key, err := makeKey(ctx, interbankObjectType, t.ID)
+	if err != nil {
+		return err
+	}
+	return putJSON(ctx, key, t)
+}
+
+// orgsPolicy builds an endorsement policy that needs a peer of every
+// listed organisation
+func orgsPolicy(msps ...string) ([]byte, error) {
+	sort.Strings(msps)
+	policy := &common.SignaturePolicyEnvelope{}
+	var rules []*common.SignaturePolicy
+	for i, id := range msps {
+		role, err := proto.Marshal(&msp.MSPRole{MspIdentifier: id, Role: msp.MSPRole_PEER})
+		if err != nil {
+			return nil, err
+		}
+		policy.Identities = append(policy.Identities, &msp.MSPPrincipal{
+			PrincipalClassification: msp.MSPPrincipal_ROLE,
+			Principal:               role,
+		})
+		rules = append(rules, &common.SignaturePolicy{Type: &common.SignaturePolicy_SignedBy{SignedBy: int32(i)}})
+	}
+	policy.Rule = &common.SignaturePolicy{Type: &common.SignaturePolicy_NOutOf_{
+		NOutOf: &common.SignaturePolicy_NOutOf{N: int32(len(rules)), Rules: rules},
+	}}
+	return proto.Marshal(policy)
+}
+
+// resolveInterbankTransfer checks that the caller is staff of the receiving
+// bank and that the transfer is still pending
+func resolveInterbankTransfer(ctx contractapi.TransactionContextInterface, id string) (*InterbankTransfer, error) {
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+	t, err := getInterbankTransfer(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	caller, err := getClientMSP(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if caller != t.ToMSP {
+		return nil, fmt.Errorf("access denied: only %s can resolve transfer %s", t.ToMSP, t.ID)
+	}
+	if t.Status != interbankPending {
+		return nil, fmt.Errorf("interbank transfer %s is %s", t.ID, t.Status)
+	}
+	return t, nil
+}
+
+// closeInterbankTransfer stores a resolved transfer and removes it from
+// the receiving bank's pending list
+func closeInterbankTransfer(ctx contractapi.TransactionContextInterface, t *InterbankTransfer) error {
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+	t.ResolvedBy, _ = getCallerCN(ctx)
+	t.ResolvedAt = now.Format(time.RFC3339)
+	if err := putInterbankTransfer(ctx, t); err != nil {
+		return err
+	}
+	pendingKey, err := makeKey(ctx, interbankPendingIndex, t.ToMSP, t.ID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().DelState(pendingKey)
+}
+
+// queueForSettlement adds an accepted transfer to the next settlement cycle
+func queueForSettlement(ctx contractapi.TransactionContextInterface, t *InterbankTransfer) error {
+	unsettledKey, err := makeKey(ctx, interbankUnsettled, t.ID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(unsettledKey, []byte{0x00})
+}
+
+// bookInterbankCredit records a payment that a subsystem such as cheque
+// clearing has already posted from an account at one bank to an account at
+// another as an accepted interbank transfer, so that the banks settle it in
+// the next cycle with their other obligations
+func bookInterbankCredit(ctx contractapi.TransactionContextInterface, from *Account, to *Account, amount int64, reference string) (*InterbankTransfer, error) {
+	if err := glCredit(ctx, glSettlementAccount, amount, "Interbank transfer to "+to.BankMSP+" "+reference); err != nil {
+		return nil, err
+	}
+	if err := glDebit(ctx, glSettlementAccount, amount, "Interbank transfer from "+from.BankMSP+" "+reference); err != nil {
+		return nil, err
+	}
+
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cn, _ := getCallerCN(ctx)
+	t := &InterbankTransfer{
+		ID:          newID(ctx, "IBT"),
+		FromMSP:     from.BankMSP,
+		FromAccount: from.ID,
+		ToMSP:       to.BankMSP,
+		ToAccount:   to.ID,
+		Amount:      amount,
+		Reference:   reference,
+		Status:      interbankAccepted,
+		InitiatedBy: cn,
+		InitiatedAt: now.Format(time.RFC3339),
+		ResolvedBy:  cn,
+		ResolvedAt:  now.Format(time.RFC3339),
+	}
+	if err := putInterbankTransfer(ctx, t); err != nil {
+		return nil, err
+	}
+	return t, queueForSettlement(ctx, t)
+}
+
+// ======================== Interbank Methods ========================
+
+// Pay from an account at the caller's bank to an account at another bank.
+// The sender is debited now and the credit waits for the receiving bank.
+func (s *SmartContract) InitiateInterbankTransfer(
+	ctx contractapi.TransactionContextInterface,
+	fromAccount string, toMSP string, toAccount string, amount int64, reference string,
+) (*InterbankTransfer, error) {
+
+	if amount <= 0 {
+		return nil, fmt.Errorf("amount must be positive")
+	}
+	if toMSP == "" || reference == "" {
+		return nil, fmt.Errorf("toMsp and reference required")
+	}
+	fromMSP, err := getClientMSP(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if toMSP == fromMSP {
+		return nil, fmt.Errorf("use Transfer for payments within %s", fromMSP)
+	}
+
+	from, err := getAccount(ctx, fromAccount)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireDebitAuthority(ctx, from); err != nil {
+		return nil, err
+	}
+	if from.BankMSP != fromMSP {
+		return nil, fmt.Errorf("account %s is not held at %s", from.ID, fromMSP)
+	}
+	to, err := getAccount(ctx, toAccount)
+	if err != nil {
+		return nil, err
+	}
+	if to.BankMSP != toMSP {
+		return nil, fmt.Errorf("account %s is not held at %s", to.ID, toMSP)
+	}
+	if err := checkBeneficiary(ctx, from, to, amount); err != nil {
+		return nil, err
+	}
+	if err := enforceLimits(ctx, &LimitedOperation{Operation: opTransfer, AccountID: from.ID, ToAccount: to.ID, Amount: amount}); err != nil {
+		return nil, err
+	}
+
+	narrative := "Interbank transfer to " + toMSP + " " + reference
+	if err := postToAccount(ctx, from, -amount, narrative); err != nil {
+		return nil, err
+	}
+	if err := glCredit(ctx, glSettlementAccount, amount, narrative); err != nil {
+		return nil, err
+	}
+	fee, _, err := feeFor(ctx, opTransfer, from, feeChannel(ctx), amount)
+	if err != nil {
+		return nil, err
+	}
+	if err := postFee(ctx, from, opTransfer, fee); err != nil {
+		return nil, err
+	}
+
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cn, _ := getCallerCN(ctx)
+	t := &InterbankTransfer{
+		ID:          newID(ctx, "IBT"),
+		FromMSP:     fromMSP,
+		FromAccount: from.ID,
+		ToMSP:       toMSP,
+		ToAccount:   to.ID,
+		Amount:      amount,
+		Fee:         fee,
+		Reference:   reference,
+		Status:      interbankPending,
+		InitiatedBy: cn,
+		InitiatedAt: now.Format(time.RFC3339),
+	}
+	if err := putInterbankTransfer(ctx, t); err != nil {
+		return nil, err
+	}
+	// Accepting or rejecting the transfer needs the endorsement of both banks.
+	// Only this record carries the policy: every transaction that later moves
+	// money for the transfer (the beneficiary credit on accept, the refund on
+	// reject) also writes this record, so its whole read-write
+	// set, account updates included, is endorsed by both banks. Putting the
+	// policy on the account keys instead would make every later posting to
+	// those accounts, interbank or not, need both banks.
+	key, err := makeKey(ctx, interbankObjectType, t.ID)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := orgsPolicy(fromMSP, toMSP)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build endorsement policy: %v", err)
+	}
+	if err := ctx.GetStub().SetStateValidationParameter(key, policy); err != nil {
+		return nil, err
+	}
+	pendingKey, err := makeKey(ctx, interbankPendingIndex, toMSP, t.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(pendingKey, []byte{0x00}); err != nil {
+		return nil, err
+	}
+
+	payload, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().SetEvent(interbankEvent, payload); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Accept a pending transfer as the receiving bank and credit the beneficiary
+func (s *SmartContract) AcceptInterbankTransfer(ctx contractapi.TransactionContextInterface, id string) (*InterbankTransfer, error) {
+
+	t, err := resolveInterbankTransfer(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	to, err := getAccount(ctx, t.ToAccount)
+	if err != nil {
+		return nil, err
+	}
+	narrative := "Interbank transfer from " + t.FromMSP + " " + t.Reference
+	if err := postToAccount(ctx, to, t.Amount, narrative); err != nil {
+		return nil, err
+	}
+	if err := glDebit(ctx, glSettlementAccount, t.Amount, narrative); err != nil {
+		return nil, err
+	}
+
+	t.Status = interbankAccepted
+	if err := closeInterbankTransfer(ctx, t); err != nil {
+		return nil, err
+	}
+	if err := queueForSettlement(ctx, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Reject a pending transfer as the receiving bank and refund the sender the
+// amount, but not the fee
+func (s *SmartContract) RejectInterbankTransfer(ctx contractapi.TransactionContextInterface, id string, reason string) (*InterbankTransfer, error) {
+
+	if reason == "" {
+		return nil, fmt.Errorf("reason required")
+	}
+	t, err := resolveInterbankTransfer(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	from, err := getAccount(ctx, t.FromAccount)
+	if err != nil {
+		return nil, err
+	}
+	narrative := "Interbank transfer returned by " + t.ToMSP + " " + t.Reference
+	if err := postToAccount(ctx, from, t.Amount, narrative); err != nil {
+		return nil, err
+	}
+	if err := glDebit(ctx, glSettlementAccount, t.Amount, narrative); err != nil {
+		return nil, err
+	}
+
+	t.Status = interbankRejected
+	t.Reason = reason
+	if err := closeInterbankTransfer(ctx, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Fetch interbank transfer
+func (s *SmartContract) GetInterbankTransfer(ctx contractapi.TransactionContextInterface, id string) (*InterbankTransfer, error) {
+	t, err := getInterbankTransfer(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if isStaff(ctx) {
+		return t, nil
+	}
+	from, err := getAccount(ctx, t.FromAccount)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountAccess(ctx, from); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// List transfers waiting for the caller's bank to accept or reject them
+func (s *SmartContract) ListPendingInterbankTransfers(ctx contractapi.TransactionContextInterface) ([]*InterbankTransfer, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+	caller, err := getClientMSP(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(interbankPendingIndex, []string{caller})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var list []*InterbankTransfer
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, parts, err := ctx.GetStub().SplitCompositeKey(res.Key)
+		if err != nil || len(parts) != 2 {
+			continue
+		}
+		t, err := getInterbankTransfer(ctx, parts[1])
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, t)
+	}
+	return list, nil
+}
+
+// Net the accepted transfers not yet settled into one position per pair of
+// banks and record the settlement cycle
+func (s *SmartContract) RunSettlementCycle(ctx contractapi.TransactionContextInterface) (*SettlementCycle, error) {
+
+	if err := requireRole(ctx, "SuperAdmin", "Admin"); err != nil {
+		return nil, err
+	}
+	today, err := getBusinessDate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(interbankUnsettled, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	cycle := &SettlementCycle{ID: newID(ctx, "STL"), BusinessDate: today}
+	// gross[a][b] is the total a sent to b
+	gross := map[string]map[string]int64{}
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, parts, err := ctx.GetStub().SplitCompositeKey(res.Key)
+		if err != nil || len(parts) != 1 {
+			continue
+		}
+		t, err := getInterbankTransfer(ctx, parts[0])
+		if err != nil {
+			return nil, err
+		}
+		if gross[t.FromMSP] == nil {
+			gross[t.FromMSP] = map[string]int64{}
+		}
+		gross[t.FromMSP][t.ToMSP] += t.Amount
+		cycle.GrossAmount += t.Amount
+		cycle.TransferIDs = append(cycle.TransferIDs, t.ID)
+		if err := ctx.GetStub().DelState(res.Key); err != nil {
+			return nil, err
+		}
+	}
+	if len(cycle.TransferIDs) == 0 {
+		return nil, fmt.Errorf("no accepted transfers to settle")
+	}
+
+	var banks []string
+	seen := map[string]bool{}
+	for a, row := range gross {
+		for b := range row {
+			for _, id := range []string{a, b} {
+				if !seen[id] {
+					seen[id] = true
+					banks = append(banks, id)
+				}
+			}
+		}
+	}
+	sort.Strings(banks)
+	for i, a := range banks {
+		for _, b := range banks[i+1:] {
+			ab, ba := gross[a][b], gross[b][a]
+			if ab == 0 && ba == 0 {
+				continue
+			}
+			p := &SettlementPosition{PayerMSP: a, PayeeMSP: b, Gross: ab, Offset: ba, Net: ab - ba}
+			if p.Net < 0 {
+				p = &SettlementPosition{PayerMSP: b, PayeeMSP: a, Gross: ba, Offset: ab, Net: ba - ab}
+			}
+			cycle.Positions = append(cycle.Positions, p)
+		}
+	}
+
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cycle.RunBy, _ = getCallerCN(ctx)
+	cycle.RunAt = now.Format(time.RFC3339)
+	key, err := makeKey(ctx, settlementObjectType, cycle.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := putJSON(ctx, key, cycle); err != nil {
+		return nil, err
+	}
+	return cycle, nil
+}
+
+// Fetch settlement cycle
+func (s *SmartContract) GetSettlementCycle(ctx contractapi.TransactionContextInterface, id string) (*SettlementCycle, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+	key, err := makeKey(ctx, settlementObjectType, id)
+	if err != nil {
+		return nil, err
+	}
+	var cycle SettlementCycle
+	found, err := getJSON(ctx, key, &cycle)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("settlement cycle %s not found", id)
+	}
+	return &cycle, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import "testing"
+
+// atBank runs the calls in fn as members of another bank
+func (l *testLedger) atBank(msp string, fn func()) {
+	l.t.Helper()
+	l.commit()
+	saved := l.msp
+	l.msp = msp
+	defer func() {
+		l.commit()
+		l.msp = saved
+	}()
+	fn()
+}
+
+func sendInterbank(l *testLedger, owner string, from string, toMSP string, to string, amount int64) string {
+	l.t.Helper()
+	t, err := l.cc.InitiateInterbankTransfer(l.as(owner, "User"), from, toMSP, to, amount, "ref")
+	l.check(err)
+	return t.ID
+}
+
+func TestSettlementCycleNetsBankPositions(t *testing.T) {
+	l := newTestLedger(t)
+	l.openAccount("A1", "alice", 1000)
+	l.atBank("Org2MSP", func() {
+		l.openAccount("B1", "bob", 1000)
+		l.addBeneficiary("bob", "A1")
+		_, err := l.cc.IssueChequeBook(l.staff(), "B1", 1)
+		l.check(err)
+	})
+	l.atBank("Org3MSP", func() { l.openAccount("C1", "carol", 1000) })
+	l.addBeneficiary("alice", "B1")
+	l.addBeneficiary("alice", "C1")
+
+	// Org1 sends Org2 300; Org2 sends Org1 100 and pays it a 70 cheque
+	toBob := sendInterbank(l, "alice", "A1", "Org2MSP", "B1", 300)
+	toAlice := ""
+	l.atBank("Org2MSP", func() {
+		toAlice = sendInterbank(l, "bob", "B1", "Org1MSP", "A1", 100)
+		_, err := l.cc.AcceptInterbankTransfer(l.staff(), toBob)
+		l.check(err)
+	})
+	_, err := l.cc.AcceptInterbankTransfer(l.staff(), toAlice)
+	l.check(err)
+	item, err := l.cc.PresentCheque(l.staff(), "B1", 1, 70, "A1")
+	l.check(err)
+	l.atBank("Org2MSP", func() {
+		_, err := l.cc.HonourCheque(l.staff(), item.ID)
+		l.check(err)
+	})
+
+	// Neither a rejected nor a pending transfer is settled
+	rejected := sendInterbank(l, "alice", "A1", "Org3MSP", "C1", 50)
+	pending := sendInterbank(l, "alice", "A1", "Org3MSP", "C1", 40)
+	l.atBank("Org3MSP", func() {
+		_, err := l.cc.RejectInterbankTransfer(l.staff(), rejected, "closed account")
+		l.check(err)
+	})
+
+	l.expectBalances("A1", 1000-300+100+70-40, 1000-300+100+70-40)
+	l.expectBalances("B1", 1000+300-100-70, 1000+300-100-70)
+	// Only the pending transfer is still held in settlement
+	if got := l.glBalance(glSettlementAccount); got != -40 {
+		t.Fatalf("settlement account %d, want -40", got)
+	}
+
+	cycle, err := l.cc.RunSettlementCycle(l.as("admin", "Admin"))
+	l.check(err)
+	if cycle.GrossAmount != 470 || len(cycle.TransferIDs) != 3 {
+		t.Fatalf("cycle settled %d in %v", cycle.GrossAmount, cycle.TransferIDs)
+	}
+	if len(cycle.Positions) != 1 {
+		t.Fatalf("positions %+v", cycle.Positions)
+	}
+	want := SettlementPosition{PayerMSP: "Org1MSP", PayeeMSP: "Org2MSP", Gross: 300, Offset: 170, Net: 130}
+	if *cycle.Positions[0] != want {
+		t.Fatalf("position %+v, want %+v", *cycle.Positions[0], want)
+	}
+
+	_, err = l.cc.RunSettlementCycle(l.as("admin", "Admin"))
+	l.checkFails(err, "no accepted transfers to settle")
+
+	// The pending transfer settles in the next cycle once accepted
+	l.atBank("Org3MSP", func() {
+		_, err := l.cc.AcceptInterbankTransfer(l.staff(), pending)
+		l.check(err)
+	})
+	cycle, err = l.cc.RunSettlementCycle(l.as("admin", "Admin"))
+	l.check(err)
+	want = SettlementPosition{PayerMSP: "Org1MSP", PayeeMSP: "Org3MSP", Gross: 40, Net: 40}
+	if len(cycle.Positions) != 1 || *cycle.Positions[0] != want {
+		t.Fatalf("second cycle positions %+v", cycle.Positions)
+	}
+	if got := l.glBalance(glSettlementAccount); got != 0 {
+		t.Fatalf("settlement account %d after settling, want 0", got)
+	}
+}
+
+func TestSettlementPositionFlipsToTheNetPayer(t *testing.T) {
+	l := newTestLedger(t)
+	l.openAccount("A1", "alice", 1000)
+	l.atBank("Org2MSP", func() {
+		l.openAccount("B1", "bob", 1000)
+		l.addBeneficiary("bob", "A1")
+	})
+	l.addBeneficiary("alice", "B1")
+
+	// Bank names sort Org1 first, but Org2 is the net payer
+	toBob := sendInterbank(l, "alice", "A1", "Org2MSP", "B1", 100)
+	var toAlice string
+	l.atBank("Org2MSP", func() {
+		toAlice = sendInterbank(l, "bob", "B1", "Org1MSP", "A1", 250)
+		_, err := l.cc.AcceptInterbankTransfer(l.staff(), toBob)
+		l.check(err)
+	})
+	_, err := l.cc.AcceptInterbankTransfer(l.staff(), toAlice)
+	l.check(err)
+
+	cycle, err := l.cc.RunSettlementCycle(l.as("admin", "Admin"))
+	l.check(err)
+	want := SettlementPosition{PayerMSP: "Org2MSP", PayeeMSP: "Org1MSP", Gross: 250, Offset: 100, Net: 150}
+	if len(cycle.Positions) != 1 || *cycle.Positions[0] != want {
+		t.Fatalf("positions %+v, want %+v", cycle.Positions, want)
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ======================== Structs ==========================
+
+const (
+	signingRequestObjectType = "SigningRequest"
+	signingRequestIndex      = "sigreq~account~id"
+	signaturesRequiredEvent  = "SignaturesRequired"
+
+	// Signing rules of a joint account
+	signEither = "EITHER"
+	signAll    = "ALL"
+	signAnyN   = "ANY_N"
+
+	signingPending  = "PENDING"
+	signingExecuted = "EXECUTED"
+	signingReferred = "REFERRED"
+	signingDeclined = "DECLINED"
+)
+
+// Signature is one owner's approval of a debit. SignerID fingerprints the
+// certificate the owner signed with.
+type Signature struct {
+	UserID    string `json:"userId"`
+	SignerID  string `json:"signerId"`
+	SignerMSP string `json:"signerMsp"`
+	SignedAt  string `json:"signedAt"`
+}
+
+// SigningRequest is a debit from a joint account waiting for the signatures
+// its signing rule requires. The requester signs first; the transfer is
+// posted when Required owners have signed. REFERRED means it was signed
+// but exceeded a limit and now waits for a LimitApproval, which executes or
+// declines it.
+type SigningRequest struct {
+	ID          string       `json:"id"`
+	AccountID   string       `json:"accountId"`
+	ToAccount   string       `json:"toAccount"`
+	Amount      int64        `json:"amount"`
+	Required    int          `json:"required"`
+	Signatures  []*Signature `json:"signatures"`
+	Status      string       `json:"status"`
+	RequestedBy string       `json:"requestedBy"`
+	RequestedAt string       `json:"requestedAt"`
+	ResolvedBy  string       `json:"resolvedBy,omitempty" metadata:",optional"`
+	ResolvedAt  string       `json:"resolvedAt,omitempty" metadata:",optional"`
+}
+
+// ======================== Joint Account Helpers ========================
+
+// accountOwners lists the primary holder followed by the joint owners
+func accountOwners(a *Account) []string {
+	return append([]string{a.OwnerID}, a.JointOwners...)
+}
+
+func isAccountOwner(a *Account, userID string) bool {
+	for _, owner := range accountOwners(a) {
+		if owner == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// requiredSigners is the number of owners that must sign a customer debit
+func requiredSigners(a *Account) int {
+	switch a.SigningRule {
+	case signAll:
+		return len(accountOwners(a))
+	case signAnyN:
+		return a.RequiredSigners
+	}
+	return 1
+}
+
+// requireDebitAuthority is requireAccountAccess for standing authorities to
+// debit an account, such as standing orders and mandates, which a customer
+// may only give alone on accounts a single owner can operate
+func requireDebitAuthority(ctx contractapi.TransactionContextInterface, a *Account) error {
+	if err := requireAccountAccess(ctx, a); err != nil {
+		return err
+	}
+	if n := requiredSigners(a); n > 1 && !isStaff(ctx) {
+		return fmt.Errorf("account %s needs %d signatures: ask the bank to set this up", a.ID, n)
+	}
+	return nil
+}
+
+// resolveReferredRequest closes the signing request a limit approval was
+// raised for, if any, with the approval's outcome
+func resolveReferredRequest(ctx contractapi.TransactionContextInterface, op *LimitedOperation, status string) error {
+	if op.SigningRequest == "" {
+		return nil
+	}
+	r, err := getSigningRequest(ctx, op.SigningRequest)
+	if err != nil {
+		return err
+	}
+	if r.Status != signingReferred {
+		return fmt.Errorf("signing request %s is %s", r.ID, r.Status)
+	}
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+	r.Status = status
+	r.ResolvedBy, _ = getCallerCN(ctx)
+	r.ResolvedAt = now.Format(time.RFC3339)
+	return putSigningRequest(ctx, r)
+}
+
+// validateSigningRule checks a signing rule against an owner count
+func validateSigningRule(rule string, required int, owners int) error {
+	switch rule {
+	case signEither, signAll:
+		return nil
+	case signAnyN:
+		if required < 1 || required > owners {
+			return fmt.Errorf("requiredSigners must be between 1 and %d", owners)
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid signing rule: %s", rule)
+}
+
+// newSignature records the caller's signature as owner of an account. The
+// caller must be an active customer bound to one of the owners by the CN of
+// their certificate.
+func newSignature(ctx contractapi.TransactionContextInterface, a *Account) (*Signature, error) {
+	cn, err := getCallerCN(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !isAccountOwner(a, cn) {
+		return nil, fmt.Errorf("access denied: %s is not an owner of account %s", cn, a.ID)
+	}
+	u, err := getUser(ctx, cn)
+	if err != nil {
+		return nil, err
+	}
+	if !u.IsActive {
+		return nil, fmt.Errorf("user %s is not active", cn)
+	}
+	clientID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client identity: %v", err)
+	}
+	msp, err := getClientMSP(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Signature{UserID: cn, SignerID: hashOf(clientID), SignerMSP: msp, SignedAt: now.Format(time.RFC3339)}, nil
+}
+
+// requestSignatures queues a transfer from a joint account with the
+// caller's signature and emits an event for the other owners
+func requestSignatures(ctx contractapi.TransactionContextInterface, from *Account, to *Account, amount int64) (*SigningRequest, error) {
+	sig, err := newSignature(ctx, from)
+	if err != nil {
+		return nil, err
+	}
+	r := &SigningRequest{
+		ID:          newID(ctx, "SIG"),
+		AccountID:   from.ID,
+		ToAccount:   to.ID,
+		Amount:      amount,
+		Required:    requiredSigners(from),
+		Signatures:  []*Signature{sig},
+		Status:      signingPending,
+		RequestedBy: sig.UserID,
+		RequestedAt: sig.SignedAt,
+	}
+	if err := putSigningRequest(ctx, r); err != nil {
+		return nil, err
+	}
+	indexKey, err := makeKey(ctx, signingRequestIndex, from.ID, r.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(indexKey, []byte{0x00}); err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return r, ctx.GetStub().SetEvent(signaturesRequiredEvent, payload)
+}
+
+func getSigningRequest(ctx contractapi.TransactionContextInterface, id string) (*SigningRequest, error) {
+	if id == "" {
+		return nil, fmt.Errorf("signing request id required")
+	}
+	key, err := makeKey(ctx, signingRequestObjectType, id)
+	if err != nil {
+		return nil, err
+	}
+	var r SigningRequest
+	found, err := getJSON(ctx, key, &r)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("signing request %s not found", id)
+	}
+	return &r, nil
+}
+
+func putSigningRequest(ctx contractapi.TransactionContextInterface, r *SigningRequest) error {
+	key, err := makeKey(ctx, signingRequestObjectType, r.ID)
+	if err != nil {
+		return err
+	}
+	return putJSON(ctx, key, r)
+}
+
+// ======================== Joint Account Methods ========================
+
+// Add a customer as joint owner of an account
+func (s *SmartContract) AddJointOwner(ctx contractapi.TransactionContextInterface, accountID string, userID string) (*Account, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+	a, err := getAccount(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if isAccountOwner(a, userID) {
+		return nil, fmt.Errorf("%s is already an owner of account %s", userID, a.ID)
+	}
+	u, err := getUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if u.Role != "User" || !u.IsActive {
+		return nil, fmt.Errorf("%s is not an active customer", userID)
+	}
+
+	a.JointOwners = append(a.JointOwners, u.ID)
+	if a.SigningRule == "" {
+		a.SigningRule = signEither
+	}
+	if err := putAccount(ctx, a); err != nil {
+		return nil, err
+	}
+	indexKey, err := makeKey(ctx, ownerIndex, u.ID, a.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(indexKey, []byte{0x00}); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Remove a joint owner from an account. The primary holder cannot be removed.
+func (s *SmartContract) RemoveJointOwner(ctx contractapi.TransactionContextInterface, accountID string, userID string) (*Account, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+	a, err := getAccount(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if userID == a.OwnerID {
+		return nil, fmt.Errorf("%s is the primary holder of account %s", userID, a.ID)
+	}
+	var owners []string
+	for _, owner := range a.JointOwners {
+		if owner != userID {
+			owners = append(owners, owner)
+		}
+	}
+	if len(owners) == len(a.JointOwners) {
+		return nil, fmt.Errorf("%s is not a joint owner of account %s", userID, a.ID)
+	}
+	a.JointOwners = owners
+	if a.SigningRule == signAnyN && a.RequiredSigners > len(accountOwners(a)) {
+		return nil, fmt.Errorf("account %s needs %d signers: change its signing rule first", a.ID, a.RequiredSigners)
+	}
+
+	if err := putAccount(ctx, a); err != nil {
+		return nil, err
+	}
+	indexKey, err := makeKey(ctx, ownerIndex, userID, a.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().DelState(indexKey); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Set how many owners must sign customer debits: EITHER (any one owner),
+// ALL, or ANY_N with requiredSigners owners
+func (s *SmartContract) SetSigningRule(ctx contractapi.TransactionContextInterface, accountID string, rule string, requiredSigners int) (*Account, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+	a, err := getAccount(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateSigningRule(rule, requiredSigners, len(accountOwners(a))); err != nil {
+		return nil, err
+	}
+
+	a.SigningRule = rule
+	a.RequiredSigners = 0
+	if rule == signAnyN {
+		a.RequiredSigners = requiredSigners
+	}
+	if err := putAccount(ctx, a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Sign a pending debit as another owner of the account. The signature that
+// completes the signing rule posts the transfer, subject to limits.
+func (s *SmartContract) SignTransfer(ctx contractapi.TransactionContextInterface, id string) (*SigningRequest, error) {
+
+	r, err := getSigningRequest(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if r.Status != signingPending {
+		return nil, fmt.Errorf("signing request %s is %s", r.ID, r.Status)
+	}
+	from, err := getAccount(ctx, r.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := newSignature(ctx, from)
+	if err != nil {
+		return nil, err
+	}
+	for _, previous := range r.Signatures {
+		if previous.UserID == sig.UserID {
+			return nil, fmt.Errorf("%s has already signed request %s", sig.UserID, r.ID)
+		}
+	}
+	r.Signatures = append(r.Signatures, sig)
+	if len(r.Signatures) < r.Required {
+		return r, putSigningRequest(ctx, r)
+	}
+
+	to, err := getAccount(ctx, r.ToAccount)
+	if err != nil {
+		return nil, err
+	}
+	op := &LimitedOperation{Operation: opTransfer, AccountID: from.ID, ToAccount: to.ID, Amount: r.Amount, SigningRequest: r.ID}
+	queued, err := applyLimits(ctx, op)
+	if err != nil {
+		return nil, err
+	}
+	r.Status = signingReferred
+	if !queued {
+		if err := transferFunds(ctx, from, to, r.Amount, channelOnline); err != nil {
+			return nil, err
+		}
+		r.Status = signingExecuted
+	}
+	r.ResolvedBy = sig.UserID
+	r.ResolvedAt = sig.SignedAt
+	return r, putSigningRequest(ctx, r)
+}
+
+// Decline a pending debit as an owner of the account, or as staff
+func (s *SmartContract) DeclineTransfer(ctx contractapi.TransactionContextInterface, id string) (*SigningRequest, error) {
+
+	r, err := getSigningRequest(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	from, err := getAccount(ctx, r.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountAccess(ctx, from); err != nil {
+		return nil, err
+	}
+	if r.Status != signingPending {
+		return nil, fmt.Errorf("signing request %s is %s", r.ID, r.Status)
+	}
+
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r.Status = signingDeclined
+	r.ResolvedBy, _ = getCallerCN(ctx)
+	r.ResolvedAt = now.Format(time.RFC3339)
+	return r, putSigningRequest(ctx, r)
+}
+
+// Fetch signing request
+func (s *SmartContract) GetSigningRequest(ctx contractapi.TransactionContextInterface, id string) (*SigningRequest, error) {
+	r, err := getSigningRequest(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	a, err := getAccount(ctx, r.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountAccess(ctx, a); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// List debits on an account waiting for signatures
+func (s *SmartContract) ListPendingSignatures(ctx contractapi.TransactionContextInterface, accountID string) ([]*SigningRequest, error) {
+	a, err := getAccount(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountAccess(ctx, a); err != nil {
+		return nil, err
+	}
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(signingRequestIndex, []string{a.ID})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var list []*SigningRequest
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, parts, err := ctx.GetStub().SplitCompositeKey(res.Key)
+		if err != nil || len(parts) != 2 {
+			continue
+		}
+		r, err := getSigningRequest(ctx, parts[1])
+		if err != nil {
+			return nil, err
+		}
+		if r.Status == signingPending {
+			list = append(list, r)
+		}
+	}
+	return list, nil
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ======================== Structs ==========================
+
+const (
+	limitRuleObjectType     = "LimitRule"
+	limitUsageObjectType    = "LimitUsage"
+	limitApprovalObjectType = "LimitApproval"
+	limitApprovalEvent      = "LimitApprovalRequired"
+
+	scopeRole     = "ROLE"
+	scopeProduct  = "PRODUCT"
+	scopeCustomer = "CUSTOMER"
+
+	opDeposit    = "DEPOSIT"
+	opWithdrawal = "WITHDRAWAL"
+	opTransfer   = "TRANSFER"
+
+	limitActionFail     = "FAIL"
+	limitActionApproval = "APPROVAL"
+
+	approvalPending  = "PENDING"
+	approvalExecuted = "EXECUTED"
+	approvalRejected = "REJECTED"
+)
+
+// LimitRule caps one operation for a role, a product or a single customer.
+// A zero limit is unlimited. A customer rule replaces the product rule for
+// that customer's accounts; role rules apply to the caller on top of both.
+// Action decides whether an operation over the limit fails or waits for
+// approval.
+type LimitRule struct {
+	Scope          string `json:"scope"`
+	Subject        string `json:"subject"`
+	Operation      string `json:"operation"`
+	PerTransaction int64  `json:"perTransaction"`
+	PerDay         int64  `json:"perDay"`
+	PerMonth       int64  `json:"perMonth"`
+	Action         string `json:"action"`
+	UpdatedBy      string `json:"updatedBy"`
+}
+
+// LimitUsage is the running total of one rule subject for a business day
+// or month
+type LimitUsage struct {
+	Amount int64 `json:"amount"`
+	Count  int   `json:"count"`
+}
+
+// LimitedOperation is a money movement checked against limits. ToAccount
+// is set for transfers only, SigningRequest for joint account debits whose
+// signing request was referred to limit approval.
+type LimitedOperation struct {
+	Operation      string `json:"operation"`
+	AccountID      string `json:"accountId"`
+	ToAccount      string `json:"toAccount,omitempty" metadata:",optional"`
+	Amount         int64  `json:"amount"`
+	SigningRequest string `json:"signingRequest,omitempty" metadata:",optional"`
+}
+
+// LimitApproval is an operation that exceeded a limit whose action is
+// APPROVAL. Nothing is posted until a staff member other than the requester
+// approves it.
+type LimitApproval struct {
+	ID            string            `json:"id"`
+	Operation     *LimitedOperation `json:"operation"`
+	Reason        string            `json:"reason"`
+	Status        string            `json:"status"`
+	RequestedBy   string            `json:"requestedBy"`
+	RequestedRole string            `json:"requestedRole"`
+	RequestedAt   string            `json:"requestedAt"`
+	ResolvedBy    string            `json:"resolvedBy,omitempty" metadata:",optional"`
+	ResolvedAt    string            `json:"resolvedAt,omitempty" metadata:",optional"`
+}
+
+// limitCheck is a rule that applies to an operation and the subject whose
+// usage it is counted against: the caller for role rules, the customer for
+// customer rules and the account for product rules
+type limitCheck struct {
+	rule    *LimitRule
+	subject string
+}
+
+// ======================== Limit Helpers ========================
+
+func getLimitRule(ctx contractapi.TransactionContextInterface, scope string, subject string, operation string) (*LimitRule, bool, error) {
+	key, err := makeKey(ctx, limitRuleObjectType, scope, subject, operation)
+	if err != nil {
+		return nil, false, err
+	}
+	var r LimitRule
+	found, err := getJSON(ctx, key, &r)
+	if err != nil {
+		return nil, false, err
+	}
+	return &r, found, nil
+}
+
+// applicableLimits returns the rules an operation by a caller is subject to
+func applicableLimits(ctx contractapi.TransactionContextInterface, op *LimitedOperation, role string, caller string) ([]limitCheck, error) {
+	a, err := getAccount(ctx, op.AccountID)
+	if err != nil {
+		return nil, err
+	}
+
+	var checks []limitCheck
+	if role != "" {
+		r, found, err := getLimitRule(ctx, scopeRole, role, op.Operation)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			checks = append(checks, limitCheck{rule: r, subject: caller})
+		}
+	}
+
+	r, found, err := getLimitRule(ctx, scopeCustomer, a.OwnerID, op.Operation)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		return append(checks, limitCheck{rule: r, subject: a.OwnerID}), nil
+	}
+	r, found, err = getLimitRule(ctx, scopeProduct, a.Product, op.Operation)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		checks = append(checks, limitCheck{rule: r, subject: a.ID})
+	}
+	return checks, nil
+}
+
+// usageKeys returns the day and month running total keys of a check
+func usageKeys(ctx contractapi.TransactionContextInterface, c limitCheck, date string) (string, string, error) {
+	dayKey, err := makeKey(ctx, limitUsageObjectType, c.rule.Scope, c.subject, c.rule.Operation, date)
+	if err != nil {
+		return "", "", err
+	}
+	monthKey, err := makeKey(ctx, limitUsageObjectType, c.rule.Scope, c.subject, c.rule.Operation, date[:7])
+	if err != nil {
+		return "", "", err
+	}
+	return dayKey, monthKey, nil
+}
+
+// exceededBy reports which limit of a check an amount would exceed, if any
+func exceededBy(ctx contractapi.TransactionContextInterface, c limitCheck, amount int64, date string) (string, error) {
+	r := c.rule
+	if r.PerTransaction > 0 && amount > r.PerTransaction {
+		return fmt.Sprintf("%s %s limit per transaction is %d", r.Scope, r.Subject, r.PerTransaction), nil
+	}
+	dayKey, monthKey, err := usageKeys(ctx, c, date)
+	if err != nil {
+		return "", err
+	}
+	var day, month LimitUsage
+	if _, err := getJSON(ctx, dayKey, &day); err != nil {
+		return "", err
+	}
+	if _, err := getJSON(ctx, monthKey, &month); err != nil {
+		return "", err
+	}
+	if r.PerDay > 0 && day.Amount+amount > r.PerDay {
+		return fmt.Sprintf("%s %s daily limit is %d, %d used", r.Scope, r.Subject, r.PerDay, day.Amount), nil
+	}
+	if r.PerMonth > 0 && month.Amount+amount > r.PerMonth {
+		return fmt.Sprintf("%s %s monthly limit is %d, %d used", r.Scope, r.Subject, r.PerMonth, month.Amount), nil
+	}
+	return "", nil
+}
+
+// recordUsage adds an operation to the running totals of its checks
+func recordUsage(ctx contractapi.TransactionContextInterface, checks []limitCheck, amount int64, date string) error {
+	for _, c := range checks {
+		dayKey, monthKey, err := usageKeys(ctx, c, date)
+		if err != nil {
+			return err
+		}
+		for _, key := range []string{dayKey, monthKey} {
+			var u LimitUsage
+			if _, err := getJSON(ctx, key, &u); err != nil {
+				return err
+			}
+			u.Amount += amount
+			u.Count++
+			if err := putJSON(ctx, key, u); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkLimits checks an operation by the caller against its limits. It
+// fails over a FAIL limit and otherwise returns the checks to record usage
+// against, the business date and, if an APPROVAL limit is exceeded, why.
+func checkLimits(ctx contractapi.TransactionContextInterface, op *LimitedOperation) ([]limitCheck, string, string, error) {
+	role, _, err := getClientRole(ctx)
+	if err != nil {
+		return nil, "", "", err
+	}
+	cn, _ := getCallerCN(ctx)
+	checks, err := applicableLimits(ctx, op, role, cn)
+	if err != nil || len(checks) == 0 {
+		return nil, "", "", err
+	}
+	date, err := getBusinessDate(ctx)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	approvalReason := ""
+	for _, c := range checks {
+		reason, err := exceededBy(ctx, c, op.Amount, date)
+		if err != nil {
+			return nil, "", "", err
+		}
+		if reason == "" {
+			continue
+		}
+		if c.rule.Action != limitActionApproval {
+			return nil, "", "", fmt.Errorf("limit exceeded: %s", reason)
+		}
+		if approvalReason == "" {
+			approvalReason = reason
+		}
+	}
+	return checks, date, approvalReason, nil
+}
+
+// enforceLimits applies limits to an operation that cannot wait for
+// approval, such as a standing order, a direct debit or a payment held by a
+// subsystem: ApproveLimitOverride could only replay it as a plain transfer,
+// so it fails over any limit. Within limits the usage is recorded.
+func enforceLimits(ctx contractapi.TransactionContextInterface, op *LimitedOperation) error {
+	checks, date, approvalReason, err := checkLimits(ctx, op)
+	if err != nil || len(checks) == 0 {
+		return err
+	}
+	if approvalReason != "" {
+		return fmt.Errorf("limit exceeded: %s", approvalReason)
+	}
+	return recordUsage(ctx, checks, op.Amount, date)
+}
+
+// applyLimits checks an operation by the caller against its limits. Within
+// limits the usage is recorded and false is returned so the caller posts the
+// operation. Over a FAIL limit it returns an error; over an APPROVAL limit it
+// queues a LimitApproval, emits an event and returns true.
+func applyLimits(ctx contractapi.TransactionContextInterface, op *LimitedOperation) (bool, error) {
+	checks, date, approvalReason, err := checkLimits(ctx, op)
+	if err != nil || len(checks) == 0 {
+		return false, err
+	}
+	if approvalReason == "" {
+		return false, recordUsage(ctx, checks, op.Amount, date)
+	}
+	role, _, err := getClientRole(ctx)
+	if err != nil {
+		return false, err
+	}
+	cn, _ := getCallerCN(ctx)
+
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return false, err
+	}
+	approval := &LimitApproval{
+		ID:            newID(ctx, "LAP"),
+		Operation:     op,
+		Reason:        approvalReason,
+		Status:        approvalPending,
+		RequestedBy:   cn,
+		RequestedRole: role,
+		RequestedAt:   now.Format(time.RFC3339),
+	}
+	if err := putLimitApproval(ctx, approval); err != nil {
+		return false, err
+	}
+	payload, err := json.Marshal(approval)
+	if err != nil {
+		return false, err
+	}
+	return true, ctx.GetStub().SetEvent(limitApprovalEvent, payload)
+}
+
+func getLimitApproval(ctx contractapi.TransactionContextInterface, id string) (*LimitApproval, error) {
+	if id == "" {
+		return nil, fmt.Errorf("approval id required")
+	}
+	key, err := makeKey(ctx, limitApprovalObjectType, id)
+	if err != nil {
+		return nil, err
+	}
+	var a LimitApproval
+	found, err := getJSON(ctx, key, &a)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("limit approval %s not found", id)
+	}
+	return &a, nil
+}
+
+func putLimitApproval(ctx contractapi.TransactionContextInterface, a *LimitApproval) error {
+	key, err := makeKey(ctx, limitApprovalObjectType, a.ID)
+	if err != nil {
+		return err
+	}
+	return putJSON(ctx, key, a)
+}
+
+// ======================== Limit Methods ========================
+
+// Create or replace the limit rule for a scope, subject and operation
+func (s *SmartContract) SetLimitRule(
+	ctx contractapi.TransactionContextInterface,
+	scope string, subject string, operation string,
+	perTransaction int64, perDay int64, perMonth int64, action string,
+) (*LimitRule, error) {
+
+	if err := requireRole(ctx, "SuperAdmin", "Admin"); err != nil {
+		return nil, err
+	}
+	switch scope {
+	case scopeRole, scopeProduct, scopeCustomer:
+	default:
+		return nil, fmt.Errorf("invalid scope: %s", scope)
+	}
+	switch operation {
+	case opDeposit, opWithdrawal, opTransfer:
+	default:
+		return nil, fmt.Errorf("invalid operation: %s", operation)
+	}
+	if action != limitActionFail && action != limitActionApproval {
+		return nil, fmt.Errorf("invalid action: %s", action)
+	}
+	if subject == "" {
+		return nil, fmt.Errorf("subject required")
+	}
+	if perTransaction < 0 || perDay < 0 || perMonth < 0 {
+		return nil, fmt.Errorf("limits cannot be negative")
+	}
+
+	cn, _ := getCallerCN(ctx)
+	rule := &LimitRule{
+		Scope:          scope,
+		Subject:        subject,
+		Operation:      operation,
+		PerTransaction: perTransaction,
+		PerDay:         perDay,
+		PerMonth:       perMonth,
+		Action:         action,
+		UpdatedBy:      cn,
+	}
+	key, err := makeKey(ctx, limitRuleObjectType, scope, subject, operation)
+	if err != nil {
+		return nil, err
+	}
+	if err := putJSON(ctx, key, rule); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+// Remove a limit rule
+func (s *SmartContract) RemoveLimitRule(ctx contractapi.TransactionContextInterface, scope string, subject string, operation string) error {
+
+	if err := requireRole(ctx, "SuperAdmin", "Admin"); err != nil {
+		return err
+	}
+	_, found, err := getLimitRule(ctx, scope, subject, operation)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("no %s limit for %s %s", operation, scope, subject)
+	}
+	key, err := makeKey(ctx, limitRuleObjectType, scope, subject, operation)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().DelState(key)
+}
+
+// List all limit rules
+func (s *SmartContract) ListLimitRules(ctx contractapi.TransactionContextInterface) ([]*LimitRule, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(limitRuleObjectType, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var list []*LimitRule
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		var r LimitRule
+		if err := json.Unmarshal(res.Value, &r); err != nil {
+			return nil, fmt.Errorf("corrupt limit rule at %s: %v", res.Key, err)
+		}
+		list = append(list, &r)
+	}
+	return list, nil
+}
+
+// Approve an operation queued by a limit and post it
+func (s *SmartContract) ApproveLimitOverride(ctx contractapi.TransactionContextInterface, id string) (*LimitApproval, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+
+	approval, err := getLimitApproval(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if approval.Status != approvalPending {
+		return nil, fmt.Errorf("limit approval %s is %s", approval.ID, approval.Status)
+	}
+	cn, _ := getCallerCN(ctx)
+	if cn == approval.RequestedBy {
+		return nil, fmt.Errorf("an operation cannot be approved by its requester")
+	}
+
+	op := approval.Operation
+	a, err := getAccount(ctx, op.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountBank(ctx, a); err != nil {
+		return nil, err
+	}
+	switch op.Operation {
+	case opDeposit:
+		err = depositCash(ctx, a, op.Amount)
+	case opWithdrawal:
+		err = withdrawCash(ctx, a, op.Amount)
+	case opTransfer:
+		var to *Account
+		if to, err = getAccount(ctx, op.ToAccount); err == nil {
+			err = transferFunds(ctx, a, to, op.Amount, channelForRole(approval.RequestedRole))
+		}
+	default:
+		err = fmt.Errorf("unknown operation %s", op.Operation)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := resolveReferredRequest(ctx, op, signingExecuted); err != nil {
+		return nil, err
+	}
+
+	// The approved amount still counts towards the requester's totals
+	checks, err := applicableLimits(ctx, op, approval.RequestedRole, approval.RequestedBy)
+	if err != nil {
+		return nil, err
+	}
+	date, err := getBusinessDate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := recordUsage(ctx, checks, op.Amount, date); err != nil {
+		return nil, err
+	}
+
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	approval.Status = approvalExecuted
+	approval.ResolvedBy = cn
+	approval.ResolvedAt = now.Format(time.RFC3339)
+	if err := putLimitApproval(ctx, approval); err != nil {
+		return nil, err
+	}
+	return approval, nil
+}
+
+// Reject an operation queued by a limit
+func (s *SmartContract) RejectLimitOverride(ctx contractapi.TransactionContextInterface, id string) (*LimitApproval, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+
+	approval, err := getLimitApproval(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if approval.Status != approvalPending {
+		return nil, fmt.Errorf("limit approval %s is %s", approval.ID, approval.Status)
+	}
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := resolveReferredRequest(ctx, approval.Operation, signingDeclined); err != nil {
+		return nil, err
+	}
+	approval.Status = approvalRejected
+	approval.ResolvedBy, _ = getCallerCN(ctx)
+	approval.ResolvedAt = now.Format(time.RFC3339)
+	if err := putLimitApproval(ctx, approval); err != nil {
+		return nil, err
+	}
+	return approval, nil
+}
+
+// List operations waiting for limit approval
+func (s *SmartContract) ListPendingLimitApprovals(ctx contractapi.TransactionContextInterface) ([]*LimitApproval, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(limitApprovalObjectType, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var list []*LimitApproval
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		var a LimitApproval
+		if err := json.Unmarshal(res.Value, &a); err != nil {
+			return nil, fmt.Errorf("corrupt limit approval at %s: %v", res.Key, err)
+		}
+		if a.Status == approvalPending {
+			list = append(list, &a)
+		}
+	}
+	return list, nil
+}
@@ -0,0 +1,896 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ======================== Structs ==========================
+
+const (
+	loanObjectType         = "Loan"
+	loanScheduleObjectType = "LoanSchedule"
+	loanConfigKey          = "LoanConfig"
+	delinquencyIndex       = "delinquency~branch~bucket~id"
+
+	defaultLoanPenaltyRate = 200
+
+	// maxLoanTermMonths bounds the schedule a single application can build
+	maxLoanTermMonths = 360
+
+	loanApplied    = "APPLIED"
+	loanApproved   = "APPROVED"
+	loanDisbursed  = "DISBURSED"
+	loanClosed     = "CLOSED"
+	loanWrittenOff = "WRITTEN_OFF"
+
+	// Delinquency buckets by days past due
+	bucketCurrent = "CURRENT"
+	bucket1to29   = "1-29"
+	bucket30to59  = "30-59"
+	bucket60to89  = "60-89"
+	bucket90Plus  = "90+"
+)
+
+// loanTransitions is the loan state machine: status -> allowed next statuses
+var loanTransitions = map[string][]string{
+	loanApplied:   {loanApproved, loanClosed},
+	loanApproved:  {loanDisbursed, loanClosed},
+	loanDisbursed: {loanClosed, loanWrittenOff},
+}
+
+// Loan is a reducing-balance term loan. Principal and balances are in minor
+// units and Rate is annual in basis points, as for fixed deposits.
+type Loan struct {
+	ID          string `json:"id"`
+	BorrowerID  string `json:"borrowerId"`
+	AccountID   string `json:"accountId"`
+	BankBranch  string `json:"bankBranch"`
+	Principal   int64  `json:"principal"`
+	Rate        int64  `json:"rate"`
+	TermMonths  int    `json:"termMonths"`
+	Instalment  int64  `json:"instalment"`
+	Outstanding int64  `json:"outstanding"`
+	Status      string `json:"status"`
+	AppliedBy   string `json:"appliedBy"`
+	AppliedAt   string `json:"appliedAt"`
+	ApprovedBy  string `json:"approvedBy,omitempty" metadata:",optional"`
+	ApprovedAt  string `json:"approvedAt,omitempty" metadata:",optional"`
+	DisbursedBy string `json:"disbursedBy,omitempty" metadata:",optional"`
+	DisbursedAt string `json:"disbursedAt,omitempty" metadata:",optional"`
+	ClosedBy    string `json:"closedBy,omitempty" metadata:",optional"`
+	ClosedAt    string `json:"closedAt,omitempty" metadata:",optional"`
+
+	// Servicing state maintained by RepayLoan and RunDelinquencyAging
+	PenaltyDue       int64  `json:"penaltyDue"`
+	PenaltyAccruedTo string `json:"penaltyAccruedTo,omitempty" metadata:",optional"`
+	DaysPastDue      int    `json:"daysPastDue"`
+	Bucket           string `json:"bucket,omitempty" metadata:",optional"`
+}
+
+// Instalment is one line of an amortisation schedule
+type Instalment struct {
+	Number    int    `json:"number"`
+	DueDate   string `json:"dueDate"`
+	Payment   int64  `json:"payment"`
+	Principal int64  `json:"principal"`
+	Interest  int64  `json:"interest"`
+	Balance   int64  `json:"balance"`
+
+	PaidPrincipal int64 `json:"paidPrincipal"`
+	PaidInterest  int64 `json:"paidInterest"`
+}
+
+// LoanConfig holds bank-wide loan servicing settings
+type LoanConfig struct {
+	PenaltyRate int64  `json:"penaltyRate"`
+	UpdatedBy   string `json:"updatedBy"`
+}
+
+// RepaymentResult shows how a repayment was allocated
+type RepaymentResult struct {
+	LoanID        string `json:"loanId"`
+	Amount        int64  `json:"amount"`
+	PenaltyPaid   int64  `json:"penaltyPaid"`
+	InterestPaid  int64  `json:"interestPaid"`
+	PrincipalPaid int64  `json:"principalPaid"`
+	Outstanding   int64  `json:"outstanding"`
+	Status        string `json:"status"`
+}
+
+// AgingResult summarises one page of a delinquency aging run. An empty
+// Bookmark means every loan has been aged.
+type AgingResult struct {
+	AsOfDate       string `json:"asOfDate"`
+	Processed      int    `json:"processed"`
+	Overdue        int    `json:"overdue"`
+	PenaltyAccrued int64  `json:"penaltyAccrued"`
+	Bookmark       string `json:"bookmark"`
+}
+
+// LoanSchedule is the amortisation schedule stored for a loan. Until the loan
+// is disbursed the due dates are provisional, counted from the application date.
+type LoanSchedule struct {
+	LoanID      string       `json:"loanId"`
+	StartDate   string       `json:"startDate"`
+	Provisional bool         `json:"provisional"`
+	Instalments []Instalment `json:"instalments"`
+}
+
+// ======================== Loan Helpers ========================
+
+func getLoan(ctx contractapi.TransactionContextInterface, id string) (*Loan, error) {
+	if id == "" {
+		return nil, fmt.Errorf("loan id required")
+	}
+	key, err := makeKey(ctx, loanObjectType, id)
+	if err != nil {
+		return nil, err
+	}
+	var l Loan
+	found, err := getJSON(ctx, key, &l)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("loan %s not found", id)
+	}
+	return &l, nil
+}
+
+func putLoan(ctx contractapi.TransactionContextInterface, l *Loan) error {
+	key, err := makeKey(ctx, loanObjectType, l.ID)
+	if err != nil {
+		return err
+	}
+	return putJSON(ctx, key, l)
+}
+
+func getLoanSchedule(ctx contractapi.TransactionContextInterface, loanID string) (*LoanSchedule, error) {
+	key, err := makeKey(ctx, loanScheduleObjectType, loanID)
+	if err != nil {
+		return nil, err
+	}
+	var sched LoanSchedule
+	found, err := getJSON(ctx, key, &sched)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("no schedule for loan %s", loanID)
+	}
+	return &sched, nil
+}
+
+func putLoanSchedule(ctx contractapi.TransactionContextInterface, sched *LoanSchedule) error {
+	key, err := makeKey(ctx, loanScheduleObjectType, sched.LoanID)
+	if err != nil {
+		return err
+	}
+	return putJSON(ctx, key, sched)
+}
+
+// transitionLoan moves a loan to the next status if the state machine allows it
+func transitionLoan(l *Loan, to string) error {
+	for _, next := range loanTransitions[l.Status] {
+		if next == to {
+			l.Status = to
+			return nil
+		}
+	}
+	return fmt.Errorf("loan %s cannot move from %s to %s", l.ID, l.Status, to)
+}
+
+// roundRat rounds a non-negative rational to the nearest integer, halves up
+func roundRat(r *big.Rat) int64 {
+	num := new(big.Int).Mul(r.Num(), big.NewInt(2))
+	num.Add(num, r.Denom())
+	den := new(big.Int).Mul(r.Denom(), big.NewInt(2))
+	return new(big.Int).Quo(num, den).Int64()
+}
+
+// monthlyInterest is one month of interest on balance at an annual rate in basis points
+func monthlyInterest(balance int64, rateBps int64) int64 {
+	return roundRat(big.NewRat(balance*rateBps, 12*10000))
+}
+
+// amortise builds an equal-instalment reducing-balance schedule. Exact
+// rational arithmetic keeps the result identical on every endorsing peer;
+// the final instalment absorbs any rounding difference.
+func amortise(principal int64, rateBps int64, termMonths int, startDate string) (int64, []Instalment, error) {
+	var payment int64
+	if rateBps == 0 {
+		payment = roundRat(big.NewRat(principal, int64(termMonths)))
+	} else {
+		r := big.NewRat(rateBps, 12*10000)
+		growth := new(big.Rat).Add(big.NewRat(1, 1), r)
+		pow := big.NewRat(1, 1)
+		for i := 0; i < termMonths; i++ {
+			pow.Mul(pow, growth)
+		}
+		num := new(big.Rat).Mul(big.NewRat(principal, 1), r)
+		num.Mul(num, pow)
+		den := new(big.Rat).Sub(pow, big.NewRat(1, 1))
+		payment = roundRat(num.Quo(num, den))
+	}
+
+	balance := principal
+	lines := make([]Instalment, 0, termMonths)
+	for i := 1; i <= termMonths; i++ {
+		due, err := addMonths(startDate, i)
+		if err != nil {
+			return 0, nil, err
+		}
+		interest := monthlyInterest(balance, rateBps)
+		principalPart := payment - interest
+		if i == termMonths || principalPart > balance {
+			principalPart = balance
+		}
+		balance -= principalPart
+		lines = append(lines, Instalment{
+			Number:    i,
+			DueDate:   due,
+			Payment:   principalPart + interest,
+			Principal: principalPart,
+			Interest:  interest,
+			Balance:   balance,
+		})
+	}
+	return payment, lines, nil
+}
+
+func scheduleLoan(ctx contractapi.TransactionContextInterface, l *Loan, startDate string, provisional bool) error {
+	payment, lines, err := amortise(l.Principal, l.Rate, l.TermMonths, startDate)
+	if err != nil {
+		return err
+	}
+	l.Instalment = payment
+	return putLoanSchedule(ctx, &LoanSchedule{
+		LoanID:      l.ID,
+		StartDate:   startDate,
+		Provisional: provisional,
+		Instalments: lines,
+	})
+}
+
+func getLoanConfig(ctx contractapi.TransactionContextInterface) (*LoanConfig, error) {
+	key, err := makeKey(ctx, loanConfigKey)
+	if err != nil {
+		return nil, err
+	}
+	cfg := LoanConfig{PenaltyRate: defaultLoanPenaltyRate}
+	if _, err := getJSON(ctx, key, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func bucketFor(daysPastDue int) string {
+	switch {
+	case daysPastDue <= 0:
+		return bucketCurrent
+	case daysPastDue < 30:
+		return bucket1to29
+	case daysPastDue < 60:
+		return bucket30to59
+	case daysPastDue < 90:
+		return bucket60to89
+	default:
+		return bucket90Plus
+	}
+}
+
+// setDelinquencyIndex keeps the branch/bucket index in step with the loan. Only
+// disbursed loans that are past due appear in the index.
+func setDelinquencyIndex(ctx contractapi.TransactionContextInterface, l *Loan, oldBucket string) error {
+	if oldBucket != "" && oldBucket != bucketCurrent {
+		key, err := makeKey(ctx, delinquencyIndex, l.BankBranch, oldBucket, l.ID)
+		if err != nil {
+			return err
+		}
+		if err := ctx.GetStub().DelState(key); err != nil {
+			return err
+		}
+	}
+	if l.Status != loanDisbursed || l.Bucket == "" || l.Bucket == bucketCurrent {
+		return nil
+	}
+	key, err := makeKey(ctx, delinquencyIndex, l.BankBranch, l.Bucket, l.ID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, []byte{0x00})
+}
+
+// overdueOf returns the unpaid amount of instalments due on or before asOfDate
+// and the due date of the oldest of them ("" when nothing is overdue)
+func overdueOf(sched *LoanSchedule, asOfDate string) (int64, string) {
+	var overdue int64
+	oldest := ""
+	for _, in := range sched.Instalments {
+		if in.DueDate > asOfDate {
+			break
+		}
+		unpaid := in.Principal - in.PaidPrincipal + in.Interest - in.PaidInterest
+		if unpaid > 0 {
+			overdue += unpaid
+			if oldest == "" {
+				oldest = in.DueDate
+			}
+		}
+	}
+	return overdue, oldest
+}
+
+// penaltyOf is the penalty interest on overdue instalments for the days after
+// accruedTo up to asOfDate. Each instalment accrues from its own due date.
+func penaltyOf(sched *LoanSchedule, accruedTo string, asOfDate string, penaltyRate int64) (int64, error) {
+	// Sum unpaid amount x days first so that truncation happens once
+	var dayAmounts int64
+	for _, in := range sched.Instalments {
+		if in.DueDate > asOfDate {
+			break
+		}
+		unpaid := in.Principal - in.PaidPrincipal + in.Interest - in.PaidInterest
+		if unpaid <= 0 {
+			continue
+		}
+		from := in.DueDate
+		if accruedTo > from {
+			from = accruedTo
+		}
+		days, err := daysBetween(from, asOfDate)
+		if err != nil {
+			return 0, err
+		}
+		if days > 0 {
+			dayAmounts += unpaid * int64(days)
+		}
+	}
+	return dayAmounts * penaltyRate / (365 * 10000), nil
+}
+
+// ageLoan accrues penalty interest on overdue instalments up to asOfDate and
+// reclassifies the loan into its delinquency bucket. Accrual is idempotent:
+// penalty is only charged for days after PenaltyAccruedTo.
+func ageLoan(ctx contractapi.TransactionContextInterface, l *Loan, asOfDate string, penaltyRate int64) (int64, error) {
+	sched, err := getLoanSchedule(ctx, l.ID)
+	if err != nil {
+		return 0, err
+	}
+	_, oldest := overdueOf(sched, asOfDate)
+
+	penalty, err := penaltyOf(sched, l.PenaltyAccruedTo, asOfDate, penaltyRate)
+	if err != nil {
+		return 0, err
+	}
+	if asOfDate > l.PenaltyAccruedTo {
+		l.PenaltyAccruedTo = asOfDate
+	}
+	l.PenaltyDue += penalty
+
+	l.DaysPastDue = 0
+	if oldest != "" {
+		l.DaysPastDue, err = daysBetween(oldest, asOfDate)
+		if err != nil {
+			return 0, err
+		}
+	}
+	oldBucket := l.Bucket
+	l.Bucket = bucketFor(l.DaysPastDue)
+	if err := setDelinquencyIndex(ctx, l, oldBucket); err != nil {
+		return 0, err
+	}
+	return penalty, putLoan(ctx, l)
+}
+
+// requireLoanAccess allows staff or the borrower
+func requireLoanAccess(ctx contractapi.TransactionContextInterface, l *Loan) error {
+	if isStaff(ctx) {
+		return nil
+	}
+	cn, err := getCallerCN(ctx)
+	if err != nil {
+		return err
+	}
+	if cn != l.BorrowerID {
+		return fmt.Errorf("access denied: %s is not the borrower of loan %s", cn, l.ID)
+	}
+	return nil
+}
+
+// ageLoans ages one page of disbursed loans as of a date, resuming after bookmark
+func ageLoans(
+	ctx contractapi.TransactionContextInterface,
+	asOfDate string, pageSize int, bookmark string,
+) (*AgingResult, error) {
+	cfg, err := getLoanConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &AgingResult{AsOfDate: asOfDate}
+	next, err := scanIndex(ctx, loanObjectType, nil, bookmark, pageSize,
+		func(key string, _ []string, value []byte) (bool, error) {
+			var loan Loan
+			if err := json.Unmarshal(value, &loan); err != nil {
+				return false, fmt.Errorf("corrupt loan at %s: %v", key, err)
+			}
+			if loan.Status != loanDisbursed {
+				return true, nil
+			}
+			penalty, err := ageLoan(ctx, &loan, asOfDate, cfg.PenaltyRate)
+			if err != nil {
+				return false, err
+			}
+			result.Processed++
+			result.PenaltyAccrued += penalty
+			if loan.DaysPastDue > 0 {
+				result.Overdue++
+			}
+			return true, nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	result.Bookmark = next
+	return result, nil
+}
+
+// ======================== Loan Methods ========================
+
+// Apply for a loan on behalf of a customer
+func (s *SmartContract) ApplyForLoan(
+	ctx contractapi.TransactionContextInterface,
+	borrowerID string, accountID string, principal int64, rate int64, termMonths int,
+) (*Loan, error) {
+
+	if err := requireRole(ctx, "Manager"); err != nil {
+		return nil, err
+	}
+	if principal <= 0 || termMonths <= 0 || rate < 0 {
+		return nil, fmt.Errorf("principal and termMonths must be positive and rate non-negative")
+	}
+	if termMonths > maxLoanTermMonths {
+		return nil, fmt.Errorf("termMonths cannot exceed %d", maxLoanTermMonths)
+	}
+	// Interest is computed as principal x rate x months; refuse terms that overflow it
+	if rate > 0 && principal > math.MaxInt64/rate/int64(termMonths) {
+		return nil, fmt.Errorf("principal %d at %d basis points over %d months is too large", principal, rate, termMonths)
+	}
+
+	borrower, err := s.GetUser(ctx, borrowerID)
+	if err != nil {
+		return nil, err
+	}
+	if borrower.Role != "User" || !borrower.IsActive {
+		return nil, fmt.Errorf("%s is not an active customer", borrowerID)
+	}
+	account, err := getAccount(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if !isAccountOwner(account, borrowerID) {
+		return nil, fmt.Errorf("account %s does not belong to %s", accountID, borrowerID)
+	}
+
+	today, err := getBusinessDate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cn, _ := getCallerCN(ctx)
+
+	loan := &Loan{
+		ID:         newID(ctx, "LN"),
+		BorrowerID: borrowerID,
+		AccountID:  accountID,
+		BankBranch: account.BankBranch,
+		Principal:  principal,
+		Rate:       rate,
+		TermMonths: termMonths,
+		Status:     loanApplied,
+		AppliedBy:  cn,
+		AppliedAt:  today,
+	}
+	if err := scheduleLoan(ctx, loan, today, true); err != nil {
+		return nil, err
+	}
+	if err := putLoan(ctx, loan); err != nil {
+		return nil, err
+	}
+	return loan, nil
+}
+
+// Approve a loan application
+func (s *SmartContract) ApproveLoan(ctx contractapi.TransactionContextInterface, id string) (*Loan, error) {
+
+	if err := requireRole(ctx, "SuperAdmin", "Admin"); err != nil {
+		return nil, err
+	}
+
+	loan, err := getLoan(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := transitionLoan(loan, loanApproved); err != nil {
+		return nil, err
+	}
+
+	loan.ApprovedBy, _ = getCallerCN(ctx)
+	loan.ApprovedAt, err = getBusinessDate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := putLoan(ctx, loan); err != nil {
+		return nil, err
+	}
+	return loan, nil
+}
+
+// Disburse an approved loan into the borrower's account
+func (s *SmartContract) DisburseLoan(ctx contractapi.TransactionContextInterface, id string) (*Loan, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+
+	loan, err := getLoan(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := transitionLoan(loan, loanDisbursed); err != nil {
+		return nil, err
+	}
+
+	account, err := getAccount(ctx, loan.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountBank(ctx, account); err != nil {
+		return nil, err
+	}
+	if err := postToAccount(ctx, account, loan.Principal, "Loan disbursement "+loan.ID); err != nil {
+		return nil, err
+	}
+	if err := glDebit(ctx, glLoans, loan.Principal, "Loan disbursement "+loan.ID); err != nil {
+		return nil, err
+	}
+
+	today, err := getBusinessDate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := scheduleLoan(ctx, loan, today, false); err != nil {
+		return nil, err
+	}
+
+	loan.DisbursedBy, _ = getCallerCN(ctx)
+	loan.DisbursedAt = today
+	loan.Outstanding = loan.Principal
+	loan.Bucket = bucketCurrent
+	if err := putLoan(ctx, loan); err != nil {
+		return nil, err
+	}
+	return loan, nil
+}
+
+// Cancel a loan that has not been disbursed
+func (s *SmartContract) CancelLoan(ctx contractapi.TransactionContextInterface, id string) (*Loan, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+
+	loan, err := getLoan(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if loan.Status == loanDisbursed {
+		return nil, fmt.Errorf("loan %s is disbursed and can only be repaid or written off", loan.ID)
+	}
+	if err := transitionLoan(loan, loanClosed); err != nil {
+		return nil, err
+	}
+
+	loan.ClosedBy, _ = getCallerCN(ctx)
+	loan.ClosedAt, err = getBusinessDate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := putLoan(ctx, loan); err != nil {
+		return nil, err
+	}
+	return loan, nil
+}
+
+// Write off a disbursed loan as unrecoverable
+func (s *SmartContract) WriteOffLoan(ctx contractapi.TransactionContextInterface, id string) (*Loan, error) {
+
+	if err := requireRole(ctx, "SuperAdmin", "Admin"); err != nil {
+		return nil, err
+	}
+
+	loan, err := getLoan(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	oldBucket := loan.Bucket
+	if err := transitionLoan(loan, loanWrittenOff); err != nil {
+		return nil, err
+	}
+	loan.Bucket = ""
+	if err := setDelinquencyIndex(ctx, loan, oldBucket); err != nil {
+		return nil, err
+	}
+	if err := glDebit(ctx, glWriteOffExpense, loan.Outstanding, "Loan write-off "+loan.ID); err != nil {
+		return nil, err
+	}
+	if err := glCredit(ctx, glLoans, loan.Outstanding, "Loan write-off "+loan.ID); err != nil {
+		return nil, err
+	}
+
+	loan.ClosedBy, _ = getCallerCN(ctx)
+	loan.ClosedAt, err = getBusinessDate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := putLoan(ctx, loan); err != nil {
+		return nil, err
+	}
+	return loan, nil
+}
+
+// Fetch loan
+func (s *SmartContract) GetLoan(ctx contractapi.TransactionContextInterface, id string) (*Loan, error) {
+	loan, err := getLoan(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireLoanAccess(ctx, loan); err != nil {
+		return nil, err
+	}
+	return loan, nil
+}
+
+// Fetch the amortisation schedule of a loan
+func (s *SmartContract) GetLoanSchedule(ctx contractapi.TransactionContextInterface, id string) (*LoanSchedule, error) {
+	loan, err := getLoan(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireLoanAccess(ctx, loan); err != nil {
+		return nil, err
+	}
+	return getLoanSchedule(ctx, loan.ID)
+}
+
+// ======================== Loan Servicing Methods ========================
+
+// Repay a disbursed loan from the borrower's account. The payment settles
+// penalties first, then interest, then principal; instalments already due are
+// settled before any amount is applied to future instalments.
+func (s *SmartContract) RepayLoan(ctx contractapi.TransactionContextInterface, id string, amount int64) (*RepaymentResult, error) {
+
+	if amount <= 0 {
+		return nil, fmt.Errorf("amount must be positive")
+	}
+
+	loan, err := getLoan(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireLoanAccess(ctx, loan); err != nil {
+		return nil, err
+	}
+	if loan.Status != loanDisbursed {
+		return nil, fmt.Errorf("loan %s is %s", loan.ID, loan.Status)
+	}
+	sched, err := getLoanSchedule(ctx, loan.ID)
+	if err != nil {
+		return nil, err
+	}
+	today, err := getBusinessDate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	owing := loan.PenaltyDue
+	for _, in := range sched.Instalments {
+		owing += in.Principal - in.PaidPrincipal + in.Interest - in.PaidInterest
+	}
+	if amount > owing {
+		return nil, fmt.Errorf("repayment %d exceeds amount owing %d", amount, owing)
+	}
+
+	account, err := getAccount(ctx, loan.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountBank(ctx, account); err != nil {
+		return nil, err
+	}
+	if err := postToAccount(ctx, account, -amount, "Loan repayment "+loan.ID); err != nil {
+		return nil, err
+	}
+
+	result := &RepaymentResult{LoanID: loan.ID, Amount: amount}
+	remaining := amount
+	take := func(due int64) int64 {
+		if due > remaining {
+			due = remaining
+		}
+		remaining -= due
+		return due
+	}
+
+	// 1. penalties
+	result.PenaltyPaid = take(loan.PenaltyDue)
+	loan.PenaltyDue -= result.PenaltyPaid
+
+	// 2. interest, then 3. principal, on instalments already due
+	lines := sched.Instalments
+	for i := range lines {
+		if lines[i].DueDate > today {
+			break
+		}
+		paid := take(lines[i].Interest - lines[i].PaidInterest)
+		lines[i].PaidInterest += paid
+		result.InterestPaid += paid
+	}
+	for i := range lines {
+		if lines[i].DueDate > today {
+			break
+		}
+		paid := take(lines[i].Principal - lines[i].PaidPrincipal)
+		lines[i].PaidPrincipal += paid
+		result.PrincipalPaid += paid
+	}
+
+	// anything left is paid in advance against future instalments
+	for i := range lines {
+		if remaining == 0 {
+			break
+		}
+		paid := take(lines[i].Interest - lines[i].PaidInterest)
+		lines[i].PaidInterest += paid
+		result.InterestPaid += paid
+		paid = take(lines[i].Principal - lines[i].PaidPrincipal)
+		lines[i].PaidPrincipal += paid
+		result.PrincipalPaid += paid
+	}
+
+	loan.Outstanding -= result.PrincipalPaid
+	if err := putLoanSchedule(ctx, sched); err != nil {
+		return nil, err
+	}
+
+	narrative := "Loan repayment " + loan.ID
+	if err := glCredit(ctx, glPenaltyIncome, result.PenaltyPaid, narrative); err != nil {
+		return nil, err
+	}
+	if err := glCredit(ctx, glInterestIncome, result.InterestPaid, narrative); err != nil {
+		return nil, err
+	}
+	if err := glCredit(ctx, glLoans, result.PrincipalPaid, narrative); err != nil {
+		return nil, err
+	}
+
+	oldBucket := loan.Bucket
+	if loan.Outstanding == 0 && loan.PenaltyDue == 0 {
+		if err := transitionLoan(loan, loanClosed); err != nil {
+			return nil, err
+		}
+		loan.ClosedBy, _ = getCallerCN(ctx)
+		loan.ClosedAt = today
+		loan.DaysPastDue = 0
+		loan.Bucket = ""
+	} else {
+		loan.DaysPastDue = 0
+		if _, oldest := overdueOf(sched, today); oldest != "" {
+			if loan.DaysPastDue, err = daysBetween(oldest, today); err != nil {
+				return nil, err
+			}
+		}
+		loan.Bucket = bucketFor(loan.DaysPastDue)
+	}
+	if err := setDelinquencyIndex(ctx, loan, oldBucket); err != nil {
+		return nil, err
+	}
+	if err := putLoan(ctx, loan); err != nil {
+		return nil, err
+	}
+
+	result.Outstanding = loan.Outstanding
+	result.Status = loan.Status
+	return result, nil
+}
+
+// Age all disbursed loans as of a date, one page per transaction: accrue
+// penalty interest and assign delinquency buckets
+func (s *SmartContract) RunDelinquencyAging(
+	ctx contractapi.TransactionContextInterface,
+	asOfDate string, pageSize int, bookmark string,
+) (*AgingResult, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+	if _, err := parseDate(asOfDate); err != nil {
+		return nil, err
+	}
+	today, err := getBusinessDate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if asOfDate > today {
+		return nil, fmt.Errorf("cannot age loans ahead of %s", today)
+	}
+	return ageLoans(ctx, asOfDate, pageSize, bookmark)
+}
+
+// List overdue loans of a branch, optionally limited to one delinquency bucket
+func (s *SmartContract) ListOverdueLoans(ctx contractapi.TransactionContextInterface, branch string, bucket string) ([]*Loan, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+	if branch == "" {
+		return nil, fmt.Errorf("branch required")
+	}
+
+	attrs := []string{branch}
+	if bucket != "" {
+		switch bucket {
+		case bucket1to29, bucket30to59, bucket60to89, bucket90Plus:
+		default:
+			return nil, fmt.Errorf("invalid bucket: %s", bucket)
+		}
+		attrs = append(attrs, bucket)
+	}
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(delinquencyIndex, attrs)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var list []*Loan
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, parts, err := ctx.GetStub().SplitCompositeKey(res.Key)
+		if err != nil || len(parts) != 3 {
+			continue
+		}
+		loan, err := getLoan(ctx, parts[2])
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, loan)
+	}
+	return list, nil
+}
+
+// Set the annual penalty interest rate on overdue loan amounts, in basis points
+func (s *SmartContract) SetLoanPenaltyRate(ctx contractapi.TransactionContextInterface, penaltyRate int64) error {
+
+	if err := requireRole(ctx, "SuperAdmin", "Admin"); err != nil {
+		return err
+	}
+	if penaltyRate < 0 {
+		return fmt.Errorf("penalty rate cannot be negative")
+	}
+
+	key, err := makeKey(ctx, loanConfigKey)
+	if err != nil {
+		return err
+	}
+	cn, _ := getCallerCN(ctx)
+	return putJSON(ctx, key, LoanConfig{PenaltyRate: penaltyRate, UpdatedBy: cn})
+}
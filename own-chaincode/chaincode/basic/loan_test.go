@@ -0,0 +1,101 @@
+package main
+
+import "testing"
+
+func TestMonthlyInterestRoundsHalfUp(t *testing.T) {
+	for _, tt := range []struct {
+		balance, rate, want int64
+	}{
+		{120000, 1200, 1200},
+		{110538, 1200, 1105}, // 1105.38
+		{50, 1200, 1},        // 0.5 rounds up
+		{49, 1200, 0},
+		{120000, 0, 0},
+	} {
+		if got := monthlyInterest(tt.balance, tt.rate); got != tt.want {
+			t.Errorf("monthlyInterest(%d, %d) = %d, want %d", tt.balance, tt.rate, got, tt.want)
+		}
+	}
+}
+
+func TestAmortise(t *testing.T) {
+	payment, lines, err := amortise(120000, 1200, 12, "2025-08-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment != 10662 {
+		t.Fatalf("instalment %d, want 10662", payment)
+	}
+	if len(lines) != 12 {
+		t.Fatalf("%d instalments, want 12", len(lines))
+	}
+	if first := lines[0]; first.DueDate != "2025-09-01" || first.Interest != 1200 || first.Principal != 9462 {
+		t.Fatalf("first instalment %+v", first)
+	}
+
+	var principal int64
+	for i, line := range lines[:11] {
+		if line.Payment != payment {
+			t.Fatalf("instalment %d pays %d, want %d", i+1, line.Payment, payment)
+		}
+		principal += line.Principal
+	}
+	// The last instalment repays whatever is left, absorbing the rounding
+	last := lines[11]
+	principal += last.Principal
+	if last.Balance != 0 || last.Principal != 10554 || last.Payment != 10660 {
+		t.Fatalf("last instalment %+v", last)
+	}
+	if principal != 120000 {
+		t.Fatalf("schedule repays %d of principal, want 120000", principal)
+	}
+}
+
+func TestAmortiseInterestFree(t *testing.T) {
+	payment, lines, err := amortise(1000, 0, 3, "2025-01-31")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment != 333 {
+		t.Fatalf("instalment %d, want 333", payment)
+	}
+	want := []int64{333, 333, 334}
+	for i, line := range lines {
+		if line.Payment != want[i] || line.Interest != 0 {
+			t.Fatalf("instalment %d is %+v, want a payment of %d", i+1, line, want[i])
+		}
+	}
+}
+
+func TestApplyForLoanRejectsOversizedTerms(t *testing.T) {
+	tests := []struct {
+		name      string
+		principal int64
+		rate      int64
+		term      int
+		wantErr   string
+	}{
+		{name: "term over the cap", principal: 1000, rate: 1200, term: maxLoanTermMonths + 1, wantErr: "cannot exceed"},
+		{name: "interest overflows", principal: 1 << 50, rate: 10000, term: 360, wantErr: "too large"},
+		{name: "longest term", principal: 1000, rate: 1200, term: maxLoanTermMonths},
+		{name: "large interest-free loan", principal: 1 << 50, rate: 0, term: 360},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLedger(t)
+			l.openAccount("A1", "alice", 0)
+			loan, err := l.cc.ApplyForLoan(l.staff(), "alice", "A1", tt.principal, tt.rate, tt.term)
+			if tt.wantErr != "" {
+				l.checkFails(err, tt.wantErr)
+				return
+			}
+			l.check(err)
+			sched, err := l.cc.GetLoanSchedule(l.staff(), loan.ID)
+			l.check(err)
+			if n := len(sched.Instalments); n != tt.term || sched.Instalments[n-1].Balance != 0 {
+				t.Fatalf("schedule of %d instalments does not repay the loan", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ======================== Structs ==========================
+
+const (
+	mandateObjectType   = "Mandate"
+	ddCollectionType    = "DirectDebitCollection"
+	mandateAccountIndex = "mandate~account~id"
+	collectionNarrative = "Direct debit "
+
+	mandateActive  = "ACTIVE"
+	mandateRevoked = "REVOKED"
+)
+
+// Mandate is a customer's consent for a creditor organisation to pull
+// payments from an account. At most one collection of up to MaxAmount is
+// allowed per Frequency period, up to and including ExpiryDate. CreditorMSP
+// is the bank holding CreditorAccount, whose staff collect under the mandate.
+type Mandate struct {
+	ID              string `json:"id"`
+	AccountID       string `json:"accountId"`
+	CreditorMSP     string `json:"creditorMsp"`
+	CreditorName    string `json:"creditorName"`
+	CreditorAccount string `json:"creditorAccount"`
+	MaxAmount       int64  `json:"maxAmount"`
+	Frequency       string `json:"frequency"`
+	ExpiryDate      string `json:"expiryDate"`
+	Status          string `json:"status"`
+	AuthorisedBy    string `json:"authorisedBy"`
+	AuthorisedAt    string `json:"authorisedAt"`
+	RevokedBy       string `json:"revokedBy,omitempty" metadata:",optional"`
+	RevokedAt       string `json:"revokedAt,omitempty" metadata:",optional"`
+}
+
+// DirectDebitCollection is a payment collected under a mandate. It is keyed
+// by mandate and period, which makes a second collection in the same period
+// fail.
+type DirectDebitCollection struct {
+	MandateID   string `json:"mandateId"`
+	Period      string `json:"period"`
+	Amount      int64  `json:"amount"`
+	Reference   string `json:"reference"`
+	CollectedBy string `json:"collectedBy"`
+	CollectedAt string `json:"collectedAt"`
+	HistoryHash string `json:"historyHash"`
+}
+
+// ======================== Mandate Helpers ========================
+
+func getMandate(ctx contractapi.TransactionContextInterface, id string) (*Mandate, error) {
+	if id == "" {
+		return nil, fmt.Errorf("mandate id required")
+	}
+	key, err := makeKey(ctx, mandateObjectType, id)
+	if err != nil {
+		return nil, err
+	}
+	var m Mandate
+	found, err := getJSON(ctx, key, &m)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("mandate %s not found", id)
+	}
+	return &m, nil
+}
+
+func putMandate(ctx contractapi.TransactionContextInterface, m *Mandate) error {
+	key, err := makeKey(ctx, mandateObjectType, m.ID)
+	if err != nil {
+		return err
+	}
+	return putJSON(ctx, key, m)
+}
+
+// periodOf labels the frequency period a date falls in, e.g. 2025-W32 or 2025-08
+func periodOf(date string, frequency string) (string, error) {
+	d, err := parseDate(date)
+	if err != nil {
+		return "", err
+	}
+	switch frequency {
+	case freqDaily:
+		return date, nil
+	case freqWeekly:
+		year, week := d.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week), nil
+	case freqMonthly:
+		return d.Format("2006-01"), nil
+	case freqQuarterly:
+		return fmt.Sprintf("%d-Q%d", d.Year(), (int(d.Month())+2)/3), nil
+	case freqYearly:
+		return d.Format("2006"), nil
+	}
+	return "", fmt.Errorf("invalid frequency %q", frequency)
+}
+
+// isCreditor reports whether the caller is staff of the creditor
+// organisation named in a mandate; customers of that organisation are not
+func isCreditor(ctx contractapi.TransactionContextInterface, m *Mandate) bool {
+	msp, err := getClientMSP(ctx)
+	return err == nil && msp == m.CreditorMSP && isStaff(ctx)
+}
+
+// ======================== Mandate Methods ========================
+
+// Authorise a creditor organisation to collect from one of the caller's
+// accounts. The organisation is the bank holding the creditor account.
+func (s *SmartContract) CreateMandate(
+	ctx contractapi.TransactionContextInterface,
+	accountID string, creditorName string, creditorAccount string,
+	maxAmount int64, frequency string, expiryDate string,
+) (*Mandate, error) {
+
+	if creditorName == "" {
+		return nil, fmt.Errorf("creditor name required")
+	}
+	if maxAmount <= 0 {
+		return nil, fmt.Errorf("maxAmount must be positive")
+	}
+	if _, err := periodOf(expiryDate, frequency); err != nil {
+		return nil, err
+	}
+	today, err := getBusinessDate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if expiryDate < today {
+		return nil, fmt.Errorf("expiryDate must not be before the business date %s", today)
+	}
+
+	a, err := getAccount(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	// Consent must come from the customer, not from staff on their behalf
+	cn, err := getCallerCN(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !isAccountOwner(a, cn) {
+		return nil, fmt.Errorf("access denied: only an owner of account %s can authorise a mandate", a.ID)
+	}
+	if n := requiredSigners(a); n > 1 {
+		return nil, fmt.Errorf("account %s needs %d signatures and cannot carry a mandate", a.ID, n)
+	}
+	creditor, err := getAccount(ctx, creditorAccount)
+	if err != nil {
+		return nil, err
+	}
+	if creditor.ID == a.ID {
+		return nil, fmt.Errorf("creditor account must differ from the debited account")
+	}
+	if creditor.BankMSP == "" {
+		return nil, fmt.Errorf("account %s is not held at a member bank", creditor.ID)
+	}
+
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m := &Mandate{
+		ID:              newID(ctx, "MDT"),
+		AccountID:       a.ID,
+		CreditorMSP:     creditor.BankMSP,
+		CreditorName:    creditorName,
+		CreditorAccount: creditor.ID,
+		MaxAmount:       maxAmount,
+		Frequency:       frequency,
+		ExpiryDate:      expiryDate,
+		Status:          mandateActive,
+		AuthorisedBy:    cn,
+		AuthorisedAt:    now.Format(time.RFC3339),
+	}
+	if err := putMandate(ctx, m); err != nil {
+		return nil, err
+	}
+	indexKey, err := makeKey(ctx, mandateAccountIndex, a.ID, m.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(indexKey, []byte{0x00}); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Revoke a mandate; later collections against it fail
+func (s *SmartContract) RevokeMandate(ctx contractapi.TransactionContextInterface, id string) (*Mandate, error) {
+
+	m, err := getMandate(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	a, err := getAccount(ctx, m.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountAccess(ctx, a); err != nil {
+		return nil, err
+	}
+	if m.Status != mandateActive {
+		return nil, fmt.Errorf("mandate %s is %s", m.ID, m.Status)
+	}
+
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.Status = mandateRevoked
+	m.RevokedBy, _ = getCallerCN(ctx)
+	m.RevokedAt = now.Format(time.RFC3339)
+	if err := putMandate(ctx, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Collect a payment under a mandate. Only staff of the creditor organisation
+// named in the mandate may collect, once per frequency period, up to the mandate's
+// maximum amount. A collection into an account at another bank is booked as an
+// accepted interbank transfer for the next settlement cycle.
+func (s *SmartContract) CollectDirectDebit(
+	ctx contractapi.TransactionContextInterface,
+	mandateID string, amount int64, reference string,
+) (*DirectDebitCollection, error) {
+
+	if amount <= 0 || reference == "" {
+		return nil, fmt.Errorf("positive amount and reference required")
+	}
+
+	m, err := getMandate(ctx, mandateID)
+	if err != nil {
+		return nil, err
+	}
+	if !isCreditor(ctx, m) {
+		return nil, fmt.Errorf("access denied: only %s staff can collect under mandate %s", m.CreditorMSP, m.ID)
+	}
+	if m.Status != mandateActive {
+		return nil, fmt.Errorf("mandate %s is %s", m.ID, m.Status)
+	}
+	today, err := getBusinessDate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if today > m.ExpiryDate {
+		return nil, fmt.Errorf("mandate %s expired on %s", m.ID, m.ExpiryDate)
+	}
+	if amount > m.MaxAmount {
+		return nil, fmt.Errorf("amount exceeds the mandate maximum of %d", m.MaxAmount)
+	}
+
+	period, err := periodOf(today, m.Frequency)
+	if err != nil {
+		return nil, err
+	}
+	key, err := makeKey(ctx, ddCollectionType, m.ID, period)
+	if err != nil {
+		return nil, err
+	}
+	var previous DirectDebitCollection
+	found, err := getJSON(ctx, key, &previous)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		return nil, fmt.Errorf("mandate %s was already collected for period %s (reference %s)", m.ID, period, previous.Reference)
+	}
+
+	debtor, err := getAccount(ctx, m.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	creditor, err := getAccount(ctx, m.CreditorAccount)
+	if err != nil {
+		return nil, err
+	}
+	if err := enforceLimits(ctx, &LimitedOperation{Operation: opTransfer, AccountID: debtor.ID, ToAccount: creditor.ID, Amount: amount}); err != nil {
+		return nil, err
+	}
+	narrative := collectionNarrative + m.CreditorName + " " + reference
+	record, err := postEntry(ctx, debtor, -amount, narrative, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := postToAccount(ctx, creditor, amount, collectionNarrative+m.ID+" "+reference); err != nil {
+		return nil, err
+	}
+	if debtor.BankMSP != creditor.BankMSP {
+		// The debtor's bank owes the creditor's bank until the next settlement cycle
+		if _, err := bookInterbankCredit(ctx, debtor, creditor, amount, "Direct debit "+m.ID+" "+reference); err != nil {
+			return nil, err
+		}
+	}
+
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c := &DirectDebitCollection{
+		MandateID:   m.ID,
+		Period:      period,
+		Amount:      amount,
+		Reference:   reference,
+		CollectedAt: now.Format(time.RFC3339),
+		HistoryHash: record.HistoryHash,
+	}
+	c.CollectedBy, _ = getCallerCN(ctx)
+	if err := putJSON(ctx, key, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Fetch mandate
+func (s *SmartContract) GetMandate(ctx contractapi.TransactionContextInterface, id string) (*Mandate, error) {
+	m, err := getMandate(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if isCreditor(ctx, m) {
+		return m, nil
+	}
+	a, err := getAccount(ctx, m.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountAccess(ctx, a); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// List the mandates given on an account
+func (s *SmartContract) ListMandates(ctx contractapi.TransactionContextInterface, accountID string) ([]*Mandate, error) {
+	a, err := getAccount(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountAccess(ctx, a); err != nil {
+		return nil, err
+	}
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(mandateAccountIndex, []string{a.ID})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var list []*Mandate
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, parts, err := ctx.GetStub().SplitCompositeKey(res.Key)
+		if err != nil || len(parts) != 2 {
+			continue
+		}
+		m, err := getMandate(ctx, parts[1])
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, m)
+	}
+	return list, nil
+}
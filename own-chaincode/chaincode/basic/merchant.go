@@ -0,0 +1,472 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ======================== Structs ==========================
+
+const (
+	merchantObjectType           = "Merchant"
+	paymentRequestObjectType     = "PaymentRequest"
+	merchantSettlementObjectType = "MerchantSettlement"
+	merchantUnsettledIndex       = "mpayunsettled~merchant~date~id"
+
+	merchantActive = "ACTIVE"
+
+	requestOpen = "OPEN"
+	requestPaid = "PAID"
+
+	// qrPayloadVersion prefixes payment request payloads
+	qrPayloadVersion = "BANKQR1"
+
+	// maxMDRBasisPoints caps the merchant discount rate at 10%
+	maxMDRBasisPoints = 1000
+)
+
+// Merchant is a retailer accepting QR payments. Payments collect in the
+// merchant payable GL account and are paid to SettlementAccount per business
+// date, less the merchant discount rate (MDR) in basis points.
+type Merchant struct {
+	ID                string `json:"id"`
+	Name              string `json:"name"`
+	SettlementAccount string `json:"settlementAccount"`
+	MDRBasisPoints    int    `json:"mdrBasisPoints"`
+	Status            string `json:"status"`
+	OnboardedBy       string `json:"onboardedBy"`
+	OnboardedAt       string `json:"onboardedAt"`
+}
+
+// PaymentRequest is an amount a merchant asks to be paid before ExpiresAt
+// (RFC3339). Payload is the text a wallet app encodes as the QR code.
+type PaymentRequest struct {
+	ID           string `json:"id"`
+	MerchantID   string `json:"merchantId"`
+	Amount       int64  `json:"amount"`
+	ExpiresAt    string `json:"expiresAt"`
+	Payload      string `json:"payload"`
+	Status       string `json:"status"`
+	CreatedBy    string `json:"createdBy"`
+	CreatedAt    string `json:"createdAt"`
+	PaidFrom     string `json:"paidFrom,omitempty" metadata:",optional"`
+	PaidBy       string `json:"paidBy,omitempty" metadata:",optional"`
+	PaidAt       string `json:"paidAt,omitempty" metadata:",optional"`
+	BusinessDate string `json:"businessDate,omitempty" metadata:",optional"`
+}
+
+// MerchantSettlement is the payout of a merchant's payments of one business
+// date: Gross collected, the MDR Fee kept and the Net credited
+type MerchantSettlement struct {
+	MerchantID        string   `json:"merchantId"`
+	BusinessDate      string   `json:"businessDate"`
+	SettlementAccount string   `json:"settlementAccount"`
+	Payments          int      `json:"payments"`
+	Gross             int64    `json:"gross"`
+	MDRBasisPoints    int      `json:"mdrBasisPoints"`
+	Fee               int64    `json:"fee"`
+	Net               int64    `json:"net"`
+	RequestIDs        []string `json:"requestIds"`
+	SettledBy         string   `json:"settledBy"`
+	SettledAt         string   `json:"settledAt"`
+}
+
+// ======================== Merchant Helpers ========================
+
+func getMerchant(ctx contractapi.TransactionContextInterface, id string) (*Merchant, bool, error) {
+	if id == "" {
+		return nil, false, fmt.Errorf("merchant id required")
+	}
+	key, err := makeKey(ctx, merchantObjectType, id)
+	if err != nil {
+		return nil, false, err
+	}
+	var m Merchant
+	found, err := getJSON(ctx, key, &m)
+	if err != nil {
+		return nil, false, err
+	}
+	return &m, found, nil
+}
+
+// requireMerchantAccess loads a merchant the caller may act for: staff, or an
+// owner of its settlement account
+func requireMerchantAccess(ctx contractapi.TransactionContextInterface, id string) (*Merchant, error) {
+	m, found, err := getMerchant(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("merchant %s not found", id)
+	}
+	a, err := getAccount(ctx, m.SettlementAccount)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountAccess(ctx, a); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func getPaymentRequest(ctx contractapi.TransactionContextInterface, id string) (*PaymentRequest, error) {
+	if id == "" {
+		return nil, fmt.Errorf("request id required")
+	}
+	key, err := makeKey(ctx, paymentRequestObjectType, id)
+	if err != nil {
+		return nil, err
+	}
+	var r PaymentRequest
+	found, err := getJSON(ctx, key, &r)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("payment request %s not found", id)
+	}
+	return &r, nil
+}
+
+func putPaymentRequest(ctx contractapi.TransactionContextInterface, r *PaymentRequest) error {
+	key, err := makeKey(ctx, paymentRequestObjectType, r.ID)
+	if err != nil {
+		return err
+	}
+	return putJSON(ctx, key, r)
+}
+
+// qrPayload renders a payment request as pipe-separated fields ending in a
+// short checksum, so a wallet can reject a damaged or altered scan before
+// calling PayRequest
+func qrPayload(r *PaymentRequest, merchantName string) string {
+	fields := []string{
+		qrPayloadVersion, r.ID, r.MerchantID, merchantName,
+		strconv.FormatInt(r.Amount, 10), r.ExpiresAt,
+	}
+	return strings.Join(append(fields, hashOf(fields...)[:8]), "|")
+}
+
+// ======================== Merchant Methods ========================
+
+// Onboard a merchant that is paid into settlementAccount less mdrBasisPoints
+func (s *SmartContract) OnboardMerchant(
+	ctx contractapi.TransactionContextInterface,
+	merchantID string, name string, settlementAccount string, mdrBasisPoints int,
+) (*Merchant, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, fmt.Errorf("merchant name required")
+	}
+	if strings.Contains(merchantID, "|") || strings.Contains(name, "|") {
+		return nil, fmt.Errorf("merchant id and name cannot contain '|'")
+	}
+	if mdrBasisPoints < 0 || mdrBasisPoints > maxMDRBasisPoints {
+		return nil, fmt.Errorf("mdrBasisPoints must be between 0 and %d", maxMDRBasisPoints)
+	}
+	if _, found, err := getMerchant(ctx, merchantID); err != nil {
+		return nil, err
+	} else if found {
+		return nil, fmt.Errorf("merchant %s already exists", merchantID)
+	}
+	a, err := getAccount(ctx, settlementAccount)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountBank(ctx, a); err != nil {
+		return nil, err
+	}
+	if a.Status != accountActive {
+		return nil, fmt.Errorf("account %s is %s", a.ID, a.Status)
+	}
+
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cn, _ := getCallerCN(ctx)
+	m := &Merchant{
+		ID:                merchantID,
+		Name:              name,
+		SettlementAccount: a.ID,
+		MDRBasisPoints:    mdrBasisPoints,
+		Status:            merchantActive,
+		OnboardedBy:       cn,
+		OnboardedAt:       now.Format(time.RFC3339),
+	}
+	key, err := makeKey(ctx, merchantObjectType, m.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := putJSON(ctx, key, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Fetch merchant
+func (s *SmartContract) GetMerchant(ctx contractapi.TransactionContextInterface, merchantID string) (*Merchant, error) {
+	return requireMerchantAccess(ctx, merchantID)
+}
+
+// Ask for a payment to a merchant until expiry (RFC3339). The returned
+// payload is what a wallet app encodes as a QR code.
+func (s *SmartContract) CreatePaymentRequest(
+	ctx contractapi.TransactionContextInterface,
+	merchant string, amount int64, expiry string,
+) (*PaymentRequest, error) {
+
+	if amount <= 0 {
+		return nil, fmt.Errorf("amount must be positive")
+	}
+	m, err := requireMerchantAccess(ctx, merchant)
+	if err != nil {
+		return nil, err
+	}
+	if m.Status != merchantActive {
+		return nil, fmt.Errorf("merchant %s is %s", m.ID, m.Status)
+	}
+	expiresAt, err := time.Parse(time.RFC3339, expiry)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expiry %q, expected RFC3339", expiry)
+	}
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !expiresAt.After(now) {
+		return nil, fmt.Errorf("expiry must be in the future")
+	}
+
+	cn, _ := getCallerCN(ctx)
+	r := &PaymentRequest{
+		ID:         newID(ctx, "PRQ"),
+		MerchantID: m.ID,
+		Amount:     amount,
+		ExpiresAt:  expiresAt.UTC().Format(time.RFC3339),
+		Status:     requestOpen,
+		CreatedBy:  cn,
+		CreatedAt:  now.Format(time.RFC3339),
+	}
+	r.Payload = qrPayload(r, m.Name)
+	if err := putPaymentRequest(ctx, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Fetch a payment request. Any caller may read one, as a wallet does to show
+// the merchant and amount before paying.
+func (s *SmartContract) GetPaymentRequest(ctx contractapi.TransactionContextInterface, requestID string) (*PaymentRequest, error) {
+	return getPaymentRequest(ctx, requestID)
+}
+
+// Pay an open payment request from an account. The merchant is credited
+// when its business date is settled by SettleMerchant. Merchants need not be
+// registered beneficiaries.
+func (s *SmartContract) PayRequest(ctx contractapi.TransactionContextInterface, requestID string, fromAccount string) (*PaymentRequest, error) {
+
+	r, err := getPaymentRequest(ctx, requestID)
+	if err != nil {
+		return nil, err
+	}
+	if r.Status != requestOpen {
+		return nil, fmt.Errorf("payment request %s is %s", r.ID, r.Status)
+	}
+	expiresAt, err := time.Parse(time.RFC3339, r.ExpiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("payment request %s has invalid expiry: %v", r.ID, err)
+	}
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !now.Before(expiresAt) {
+		return nil, fmt.Errorf("payment request %s expired at %s", r.ID, r.ExpiresAt)
+	}
+	m, found, err := getMerchant(ctx, r.MerchantID)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("merchant %s not found", r.MerchantID)
+	}
+	if m.Status != merchantActive {
+		return nil, fmt.Errorf("merchant %s is %s", m.ID, m.Status)
+	}
+
+	from, err := getAccount(ctx, fromAccount)
+	if err != nil {
+		return nil, err
+	}
+	if from.ID == m.SettlementAccount {
+		return nil, fmt.Errorf("cannot pay a merchant from its settlement account")
+	}
+	if err := requireDebitAuthority(ctx, from); err != nil {
+		return nil, err
+	}
+	if err := enforceLimits(ctx, &LimitedOperation{Operation: opTransfer, AccountID: from.ID, ToAccount: m.SettlementAccount, Amount: r.Amount}); err != nil {
+		return nil, err
+	}
+	date, err := getBusinessDate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	narrative := "QR payment " + r.ID + " to " + m.Name
+	if err := postToAccount(ctx, from, -r.Amount, narrative); err != nil {
+		return nil, err
+	}
+	if err := glCredit(ctx, glMerchantPayable, r.Amount, narrative); err != nil {
+		return nil, err
+	}
+
+	r.Status = requestPaid
+	r.PaidFrom = from.ID
+	r.PaidBy, _ = getCallerCN(ctx)
+	r.PaidAt = now.Format(time.RFC3339)
+	r.BusinessDate = date
+	if err := putPaymentRequest(ctx, r); err != nil {
+		return nil, err
+	}
+	unsettledKey, err := makeKey(ctx, merchantUnsettledIndex, m.ID, date, r.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(unsettledKey, []byte{0x00}); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Pay a merchant the requests it was paid on a past business date, less its
+// MDR, which is booked as fee income. A date is settled once.
+func (s *SmartContract) SettleMerchant(ctx contractapi.TransactionContextInterface, merchantID string, businessDate string) (*MerchantSettlement, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+	if _, err := parseDate(businessDate); err != nil {
+		return nil, err
+	}
+	m, found, err := getMerchant(ctx, merchantID)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("merchant %s not found", merchantID)
+	}
+	a, err := getAccount(ctx, m.SettlementAccount)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountBank(ctx, a); err != nil {
+		return nil, err
+	}
+	today, err := getBusinessDate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if businessDate >= today {
+		return nil, fmt.Errorf("business date %s is not over yet", businessDate)
+	}
+	key, err := makeKey(ctx, merchantSettlementObjectType, m.ID, businessDate)
+	if err != nil {
+		return nil, err
+	}
+	var existing MerchantSettlement
+	if found, err := getJSON(ctx, key, &existing); err != nil {
+		return nil, err
+	} else if found {
+		return nil, fmt.Errorf("merchant %s is already settled for %s", m.ID, businessDate)
+	}
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(merchantUnsettledIndex, []string{m.ID, businessDate})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	st := &MerchantSettlement{
+		MerchantID:        m.ID,
+		BusinessDate:      businessDate,
+		SettlementAccount: m.SettlementAccount,
+		MDRBasisPoints:    m.MDRBasisPoints,
+	}
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, parts, err := ctx.GetStub().SplitCompositeKey(res.Key)
+		if err != nil || len(parts) != 3 {
+			continue
+		}
+		r, err := getPaymentRequest(ctx, parts[2])
+		if err != nil {
+			return nil, err
+		}
+		st.Payments++
+		st.Gross += r.Amount
+		st.RequestIDs = append(st.RequestIDs, r.ID)
+		if err := ctx.GetStub().DelState(res.Key); err != nil {
+			return nil, err
+		}
+	}
+	if st.Payments == 0 {
+		return nil, fmt.Errorf("merchant %s has no payments to settle for %s", m.ID, businessDate)
+	}
+	st.Fee = basisPoints(st.Gross, m.MDRBasisPoints)
+	st.Net = st.Gross - st.Fee
+
+	narrative := "Merchant settlement " + m.ID + " " + businessDate
+	if err := glDebit(ctx, glMerchantPayable, st.Gross, narrative); err != nil {
+		return nil, err
+	}
+	if err := glCredit(ctx, glFeeIncome, st.Fee, "MDR "+m.ID+" "+businessDate); err != nil {
+		return nil, err
+	}
+	if st.Net > 0 {
+		if err := postToAccount(ctx, a, st.Net, narrative); err != nil {
+			return nil, err
+		}
+	}
+
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	st.SettledBy, _ = getCallerCN(ctx)
+	st.SettledAt = now.Format(time.RFC3339)
+	if err := putJSON(ctx, key, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Fetch the settlement of a merchant for a business date
+func (s *SmartContract) GetMerchantSettlement(ctx contractapi.TransactionContextInterface, merchantID string, businessDate string) (*MerchantSettlement, error) {
+	m, err := requireMerchantAccess(ctx, merchantID)
+	if err != nil {
+		return nil, err
+	}
+	key, err := makeKey(ctx, merchantSettlementObjectType, m.ID, businessDate)
+	if err != nil {
+		return nil, err
+	}
+	var st MerchantSettlement
+	found, err := getJSON(ctx, key, &st)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("merchant %s is not settled for %s", m.ID, businessDate)
+	}
+	return &st, nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+)
+
+// ======================== Mock Stub ==========================
+
+// mockStub is an in-memory world state for unit tests. As on a peer, reads
+// and range queries see committed state only: writes are buffered until the
+// transaction commits, and read-your-writes for GetState comes from the
+// chaincode's own cachingStub. Stub methods the chaincode does not use are
+// left to the embedded interface and panic if called.
+type mockStub struct {
+	shim.ChaincodeStubInterface
+	state  map[string][]byte
+	writes map[string][]byte
+	txID   string
+	txTime time.Time
+}
+
+func newMockStub() *mockStub {
+	return &mockStub{state: map[string][]byte{}, writes: map[string][]byte{}}
+}
+
+// commitTx applies the buffered writes; a nil value deletes the key
+func (s *mockStub) commitTx() {
+	for key, value := range s.writes {
+		if value == nil {
+			delete(s.state, key)
+		} else {
+			s.state[key] = value
+		}
+	}
+	s.writes = map[string][]byte{}
+}
+
+// rollbackTx drops the buffered writes of a failed transaction
+func (s *mockStub) rollbackTx() {
+	s.writes = map[string][]byte{}
+}
+
+func (s *mockStub) GetTxID() string { return s.txID }
+
+func (s *mockStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{Seconds: s.txTime.Unix(), Nanos: int32(s.txTime.Nanosecond())}, nil
+}
+
+func (s *mockStub) GetTransient() (map[string][]byte, error) { return map[string][]byte{}, nil }
+
+func (s *mockStub) SetEvent(name string, payload []byte) error { return nil }
+
+func (s *mockStub) SetStateValidationParameter(key string, ep []byte) error { return nil }
+
+func (s *mockStub) GetState(key string) ([]byte, error) { return s.state[key], nil }
+
+func (s *mockStub) PutState(key string, value []byte) error {
+	if key == "" {
+		return fmt.Errorf("empty key")
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	s.writes[key] = value
+	return nil
+}
+
+func (s *mockStub) DelState(key string) error {
+	s.writes[key] = nil
+	return nil
+}
+
+func (s *mockStub) CreateCompositeKey(objectType string, attributes []string) (string, error) {
+	key := "\x00" + objectType + "\x00"
+	for _, a := range attributes {
+		key += a + "\x00"
+	}
+	return key, nil
+}
+
+func (s *mockStub) SplitCompositeKey(key string) (string, []string, error) {
+	if !strings.HasPrefix(key, "\x00") || !strings.HasSuffix(key, "\x00") {
+		return "", nil, fmt.Errorf("%q is not a composite key", key)
+	}
+	parts := strings.Split(key[1:len(key)-1], "\x00")
+	return parts[0], parts[1:], nil
+}
+
+// GetStateByRange lists simple keys only, as the peer does
+func (s *mockStub) GetStateByRange(startKey string, endKey string) (shim.StateQueryIteratorInterface, error) {
+	return s.iterate(func(key string) bool {
+		return !strings.HasPrefix(key, "\x00") && key >= startKey && (endKey == "" || key < endKey)
+	}), nil
+}
+
+func (s *mockStub) GetStateByPartialCompositeKey(objectType string, keys []string) (shim.StateQueryIteratorInterface, error) {
+	prefix, err := s.CreateCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, err
+	}
+	return s.iterate(func(key string) bool { return strings.HasPrefix(key, prefix) }), nil
+}
+
+// iterate snapshots the matching keys in key order
+func (s *mockStub) iterate(match func(key string) bool) *mockIterator {
+	it := &mockIterator{}
+	for key, value := range s.state {
+		if match(key) {
+			it.kvs = append(it.kvs, &queryresult.KV{Key: key, Value: value})
+		}
+	}
+	sort.Slice(it.kvs, func(i, j int) bool { return it.kvs[i].Key < it.kvs[j].Key })
+	return it
+}
+
+type mockIterator struct {
+	kvs []*queryresult.KV
+}
+
+func (it *mockIterator) HasNext() bool { return len(it.kvs) > 0 }
+
+func (it *mockIterator) Next() (*queryresult.KV, error) {
+	if len(it.kvs) == 0 {
+		return nil, fmt.Errorf("iterator exhausted")
+	}
+	kv := it.kvs[0]
+	it.kvs = it.kvs[1:]
+	return kv, nil
+}
+
+func (it *mockIterator) Close() error { return nil }
+
+// mockIdentity is a client certificate with a CN, MSP and role attribute
+type mockIdentity struct {
+	cn, msp, role string
+}
+
+func (m mockIdentity) GetID() (string, error)    { return "x509::CN=" + m.cn + "::CN=ca", nil }
+func (m mockIdentity) GetMSPID() (string, error) { return m.msp, nil }
+
+func (m mockIdentity) GetAttributeValue(name string) (string, bool, error) {
+	if name == "role" && m.role != "" {
+		return m.role, true, nil
+	}
+	return "", false, nil
+}
+
+func (m mockIdentity) AssertAttributeValue(name, value string) error  { return nil }
+func (m mockIdentity) GetX509Certificate() (*x509.Certificate, error) { return nil, nil }
+
+// ======================== Test Ledger ==========================
+
+// testLedger runs chaincode calls one transaction at a time against a mock
+// stub. Each call gets a new transaction whose GL journal is posted and whose
+// writes are committed before the next one starts, as on a peer.
+type testLedger struct {
+	t    *testing.T
+	stub *mockStub
+	cc   *SmartContract
+	msp  string
+	n    int
+	last *TransactionContext
+}
+
+func newTestLedger(t *testing.T) *testLedger {
+	stub := newMockStub()
+	stub.txTime = time.Date(2025, 8, 1, 10, 0, 0, 0, time.UTC)
+	return &testLedger{t: t, stub: stub, cc: new(SmartContract), msp: "Org1MSP"}
+}
+
+// as starts a transaction for a caller
+func (l *testLedger) as(cn string, role string) *TransactionContext {
+	l.t.Helper()
+	l.commit()
+	l.n++
+	l.stub.txID = fmt.Sprintf("tx%06d", l.n)
+	ctx := new(TransactionContext)
+	ctx.SetStub(l.stub)
+	ctx.SetClientIdentity(mockIdentity{cn: cn, msp: l.msp, role: role})
+	l.last = ctx
+	return ctx
+}
+
+func (l *testLedger) staff() *TransactionContext { return l.as("manager", "Manager") }
+
+// commit posts the journal of the last transaction and commits its writes
+func (l *testLedger) commit() {
+	l.t.Helper()
+	if l.last == nil {
+		return
+	}
+	if err := postJournal(l.last); err != nil {
+		l.t.Fatalf("posting journal: %v", err)
+	}
+	l.stub.commitTx()
+	l.last = nil
+}
+
+// discard drops the journal and writes of a failed transaction, which the
+// peer would never commit
+func (l *testLedger) discard() {
+	l.stub.rollbackTx()
+	l.last = nil
+}
+
+// advance moves the clock on by days
+func (l *testLedger) advance(days int) {
+	l.stub.txTime = l.stub.txTime.AddDate(0, 0, days)
+}
+
+func (l *testLedger) check(err error) {
+	l.t.Helper()
+	if err != nil {
+		l.t.Fatal(err)
+	}
+}
+
+// checkFails expects err to mention want
+func (l *testLedger) checkFails(err error, want string) {
+	l.t.Helper()
+	l.discard()
+	if err == nil {
+		l.t.Fatalf("expected an error containing %q", want)
+	}
+	if !strings.Contains(err.Error(), want) {
+		l.t.Fatalf("expected an error containing %q, got %v", want, err)
+	}
+}
+
+// openAccount opens an account for a new user and deposits balance into it
+func (l *testLedger) openAccount(id string, owner string, balance int64) {
+	l.t.Helper()
+	l.check(l.cc.CreateUser(l.as("admin", "SuperAdmin"), owner, owner, "User", owner+"@example.com", "0", "Colombo", "2025-01-01"))
+	_, err := l.cc.OpenAccount(l.staff(), id, owner, "SAVINGS")
+	l.check(err)
+	if balance > 0 {
+		_, err = l.cc.Deposit(l.staff(), id, balance)
+		l.check(err)
+	}
+}
+
+// addBeneficiary lets a user pay an account at once, without cooling off
+func (l *testLedger) addBeneficiary(userID string, accountID string) {
+	l.t.Helper()
+	l.check(l.cc.SetBeneficiaryCoolingOff(l.as("admin", "Admin"), 0, 0))
+	_, err := l.cc.AddBeneficiary(l.as(userID, "User"), userID, accountID, accountID)
+	l.check(err)
+}
+
+// setFlatFee charges a flat fee for a transaction type on any product and
+// channel from the current business date
+func (l *testLedger) setFlatFee(txType string, fee int64) {
+	l.t.Helper()
+	today, err := getBusinessDate(l.staff())
+	l.check(err)
+	_, err = l.cc.SetTariff(l.as("admin", "SuperAdmin"), Tariff{
+		TxType: txType, Product: tariffAny, Channel: tariffAny, EffectiveFrom: today, Method: feeFlat, FlatFee: fee,
+	})
+	l.check(err)
+}
+
+func (l *testLedger) account(id string) *Account {
+	l.t.Helper()
+	a, err := getAccount(l.staff(), id)
+	l.check(err)
+	return a
+}
+
+// balances reports an account's book and available balances
+func (l *testLedger) balances(id string) (int64, int64) {
+	l.t.Helper()
+	a := l.account(id)
+	available, err := availableBalance(l.last, a)
+	l.check(err)
+	return a.Balance, available
+}
+
+func (l *testLedger) expectBalances(id string, balance int64, available int64) {
+	l.t.Helper()
+	gotBalance, gotAvailable := l.balances(id)
+	if gotBalance != balance || gotAvailable != available {
+		l.t.Fatalf("account %s: balance %d available %d, want %d and %d", id, gotBalance, gotAvailable, balance, available)
+	}
+}
+
+// glBalance is the posted debit balance of a GL account
+func (l *testLedger) glBalance(code string) int64 {
+	l.t.Helper()
+	l.commit()
+	var total int64
+	iter, err := l.stub.GetStateByPartialCompositeKey(glEntryObjectType, []string{code})
+	l.check(err)
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		l.check(err)
+		var e GLEntry
+		l.check(json.Unmarshal(kv.Value, &e))
+		total += e.Debit - e.Credit
+	}
+	return total
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ======================== Structs ==========================
+
+const (
+	paymentBatchObjectType = "PaymentBatch"
+	paymentLineObjectType  = "PaymentBatchLine"
+
+	maxPaymentBatchLines = 2000
+	paymentBatchChunk    = 200
+
+	batchSubmitted  = "SUBMITTED"
+	batchProcessing = "PROCESSING"
+	batchCompleted  = "COMPLETED"
+	batchCancelled  = "CANCELLED"
+
+	lineReady  = "PENDING"
+	linePaid   = "PAID"
+	lineFailed = "FAILED"
+)
+
+// PaymentLine is one payment of a batch as submitted
+type PaymentLine struct {
+	ToAccount string `json:"toAccount"`
+	Amount    int64  `json:"amount"`
+	Reference string `json:"reference"`
+}
+
+// PaymentBatchLine is a submitted line and its result. Fee is the transfer
+// fee quoted at submission, charged only if the line is paid.
+type PaymentBatchLine struct {
+	BatchID     string `json:"batchId"`
+	Line        int    `json:"line"`
+	ToAccount   string `json:"toAccount"`
+	Amount      int64  `json:"amount"`
+	Fee         int64  `json:"fee,omitempty" metadata:",optional"`
+	Reference   string `json:"reference"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty" metadata:",optional"`
+	HistoryHash string `json:"historyHash,omitempty" metadata:",optional"`
+}
+
+// PaymentBatch is a bulk payment such as a payroll run. The batch total and
+// the Fees of its lines are reserved on the debit account by a hold when it
+// is submitted. Each chunk processed debits what it paid, with the fees of
+// the paid lines, and reduces the hold by the lines it settled, paid or
+// failed, so failed lines are released as they occur.
+type PaymentBatch struct {
+	ID           string `json:"id"`
+	DebitAccount string `json:"debitAccount"`
+	LineCount    int    `json:"lineCount"`
+	Total        int64  `json:"total"`
+	Fees         int64  `json:"fees,omitempty" metadata:",optional"`
+	HoldID       string `json:"holdId"`
+	Status       string `json:"status"`
+	Paid         int    `json:"paid"`
+	PaidAmount   int64  `json:"paidAmount"`
+	Failed       int    `json:"failed"`
+	FailedAmount int64  `json:"failedAmount"`
+	SubmittedBy  string `json:"submittedBy"`
+	SubmittedAt  string `json:"submittedAt"`
+	CompletedAt  string `json:"completedAt,omitempty" metadata:",optional"`
+}
+
+// ======================== Payment Batch Helpers ========================
+
+func getPaymentBatch(ctx contractapi.TransactionContextInterface, id string) (*PaymentBatch, bool, error) {
+	if id == "" {
+		return nil, false, fmt.Errorf("batch id required")
+	}
+	key, err := makeKey(ctx, paymentBatchObjectType, id)
+	if err != nil {
+		return nil, false, err
+	}
+	var b PaymentBatch
+	found, err := getJSON(ctx, key, &b)
+	if err != nil {
+		return nil, false, err
+	}
+	return &b, found, nil
+}
+
+func putPaymentBatch(ctx contractapi.TransactionContextInterface, b *PaymentBatch) error {
+	key, err := makeKey(ctx, paymentBatchObjectType, b.ID)
+	if err != nil {
+		return err
+	}
+	return putJSON(ctx, key, b)
+}
+
+func paymentLineKey(ctx contractapi.TransactionContextInterface, batchID string, line int) (string, error) {
+	return makeKey(ctx, paymentLineObjectType, batchID, fmt.Sprintf("%06d", line))
+}
+
+// requireBatchAccess loads a batch the caller may operate: staff, or an
+// owner of its debit account
+func requireBatchAccess(ctx contractapi.TransactionContextInterface, id string) (*PaymentBatch, *Account, error) {
+	b, found, err := getPaymentBatch(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !found {
+		return nil, nil, fmt.Errorf("payment batch %s not found", id)
+	}
+	a, err := getAccount(ctx, b.DebitAccount)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := requireAccountAccess(ctx, a); err != nil {
+		return nil, nil, err
+	}
+	return b, a, nil
+}
+
+// validatePaymentLine checks one line against the debit account
+func validatePaymentLine(ctx contractapi.TransactionContextInterface, debit *Account, l *PaymentLine) error {
+	if l.Amount <= 0 {
+		return fmt.Errorf("amount must be positive")
+	}
+	if l.ToAccount == debit.ID {
+		return fmt.Errorf("cannot pay the debit account")
+	}
+	to, err := getAccount(ctx, l.ToAccount)
+	if err != nil {
+		return err
+	}
+	if to.Status != accountActive {
+		return fmt.Errorf("account %s is %s", to.ID, to.Status)
+	}
+	if err := requireSameBank(debit, to); err != nil {
+		return err
+	}
+	return checkBeneficiary(ctx, debit, to, l.Amount)
+}
+
+// reduceHold takes settled lines off a batch's hold and closes the hold
+// once nothing is left reserved: as captured if any line was paid,
+// otherwise as released
+func reduceHold(ctx contractapi.TransactionContextInterface, a *Account, h *Hold, settled int64, paid int64) error {
+	h.Amount -= settled
+	h.Captured += paid
+	a.HeldAmount -= settled
+	if h.Amount == 0 {
+		if h.Captured == 0 {
+			return closeHold(ctx, a, h, holdReleased)
+		}
+		return closeHold(ctx, a, h, holdCaptured)
+	}
+	return putHold(ctx, h)
+}
+
+// ======================== Payment Batch Methods ========================
+
+// Validate a batch of payments from one account and reserve its total.
+// The payments are made by ProcessPaymentBatch.
+func (s *SmartContract) SubmitPaymentBatch(
+	ctx contractapi.TransactionContextInterface,
+	batchID string, debitAccount string, lines []PaymentLine,
+) (*PaymentBatch, error) {
+
+	if len(lines) == 0 || len(lines) > maxPaymentBatchLines {
+		return nil, fmt.Errorf("a batch must have between 1 and %d lines", maxPaymentBatchLines)
+	}
+	if _, found, err := getPaymentBatch(ctx, batchID); err != nil {
+		return nil, err
+	} else if found {
+		return nil, fmt.Errorf("payment batch %s already exists", batchID)
+	}
+
+	debit, err := getAccount(ctx, debitAccount)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireDebitAuthority(ctx, debit); err != nil {
+		return nil, err
+	}
+
+	// Every line pays the transfer fee of the channel the batch came through
+	channel := feeChannel(ctx)
+	fees := make([]int64, len(lines))
+	var total, totalFees int64
+	var problems []string
+	for i := range lines {
+		if err := validatePaymentLine(ctx, debit, &lines[i]); err != nil {
+			problems = append(problems, fmt.Sprintf("line %d: %v", i+1, err))
+			continue
+		}
+		fee, _, err := feeFor(ctx, opTransfer, debit, channel, lines[i].Amount)
+		if err != nil {
+			return nil, err
+		}
+		fees[i] = fee
+		total += lines[i].Amount
+		totalFees += fee
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid payment batch: %s", strings.Join(problems, "; "))
+	}
+
+	// The batch counts against the debit account's transfer limits as a whole
+	if err := enforceLimits(ctx, &LimitedOperation{Operation: opTransfer, AccountID: debit.ID, ToAccount: "", Amount: total}); err != nil {
+		return nil, err
+	}
+	h, err := placeHold(ctx, debit, total+totalFees, "Payment batch "+batchID, batchID, "")
+	if err != nil {
+		return nil, err
+	}
+	for i, l := range lines {
+		key, err := paymentLineKey(ctx, batchID, i+1)
+		if err != nil {
+			return nil, err
+		}
+		line := PaymentBatchLine{
+			BatchID:   batchID,
+			Line:      i + 1,
+			ToAccount: l.ToAccount,
+			Amount:    l.Amount,
+			Fee:       fees[i],
+			Reference: l.Reference,
+			Status:    lineReady,
+		}
+		if err := putJSON(ctx, key, line); err != nil {
+			return nil, err
+		}
+	}
+
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cn, _ := getCallerCN(ctx)
+	b := &PaymentBatch{
+		ID:           batchID,
+		DebitAccount: debit.ID,
+		LineCount:    len(lines),
+		Total:        total,
+		Fees:         totalFees,
+		HoldID:       h.ID,
+		Status:       batchSubmitted,
+		SubmittedBy:  cn,
+		SubmittedAt:  now.Format(time.RFC3339),
+	}
+	if err := putPaymentBatch(ctx, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Pay the next chunk of a batch's lines in line order, resuming after
+// bookmark. Lines whose account can no longer be credited fail without
+// stopping the batch. Call again with the returned bookmark until it is empty.
+func (s *SmartContract) ProcessPaymentBatch(ctx contractapi.TransactionContextInterface, batchID string, bookmark string) (*BatchResult, error) {
+
+	b, debit, err := requireBatchAccess(ctx, batchID)
+	if err != nil {
+		return nil, err
+	}
+	if b.Status == batchCompleted || b.Status == batchCancelled {
+		return nil, fmt.Errorf("payment batch %s is %s", b.ID, b.Status)
+	}
+	h, err := getHold(ctx, b.HoldID)
+	if err != nil {
+		return nil, err
+	}
+	if h.Status != holdActive {
+		return nil, fmt.Errorf("hold %s of payment batch %s is %s", h.ID, b.ID, h.Status)
+	}
+
+	result := &BatchResult{}
+	var paid, fees, settled int64
+	type credit struct {
+		line *PaymentBatchLine
+		key  string
+	}
+	var credits []credit
+	next, err := scanIndex(ctx, paymentLineObjectType, []string{b.ID}, bookmark, paymentBatchChunk,
+		func(key string, _ []string, value []byte) (bool, error) {
+			var line PaymentBatchLine
+			if err := json.Unmarshal(value, &line); err != nil {
+				return false, fmt.Errorf("corrupt payment line at %s: %v", key, err)
+			}
+			if line.Status != lineReady {
+				return true, nil
+			}
+			settled += line.Amount + line.Fee
+			to, err := getAccount(ctx, line.ToAccount)
+			if err == nil && to.Status != accountActive {
+				err = fmt.Errorf("account %s is %s", to.ID, to.Status)
+			}
+			if err == nil {
+				err = requireSameBank(debit, to)
+			}
+			if err != nil {
+				line.Status = lineFailed
+				line.Error = err.Error()
+				b.Failed++
+				b.FailedAmount += line.Amount
+				result.Failed++
+				result.Errors = append(result.Errors, fmt.Sprintf("line %d: %v", line.Line, err))
+				return true, putJSON(ctx, key, line)
+			}
+			paid += line.Amount
+			fees += line.Fee
+			credits = append(credits, credit{line: &line, key: key})
+			return true, nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	// Free the reservation first so that the debit can use it
+	if err := reduceHold(ctx, debit, h, settled, paid+fees); err != nil {
+		return nil, err
+	}
+	if paid > 0 {
+		if err := postToAccount(ctx, debit, -paid, "Payment batch "+b.ID); err != nil {
+			return nil, err
+		}
+		if err := postFee(ctx, debit, opTransfer, fees); err != nil {
+			return nil, err
+		}
+	} else if err := putAccount(ctx, debit); err != nil {
+		return nil, err
+	}
+	for _, c := range credits {
+		// Reload per line: several lines may pay the same account
+		to, err := getAccount(ctx, c.line.ToAccount)
+		if err != nil {
+			return nil, err
+		}
+		record, err := postEntry(ctx, to, c.line.Amount, "Payment batch "+b.ID+" "+c.line.Reference, "")
+		if err != nil {
+			return nil, err
+		}
+		c.line.Status = linePaid
+		c.line.HistoryHash = record.HistoryHash
+		if err := putJSON(ctx, c.key, c.line); err != nil {
+			return nil, err
+		}
+		b.Paid++
+		b.PaidAmount += c.line.Amount
+		result.Processed++
+	}
+
+	b.Status = batchProcessing
+	if b.Paid+b.Failed == b.LineCount {
+		now, err := getTxTime(ctx)
+		if err != nil {
+			return nil, err
+		}
+		b.Status = batchCompleted
+		b.CompletedAt = now.Format(time.RFC3339)
+	}
+	if err := putPaymentBatch(ctx, b); err != nil {
+		return nil, err
+	}
+	result.Bookmark = next
+	return result, nil
+}
+
+// Cancel a batch that has not completed. Its pending lines fail and what
+// they reserved is released; lines already paid stand.
+func (s *SmartContract) CancelPaymentBatch(ctx contractapi.TransactionContextInterface, batchID string) (*PaymentBatch, error) {
+
+	b, debit, err := requireBatchAccess(ctx, batchID)
+	if err != nil {
+		return nil, err
+	}
+	if b.Status == batchCompleted || b.Status == batchCancelled {
+		return nil, fmt.Errorf("payment batch %s is %s", b.ID, b.Status)
+	}
+	h, err := getHold(ctx, b.HoldID)
+	if err != nil {
+		return nil, err
+	}
+	if h.Status != holdActive {
+		return nil, fmt.Errorf("hold %s of payment batch %s is %s", h.ID, b.ID, h.Status)
+	}
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(paymentLineObjectType, []string{b.ID})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var released int64
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		var line PaymentBatchLine
+		if err := json.Unmarshal(res.Value, &line); err != nil {
+			return nil, fmt.Errorf("corrupt payment line at %s: %v", res.Key, err)
+		}
+		if line.Status != lineReady {
+			continue
+		}
+		line.Status = lineFailed
+		line.Error = "batch cancelled"
+		if err := putJSON(ctx, res.Key, &line); err != nil {
+			return nil, err
+		}
+		released += line.Amount + line.Fee
+		b.Failed++
+		b.FailedAmount += line.Amount
+	}
+
+	if err := reduceHold(ctx, debit, h, released, 0); err != nil {
+		return nil, err
+	}
+	if err := putAccount(ctx, debit); err != nil {
+		return nil, err
+	}
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	b.Status = batchCancelled
+	b.CompletedAt = now.Format(time.RFC3339)
+	if err := putPaymentBatch(ctx, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Fetch payment batch status
+func (s *SmartContract) GetPaymentBatch(ctx contractapi.TransactionContextInterface, batchID string) (*PaymentBatch, error) {
+	b, _, err := requireBatchAccess(ctx, batchID)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Report the lines of a batch, optionally only those with a given status
+func (s *SmartContract) GetPaymentBatchLines(ctx contractapi.TransactionContextInterface, batchID string, status string) ([]*PaymentBatchLine, error) {
+	b, _, err := requireBatchAccess(ctx, batchID)
+	if err != nil {
+		return nil, err
+	}
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(paymentLineObjectType, []string{b.ID})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var list []*PaymentBatchLine
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		var line PaymentBatchLine
+		if err := json.Unmarshal(res.Value, &line); err != nil {
+			return nil, fmt.Errorf("corrupt payment line at %s: %v", res.Key, err)
+		}
+		if status == "" || line.Status == status {
+			list = append(list, &line)
+		}
+	}
+	return list, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// payroll is n lines of 100, every third one to C1 and the rest to B1
+func payroll(n int) []PaymentLine {
+	lines := make([]PaymentLine, n)
+	for i := range lines {
+		to := "B1"
+		if (i+1)%3 == 0 {
+			to = "C1"
+		}
+		lines[i] = PaymentLine{ToAccount: to, Amount: 100, Reference: fmt.Sprintf("salary %d", i+1)}
+	}
+	return lines
+}
+
+func batchLedger(t *testing.T, balance int64) *testLedger {
+	l := newTestLedger(t)
+	l.openAccount("A1", "alice", balance)
+	l.openAccount("B1", "bob", 0)
+	l.openAccount("C1", "carol", 0)
+	l.addBeneficiary("alice", "B1")
+	l.addBeneficiary("alice", "C1")
+	return l
+}
+
+func TestSubmitPaymentBatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		balance   int64
+		fee       int64
+		lines     []PaymentLine
+		wantErr   string
+		available int64
+	}{
+		{name: "total is reserved", balance: 10000, lines: payroll(30), available: 7000},
+		{name: "fees are reserved with the total", balance: 10000, fee: 10, lines: payroll(30), available: 6700},
+		{name: "fees must be covered", balance: 3000, fee: 10, lines: payroll(30), wantErr: "insufficient available balance",
+			available: 3000},
+		{name: "line to the debit account", balance: 10000, lines: []PaymentLine{{ToAccount: "A1", Amount: 100}},
+			wantErr: "line 1: cannot pay the debit account", available: 10000},
+		{name: "line without an amount", balance: 10000, lines: []PaymentLine{{ToAccount: "B1"}},
+			wantErr: "line 1: amount must be positive", available: 10000},
+		{name: "no lines", balance: 10000, wantErr: "between 1 and", available: 10000},
+		{name: "too many lines", balance: 10000, lines: payroll(maxPaymentBatchLines + 1), wantErr: "between 1 and",
+			available: 10000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := batchLedger(t, tt.balance)
+			if tt.fee > 0 {
+				l.setFlatFee(opTransfer, tt.fee)
+			}
+			_, err := l.cc.SubmitPaymentBatch(l.as("alice", "User"), "PAYROLL", "A1", tt.lines)
+			if tt.wantErr != "" {
+				l.checkFails(err, tt.wantErr)
+			} else {
+				l.check(err)
+			}
+			l.expectBalances("A1", tt.balance, tt.available)
+		})
+	}
+}
+
+func TestProcessPaymentBatchInChunks(t *testing.T) {
+	const lineCount = 2*paymentBatchChunk + 50
+	l := batchLedger(t, 100000)
+	l.setFlatFee(opTransfer, 10)
+	lines := payroll(lineCount)
+	b, err := l.cc.SubmitPaymentBatch(l.as("alice", "User"), "PAYROLL", "A1", lines)
+	l.check(err)
+	if b.Total != 100*lineCount || b.Fees != 10*lineCount {
+		t.Fatalf("batch total %d and fees %d", b.Total, b.Fees)
+	}
+	// Lines to C1 fail once it is frozen, releasing their amount and fee
+	c := l.account("C1")
+	c.Status = "FROZEN"
+	l.check(putAccount(l.last, c))
+
+	var balance, reserved int64 = 100000, 110 * lineCount
+	bookmark := ""
+	for chunk := 0; ; chunk++ {
+		r, err := l.cc.ProcessPaymentBatch(l.as("alice", "User"), "PAYROLL", bookmark)
+		l.check(err)
+
+		first := chunk * paymentBatchChunk
+		last := first + paymentBatchChunk
+		if last > lineCount {
+			last = lineCount
+		}
+		wantFailed := 0
+		for i := first; i < last; i++ {
+			reserved -= 110
+			if lines[i].ToAccount == "C1" {
+				wantFailed++
+			} else {
+				balance -= 110
+			}
+		}
+		if r.Processed != last-first-wantFailed || r.Failed != wantFailed {
+			t.Fatalf("chunk %d paid %d and failed %d, want %d and %d", chunk, r.Processed, r.Failed, last-first-wantFailed, wantFailed)
+		}
+		l.expectBalances("A1", balance, balance-reserved)
+
+		if r.Bookmark == "" {
+			if last != lineCount {
+				t.Fatalf("batch stopped after line %d", last)
+			}
+			break
+		}
+		bookmark = r.Bookmark
+	}
+
+	b, err = l.cc.GetPaymentBatch(l.as("alice", "User"), "PAYROLL")
+	l.check(err)
+	if b.Status != batchCompleted || b.Paid != 300 || b.Failed != 150 || b.PaidAmount != 30000 || b.FailedAmount != 15000 {
+		t.Fatalf("batch %s paid %d (%d) and failed %d (%d)", b.Status, b.Paid, b.PaidAmount, b.Failed, b.FailedAmount)
+	}
+	h, err := getHold(l.staff(), b.HoldID)
+	l.check(err)
+	if h.Status != holdCaptured || h.Amount != 0 || h.Captured != 33000 {
+		t.Fatalf("hold %s with %d left and %d captured", h.Status, h.Amount, h.Captured)
+	}
+	l.expectBalances("A1", 67000, 67000)
+	l.expectBalances("B1", 30000, 30000)
+	if got := l.glBalance(glFeeIncome); got != -3000 {
+		t.Fatalf("fee income %d, want 3000", -got)
+	}
+
+	_, err = l.cc.ProcessPaymentBatch(l.as("alice", "User"), "PAYROLL", "")
+	l.checkFails(err, "is "+batchCompleted)
+}
+
+func TestCancelPaymentBatch(t *testing.T) {
+	l := batchLedger(t, 100000)
+	l.setFlatFee(opTransfer, 10)
+	_, err := l.cc.SubmitPaymentBatch(l.as("alice", "User"), "PAYROLL", "A1", payroll(paymentBatchChunk+30))
+	l.check(err)
+	_, err = l.cc.ProcessPaymentBatch(l.as("alice", "User"), "PAYROLL", "")
+	l.check(err)
+
+	_, err = l.cc.CancelPaymentBatch(l.as("bob", "User"), "PAYROLL")
+	l.checkFails(err, "access denied")
+	b, err := l.cc.CancelPaymentBatch(l.as("alice", "User"), "PAYROLL")
+	l.check(err)
+	if b.Status != batchCancelled || b.Paid != paymentBatchChunk || b.Failed != 30 || b.FailedAmount != 3000 {
+		t.Fatalf("batch %s paid %d and failed %d (%d)", b.Status, b.Paid, b.Failed, b.FailedAmount)
+	}
+	// Only the first chunk was paid, with its fees; nothing stays reserved
+	l.expectBalances("A1", 100000-110*paymentBatchChunk, 100000-110*paymentBatchChunk)
+	h, err := getHold(l.staff(), b.HoldID)
+	l.check(err)
+	if h.Status != holdCaptured || h.Amount != 0 || h.Captured != 110*paymentBatchChunk {
+		t.Fatalf("hold %s with %d left and %d captured", h.Status, h.Amount, h.Captured)
+	}
+	failed, err := l.cc.GetPaymentBatchLines(l.as("alice", "User"), "PAYROLL", lineFailed)
+	l.check(err)
+	if len(failed) != 30 || failed[0].Error != "batch cancelled" {
+		t.Fatalf("%d failed lines", len(failed))
+	}
+
+	_, err = l.cc.ProcessPaymentBatch(l.as("alice", "User"), "PAYROLL", "")
+	l.checkFails(err, "is "+batchCancelled)
+	_, err = l.cc.CancelPaymentBatch(l.as("alice", "User"), "PAYROLL")
+	l.checkFails(err, "is "+batchCancelled)
+}
+
+func TestCancelUnprocessedBatchReleasesHold(t *testing.T) {
+	l := batchLedger(t, 10000)
+	b, err := l.cc.SubmitPaymentBatch(l.as("alice", "User"), "PAYROLL", "A1", payroll(10))
+	l.check(err)
+	l.expectBalances("A1", 10000, 9000)
+	_, err = l.cc.CancelPaymentBatch(l.staff(), "PAYROLL")
+	l.check(err)
+	l.expectBalances("A1", 10000, 10000)
+	h, err := getHold(l.staff(), b.HoldID)
+	l.check(err)
+	if h.Status != holdReleased {
+		t.Fatalf("hold is %s, want %s", h.Status, holdReleased)
+	}
+}
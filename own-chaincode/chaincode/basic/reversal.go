@@ -0,0 +1,470 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ======================== Structs ==========================
+
+const (
+	reversalObjectType = "Reversal"
+	reversalConfigKey  = "ReversalConfig"
+
+	reversalPending   = "PENDING_APPROVAL"
+	reversalCompleted = "COMPLETED"
+	reversalRejected  = "REJECTED"
+
+	defaultReversalThreshold = 5000000
+)
+
+// Reversal links posted history records to the entries that offset them. The
+// original records are never modified; this record is what marks them as
+// reversed. ID is the operation ID for chaincode postings, so every leg of
+// e.g. a transfer and its fee is reversed together, or the history hash of a
+// manually created record.
+type Reversal struct {
+	ID              string   `json:"id"`
+	OriginalEntries []string `json:"originalEntries"`
+	ReversalEntries []string `json:"reversalEntries,omitempty" metadata:",optional"`
+	Amount          int64    `json:"amount"`
+	Reason          string   `json:"reason"`
+	Status          string   `json:"status"`
+	RequestedBy     string   `json:"requestedBy"`
+	RequestedAt     string   `json:"requestedAt"`
+	ApprovedBy      string   `json:"approvedBy,omitempty" metadata:",optional"`
+	ApprovedAt      string   `json:"approvedAt,omitempty" metadata:",optional"`
+	RejectedBy      string   `json:"rejectedBy,omitempty" metadata:",optional"`
+}
+
+// ReversalConfig holds the amount above which a reversal needs Manager approval
+type ReversalConfig struct {
+	ApprovalThreshold int64  `json:"approvalThreshold"`
+	UpdatedBy         string `json:"updatedBy"`
+}
+
+// ======================== Reversal Helpers ========================
+
+func getHistory(ctx contractapi.TransactionContextInterface, id string) (*TransactionHistory, error) {
+	if id == "" {
+		return nil, fmt.Errorf("history id required")
+	}
+	var h TransactionHistory
+	found, err := getJSON(ctx, id, &h)
+	if err != nil {
+		return nil, err
+	}
+	if !found || h.HistoryHash != id {
+		return nil, fmt.Errorf("transaction history %s not found", id)
+	}
+	return &h, nil
+}
+
+// reversibleOperation runs fn as one reversible operation: every history
+// record and GL line it posts is tagged with an operation ID unique to this
+// call, and ReverseTransaction offsets exactly those. Postings made outside an
+// operation belong to a subsystem (fixed deposits, loans, escrow, HTLCs,
+// payment batches, end of day, ...) that keeps its own state and is undone
+// through that subsystem instead.
+func reversibleOperation(ctx contractapi.TransactionContextInterface, fn func() error) error {
+	tc, ok := ctx.(*TransactionContext)
+	if !ok {
+		return fmt.Errorf("operations are not available in this transaction context")
+	}
+	if tc.operation != "" {
+		return fn()
+	}
+	tc.operations++
+	tc.operation = fmt.Sprintf("%s:%d", ctx.GetStub().GetTxID(), tc.operations)
+	defer func() { tc.operation = "" }()
+	return fn()
+}
+
+func currentOperation(ctx contractapi.TransactionContextInterface) string {
+	if tc, ok := ctx.(*TransactionContext); ok {
+		return tc.operation
+	}
+	return ""
+}
+
+// reversalGroup is the ID of the reversal a history record belongs to
+func reversalGroup(h *TransactionHistory) string {
+	if h.TxID == "" {
+		return h.HistoryHash
+	}
+	return h.Operation
+}
+
+// originalEntries resolves a history record to the reversal group it belongs
+// to and all history records in that group
+func originalEntries(ctx contractapi.TransactionContextInterface, id string) (string, []*TransactionHistory, error) {
+	first, err := getHistory(ctx, id)
+	if err != nil {
+		return "", nil, err
+	}
+	if first.ReversalOf != "" {
+		return "", nil, fmt.Errorf("%s is itself a reversal and cannot be reversed", id)
+	}
+	if first.TxID == "" {
+		return first.HistoryHash, []*TransactionHistory{first}, nil
+	}
+	if first.Operation == "" {
+		return "", nil, fmt.Errorf("%s (%s) was posted by a subsystem and must be undone there", id, first.Narrative)
+	}
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(historyTxIndex, []string{first.TxID})
+	if err != nil {
+		return "", nil, err
+	}
+	defer iter.Close()
+
+	var entries []*TransactionHistory
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return "", nil, err
+		}
+		_, parts, err := ctx.GetStub().SplitCompositeKey(res.Key)
+		if err != nil || len(parts) != 2 {
+			continue
+		}
+		h, err := getHistory(ctx, parts[1])
+		if err != nil {
+			return "", nil, err
+		}
+		if h.Operation == first.Operation {
+			entries = append(entries, h)
+		}
+	}
+	return first.Operation, entries, nil
+}
+
+// requireEntriesBank refuses callers from a bank other than the one holding
+// every account the entries were posted to
+func requireEntriesBank(ctx contractapi.TransactionContextInterface, entries []*TransactionHistory) error {
+	seen := map[string]bool{}
+	for _, e := range entries {
+		if seen[e.DepositUser] {
+			continue
+		}
+		seen[e.DepositUser] = true
+		a, err := getAccount(ctx, e.DepositUser)
+		if err != nil {
+			return err
+		}
+		if err := requireAccountBank(ctx, a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getReversal(ctx contractapi.TransactionContextInterface, groupID string) (*Reversal, bool, error) {
+	key, err := makeKey(ctx, reversalObjectType, groupID)
+	if err != nil {
+		return nil, false, err
+	}
+	var r Reversal
+	found, err := getJSON(ctx, key, &r)
+	if err != nil {
+		return nil, false, err
+	}
+	return &r, found, nil
+}
+
+func putReversal(ctx contractapi.TransactionContextInterface, r *Reversal) error {
+	key, err := makeKey(ctx, reversalObjectType, r.ID)
+	if err != nil {
+		return err
+	}
+	return putJSON(ctx, key, r)
+}
+
+func getReversalConfig(ctx contractapi.TransactionContextInterface) (*ReversalConfig, error) {
+	key, err := makeKey(ctx, reversalConfigKey)
+	if err != nil {
+		return nil, err
+	}
+	cfg := ReversalConfig{ApprovalThreshold: defaultReversalThreshold}
+	if _, err := getJSON(ctx, key, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// largestLeg returns the largest entry amount in minor units. Manually
+// created records may hold amounts that are not integers; those report
+// ok=false so the reversal always goes through approval.
+func largestLeg(entries []*TransactionHistory) (int64, bool) {
+	var largest int64
+	for _, e := range entries {
+		amount, err := strconv.ParseInt(e.Amount, 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		if amount > largest {
+			largest = amount
+		}
+	}
+	return largest, true
+}
+
+// applyReversal posts an exact offsetting entry for every original entry.
+// Chaincode postings move the account balance back and the GL lines of their
+// operation are offset line by line; manually created records never touched a balance, so
+// they are offset by a DEBIT history record only.
+func applyReversal(ctx contractapi.TransactionContextInterface, r *Reversal, entries []*TransactionHistory) error {
+	for _, orig := range entries {
+		narrative := "Reversal of " + orig.HistoryHash + ": " + r.Reason
+
+		switch orig.Type {
+		case entryCredit, entryDebit:
+			amount, err := strconv.ParseInt(orig.Amount, 10, 64)
+			if err != nil {
+				return fmt.Errorf("history %s has invalid amount %q", orig.HistoryHash, orig.Amount)
+			}
+			if orig.Type == entryCredit {
+				amount = -amount
+			}
+			account, err := getAccount(ctx, orig.DepositUser)
+			if err != nil {
+				return err
+			}
+			record, err := postEntry(ctx, account, amount, narrative, orig.HistoryHash)
+			if err != nil {
+				return err
+			}
+			r.ReversalEntries = append(r.ReversalEntries, record.HistoryHash)
+
+		default:
+			record := &TransactionHistory{
+				DepositUser: orig.DepositUser,
+				Amount:      orig.Amount,
+				Type:        entryDebit,
+				Narrative:   narrative,
+				ReversalOf:  orig.HistoryHash,
+			}
+			if err := writeHistory(ctx, record); err != nil {
+				return err
+			}
+			r.ReversalEntries = append(r.ReversalEntries, record.HistoryHash)
+		}
+	}
+
+	// Customer deposit GL lines were re-posted by postEntry above; offset the rest
+	if entries[0].TxID != "" {
+		glEntries, err := glEntriesOfTx(ctx, entries[0].TxID)
+		if err != nil {
+			return err
+		}
+		for _, e := range glEntries {
+			if e.Operation != entries[0].Operation || e.GLCode == glCustomerDeposits {
+				continue
+			}
+			if err := glPost(ctx, e.GLCode, e.Credit-e.Debit, "Reversal: "+r.Reason); err != nil {
+				return err
+			}
+		}
+	}
+
+	r.Status = reversalCompleted
+	return nil
+}
+
+// ======================== Reversal Methods ========================
+
+// Reverse a deposit, withdrawal or transfer, or a manually created history
+// record. Amounts above the approval threshold wait for ApproveReversal by a
+// Manager other than the requester.
+func (s *SmartContract) ReverseTransaction(ctx contractapi.TransactionContextInterface, originalID string, reason string) (*Reversal, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+	if reason == "" {
+		return nil, fmt.Errorf("reason required")
+	}
+
+	groupID, entries, err := originalEntries(ctx, originalID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireEntriesBank(ctx, entries); err != nil {
+		return nil, err
+	}
+	existing, found, err := getReversal(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+	if found && existing.Status != reversalRejected {
+		return nil, fmt.Errorf("transaction %s is already %s", groupID, existing.Status)
+	}
+
+	cfg, err := getReversalConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cn, _ := getCallerCN(ctx)
+
+	r := &Reversal{
+		ID:          groupID,
+		Reason:      reason,
+		Status:      reversalPending,
+		RequestedBy: cn,
+		RequestedAt: now.Format(time.RFC3339),
+	}
+	for _, e := range entries {
+		r.OriginalEntries = append(r.OriginalEntries, e.HistoryHash)
+	}
+
+	amount, known := largestLeg(entries)
+	r.Amount = amount
+	if known && amount <= cfg.ApprovalThreshold {
+		if err := applyReversal(ctx, r, entries); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := putReversal(ctx, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Approve a pending reversal and post its offsetting entries
+func (s *SmartContract) ApproveReversal(ctx contractapi.TransactionContextInterface, originalID string) (*Reversal, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+
+	groupID, entries, err := originalEntries(ctx, originalID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireEntriesBank(ctx, entries); err != nil {
+		return nil, err
+	}
+	r, found, err := getReversal(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+	if !found || r.Status != reversalPending {
+		return nil, fmt.Errorf("no pending reversal for %s", groupID)
+	}
+
+	cn, _ := getCallerCN(ctx)
+	if cn == r.RequestedBy {
+		return nil, fmt.Errorf("a reversal cannot be approved by its requester")
+	}
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := applyReversal(ctx, r, entries); err != nil {
+		return nil, err
+	}
+	r.ApprovedBy = cn
+	r.ApprovedAt = now.Format(time.RFC3339)
+	if err := putReversal(ctx, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reject a pending reversal
+func (s *SmartContract) RejectReversal(ctx contractapi.TransactionContextInterface, originalID string) (*Reversal, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+
+	groupID, entries, err := originalEntries(ctx, originalID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireEntriesBank(ctx, entries); err != nil {
+		return nil, err
+	}
+	r, found, err := getReversal(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+	if !found || r.Status != reversalPending {
+		return nil, fmt.Errorf("no pending reversal for %s", groupID)
+	}
+
+	r.Status = reversalRejected
+	r.RejectedBy, _ = getCallerCN(ctx)
+	if err := putReversal(ctx, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Fetch the reversal of a transaction, for staff or an owner of the account
+// the named record was posted to
+func (s *SmartContract) GetReversal(ctx contractapi.TransactionContextInterface, originalID string) (*Reversal, error) {
+
+	if _, found, err := getClientRole(ctx); err != nil || !found {
+		return nil, fmt.Errorf("caller has no role attribute")
+	}
+
+	first, err := getHistory(ctx, originalID)
+	if err != nil {
+		return nil, err
+	}
+	a, err := getAccount(ctx, first.DepositUser)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountAccess(ctx, a); err != nil {
+		return nil, err
+	}
+	groupID := reversalGroup(first)
+	if first.ReversalOf != "" {
+		orig, err := getHistory(ctx, first.ReversalOf)
+		if err != nil {
+			return nil, err
+		}
+		groupID = reversalGroup(orig)
+	}
+	if groupID == "" {
+		return nil, fmt.Errorf("transaction %s cannot be reversed", originalID)
+	}
+
+	r, found, err := getReversal(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("transaction %s has not been reversed", originalID)
+	}
+	return r, nil
+}
+
+// Set the amount above which reversals need Manager approval
+func (s *SmartContract) SetReversalApprovalThreshold(ctx contractapi.TransactionContextInterface, threshold int64) error {
+
+	if err := requireRole(ctx, "SuperAdmin", "Admin"); err != nil {
+		return err
+	}
+	if threshold < 0 {
+		return fmt.Errorf("threshold cannot be negative")
+	}
+
+	key, err := makeKey(ctx, reversalConfigKey)
+	if err != nil {
+		return err
+	}
+	cn, _ := getCallerCN(ctx)
+	return putJSON(ctx, key, ReversalConfig{ApprovalThreshold: threshold, UpdatedBy: cn})
+}
@@ -0,0 +1,138 @@
+package main
+
+import "testing"
+
+// historyOfTx lists the history records a transaction wrote, in key order
+func historyOfTx(l *testLedger, txID string) []string {
+	l.t.Helper()
+	l.commit()
+	iter, err := l.stub.GetStateByPartialCompositeKey(historyTxIndex, []string{txID})
+	l.check(err)
+	var hashes []string
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		l.check(err)
+		_, parts, err := l.stub.SplitCompositeKey(kv.Key)
+		l.check(err)
+		hashes = append(hashes, parts[1])
+	}
+	if len(hashes) == 0 {
+		l.t.Fatalf("transaction %s wrote no history", txID)
+	}
+	return hashes
+}
+
+func TestReverseTransaction(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold int64
+		post      func(l *testLedger) (string, error)
+		wantErr   string
+		status    string
+		payer     int64
+		payee     int64
+		feeIncome int64
+	}{
+		{name: "deposit", post: func(l *testLedger) (string, error) {
+			_, err := l.cc.Deposit(l.staff(), "A1", 5000)
+			return "", err
+		}, status: reversalCompleted, payer: 10000},
+		{name: "withdrawal returns its fee", post: func(l *testLedger) (string, error) {
+			l.setFlatFee(opWithdrawal, 100)
+			_, err := l.cc.Withdraw(l.staff(), "A1", 2000)
+			return "", err
+		}, status: reversalCompleted, payer: 10000},
+		{name: "transfer", post: func(l *testLedger) (string, error) {
+			return "", l.cc.Transfer(l.as("alice", "User"), "A1", "B1", 3000)
+		}, status: reversalCompleted, payer: 10000},
+		{name: "transfer above the threshold waits", threshold: 1000, post: func(l *testLedger) (string, error) {
+			return "", l.cc.Transfer(l.as("alice", "User"), "A1", "B1", 3000)
+		}, status: reversalPending, payer: 7000, payee: 3000},
+		{name: "manual record with a decimal amount waits", post: func(l *testLedger) (string, error) {
+			h, err := l.cc.AppendTransactionHistory(l.staff(), "A1", "12.50", "2025-08-01", "10:00")
+			if err != nil {
+				return "", err
+			}
+			return h.HistoryHash, nil
+		}, status: reversalPending, payer: 10000},
+		{name: "subsystem posting", post: func(l *testLedger) (string, error) {
+			h, err := l.cc.PlaceHold(l.staff(), "A1", 4000, "card authorisation", "")
+			if err != nil {
+				return "", err
+			}
+			_, err = l.cc.CaptureHold(l.staff(), h.ID, 4000, "B1")
+			return "", err
+		}, wantErr: "posted by a subsystem", payer: 6000, payee: 4000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLedger(t)
+			l.openAccount("A1", "alice", 10000)
+			l.openAccount("B1", "bob", 0)
+			l.addBeneficiary("alice", "B1")
+			if tt.threshold > 0 {
+				l.check(l.cc.SetReversalApprovalThreshold(l.as("admin", "Admin"), tt.threshold))
+			}
+			// Postings name no record: reverse the first one their transaction wrote
+			original, err := tt.post(l)
+			l.check(err)
+			if original == "" {
+				original = historyOfTx(l, l.stub.txID)[0]
+			}
+
+			r, err := l.cc.ReverseTransaction(l.staff(), original, "posted in error")
+			if tt.wantErr != "" {
+				l.checkFails(err, tt.wantErr)
+			} else {
+				l.check(err)
+				if r.Status != tt.status {
+					t.Fatalf("reversal is %s, want %s", r.Status, tt.status)
+				}
+			}
+
+			l.expectBalances("A1", tt.payer, tt.payer)
+			l.expectBalances("B1", tt.payee, tt.payee)
+			if got := l.glBalance(glFeeIncome); got != -tt.feeIncome {
+				t.Fatalf("fee income %d, want %d", -got, tt.feeIncome)
+			}
+			if got := l.glBalance(glCash) + l.glBalance(glCustomerDeposits); got != 0 {
+				t.Fatalf("cash and deposits out of balance by %d", got)
+			}
+		})
+	}
+}
+
+func TestReversalControls(t *testing.T) {
+	l := newTestLedger(t)
+	l.openAccount("A1", "alice", 10000)
+	l.openAccount("B1", "bob", 0)
+	l.addBeneficiary("alice", "B1")
+	l.check(l.cc.SetReversalApprovalThreshold(l.as("admin", "Admin"), 1000))
+	l.check(l.cc.Transfer(l.as("alice", "User"), "A1", "B1", 3000))
+	original := historyOfTx(l, l.stub.txID)[0]
+
+	_, err := l.cc.ReverseTransaction(l.as("alice", "User"), original, "mine")
+	l.checkFails(err, "access denied")
+	_, err = l.cc.ReverseTransaction(l.staff(), original, "")
+	l.checkFails(err, "reason required")
+	_, err = l.cc.ReverseTransaction(l.staff(), original, "wrong payee")
+	l.check(err)
+	_, err = l.cc.ReverseTransaction(l.staff(), original, "again")
+	l.checkFails(err, "already "+reversalPending)
+	_, err = l.cc.ApproveReversal(l.staff(), original)
+	l.checkFails(err, "approved by its requester")
+
+	r, err := l.cc.ApproveReversal(l.as("supervisor", "Manager"), original)
+	l.check(err)
+	if r.Status != reversalCompleted || len(r.ReversalEntries) != 2 {
+		t.Fatalf("reversal is %s with %d entries", r.Status, len(r.ReversalEntries))
+	}
+	l.expectBalances("A1", 10000, 10000)
+	l.expectBalances("B1", 0, 0)
+
+	_, err = l.cc.ReverseTransaction(l.staff(), original, "again")
+	l.checkFails(err, "already "+reversalCompleted)
+	_, err = l.cc.ReverseTransaction(l.staff(), r.ReversalEntries[0], "undo the undo")
+	l.checkFails(err, "itself a reversal")
+}
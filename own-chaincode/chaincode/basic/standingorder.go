@@ -0,0 +1,619 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ======================== Structs ==========================
+
+const (
+	standingOrderObjectType = "StandingOrder"
+	soExecutionObjectType   = "StandingOrderExecution"
+	soDueIndex              = "sodue~date~id"
+	soConfigKey             = "StandingOrderConfig"
+
+	soActive    = "ACTIVE"
+	soCancelled = "CANCELLED"
+	soCompleted = "COMPLETED"
+
+	soExecuted  = "EXECUTED"
+	soRetrying  = "RETRYING"
+	soAbandoned = "ABANDONED"
+
+	freqDaily     = "DAILY"
+	freqWeekly    = "WEEKLY"
+	freqMonthly   = "MONTHLY"
+	freqQuarterly = "QUARTERLY"
+	freqYearly    = "YEARLY"
+
+	soPageSize              = 50
+	defaultSOMaxAttempts    = 3
+	defaultSORetryAfterDays = 1
+)
+
+// StandingOrder is a recurring transfer. Due dates are StartDate plus whole
+// multiples of the frequency; Period counts the due dates already settled
+// (executed or abandoned). EndDate is inclusive and may be empty.
+type StandingOrder struct {
+	ID          string `json:"id"`
+	FromAccount string `json:"fromAccount"`
+	ToAccount   string `json:"toAccount"`
+	Amount      int64  `json:"amount"`
+	Frequency   string `json:"frequency"`
+	StartDate   string `json:"startDate"`
+	EndDate     string `json:"endDate,omitempty" metadata:",optional"`
+	Period      int    `json:"period"`
+	NextDueDate string `json:"nextDueDate,omitempty" metadata:",optional"`
+	Status      string `json:"status"`
+	CreatedBy   string `json:"createdBy"`
+	CreatedAt   string `json:"createdAt"`
+	UpdatedBy   string `json:"updatedBy,omitempty" metadata:",optional"`
+}
+
+// StandingOrderAttempt is one execution attempt of a due date
+type StandingOrderAttempt struct {
+	Date        string `json:"date"`
+	Error       string `json:"error,omitempty" metadata:",optional"`
+	HistoryHash string `json:"historyHash,omitempty" metadata:",optional"`
+}
+
+// StandingOrderExecution records the outcome of one due date of an order.
+// At most one execution per order and due date can reach EXECUTED.
+type StandingOrderExecution struct {
+	OrderID  string                 `json:"orderId"`
+	DueDate  string                 `json:"dueDate"`
+	Status   string                 `json:"status"`
+	Attempts []StandingOrderAttempt `json:"attempts"`
+}
+
+// StandingOrderConfig is the retry policy for failed executions: a due date
+// is retried every RetryAfterDays until MaxAttempts have failed, then it is
+// abandoned and the order moves on to its next due date.
+type StandingOrderConfig struct {
+	MaxAttempts    int    `json:"maxAttempts"`
+	RetryAfterDays int    `json:"retryAfterDays"`
+	UpdatedBy      string `json:"updatedBy"`
+}
+
+// ======================== Standing Order Helpers ========================
+
+func getStandingOrder(ctx contractapi.TransactionContextInterface, id string) (*StandingOrder, error) {
+	if id == "" {
+		return nil, fmt.Errorf("standing order id required")
+	}
+	key, err := makeKey(ctx, standingOrderObjectType, id)
+	if err != nil {
+		return nil, err
+	}
+	var so StandingOrder
+	found, err := getJSON(ctx, key, &so)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("standing order %s not found", id)
+	}
+	return &so, nil
+}
+
+func putStandingOrder(ctx contractapi.TransactionContextInterface, so *StandingOrder) error {
+	key, err := makeKey(ctx, standingOrderObjectType, so.ID)
+	if err != nil {
+		return err
+	}
+	return putJSON(ctx, key, so)
+}
+
+func getSOExecution(ctx contractapi.TransactionContextInterface, orderID string, dueDate string) (*StandingOrderExecution, error) {
+	key, err := makeKey(ctx, soExecutionObjectType, orderID, dueDate)
+	if err != nil {
+		return nil, err
+	}
+	exec := StandingOrderExecution{OrderID: orderID, DueDate: dueDate, Attempts: []StandingOrderAttempt{}}
+	if _, err := getJSON(ctx, key, &exec); err != nil {
+		return nil, err
+	}
+	return &exec, nil
+}
+
+func putSOExecution(ctx contractapi.TransactionContextInterface, exec *StandingOrderExecution) error {
+	key, err := makeKey(ctx, soExecutionObjectType, exec.OrderID, exec.DueDate)
+	if err != nil {
+		return err
+	}
+	return putJSON(ctx, key, exec)
+}
+
+func getSOConfig(ctx contractapi.TransactionContextInterface) (*StandingOrderConfig, error) {
+	key, err := makeKey(ctx, soConfigKey)
+	if err != nil {
+		return nil, err
+	}
+	cfg := StandingOrderConfig{MaxAttempts: defaultSOMaxAttempts, RetryAfterDays: defaultSORetryAfterDays}
+	if _, err := getJSON(ctx, key, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// dueDateOf returns the n-th due date of a schedule starting at start. Monthly
+// dates that fall past the end of a month are clamped to its last day, so a
+// schedule starting on the 31st does not drift.
+func dueDateOf(start string, frequency string, n int) (string, error) {
+	s, err := parseDate(start)
+	if err != nil {
+		return "", err
+	}
+	months := 0
+	switch frequency {
+	case freqDaily:
+		return s.AddDate(0, 0, n).Format(dateLayout), nil
+	case freqWeekly:
+		return s.AddDate(0, 0, 7*n).Format(dateLayout), nil
+	case freqMonthly:
+		months = n
+	case freqQuarterly:
+		months = 3 * n
+	case freqYearly:
+		months = 12 * n
+	default:
+		return "", fmt.Errorf("invalid frequency %q", frequency)
+	}
+	firstOfMonth := time.Date(s.Year(), s.Month()+time.Month(months), 1, 0, 0, 0, 0, time.UTC)
+	lastDay := firstOfMonth.AddDate(0, 1, -1).Day()
+	day := s.Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	return time.Date(firstOfMonth.Year(), firstOfMonth.Month(), day, 0, 0, 0, 0, time.UTC).Format(dateLayout), nil
+}
+
+// setSODueIndex moves an order's due index entry from oldDate to its
+// NextDueDate; inactive orders are left out of the index
+func setSODueIndex(ctx contractapi.TransactionContextInterface, so *StandingOrder, oldDate string) error {
+	if oldDate != "" {
+		key, err := makeKey(ctx, soDueIndex, oldDate, so.ID)
+		if err != nil {
+			return err
+		}
+		if err := ctx.GetStub().DelState(key); err != nil {
+			return err
+		}
+	}
+	if so.Status != soActive {
+		return nil
+	}
+	key, err := makeKey(ctx, soDueIndex, so.NextDueDate, so.ID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, []byte{0x00})
+}
+
+// advanceStandingOrder settles the current due date and schedules the next,
+// completing the order when it runs past its end date
+func advanceStandingOrder(ctx contractapi.TransactionContextInterface, so *StandingOrder) error {
+	oldDate := so.NextDueDate
+	so.Period++
+	next, err := dueDateOf(so.StartDate, so.Frequency, so.Period)
+	if err != nil {
+		return err
+	}
+	so.NextDueDate = next
+	if so.EndDate != "" && next > so.EndDate {
+		so.Status = soCompleted
+		so.NextDueDate = ""
+	}
+	if err := setSODueIndex(ctx, so, oldDate); err != nil {
+		return err
+	}
+	return putStandingOrder(ctx, so)
+}
+
+// transferCheck reports why a transfer cannot be made, without posting.
+// amount includes any fee the sender will be charged.
+func transferCheck(ctx contractapi.TransactionContextInterface, from *Account, to *Account, amount int64) error {
+	if from.Status != accountActive {
+		return fmt.Errorf("account %s is %s", from.ID, from.Status)
+	}
+	if to.Status != accountActive {
+		return fmt.Errorf("account %s is %s", to.ID, to.Status)
+	}
+	if err := requireSameBank(from, to); err != nil {
+		return err
+	}
+	available, err := availableBalance(ctx, from)
+	if err != nil {
+		return err
+	}
+	if available < amount {
+		return fmt.Errorf("insufficient funds in account %s", from.ID)
+	}
+	return nil
+}
+
+// executeStandingOrder attempts the order's current due date. A failed
+// transfer is recorded against the due date rather than failing the batch.
+// It returns nil when nothing was attempted, e.g. because a retry is not
+// yet due.
+func executeStandingOrder(
+	ctx contractapi.TransactionContextInterface,
+	so *StandingOrder, businessDate string, cfg *StandingOrderConfig,
+) (*StandingOrderExecution, error) {
+	exec, err := getSOExecution(ctx, so.ID, so.NextDueDate)
+	if err != nil {
+		return nil, err
+	}
+	if exec.Status == soExecuted || exec.Status == soAbandoned {
+		// Already settled: never pay a due date twice
+		return nil, advanceStandingOrder(ctx, so)
+	}
+	if n := len(exec.Attempts); n > 0 {
+		retryOn, err := parseDate(exec.Attempts[n-1].Date)
+		if err != nil {
+			return nil, err
+		}
+		if businessDate < retryOn.AddDate(0, 0, cfg.RetryAfterDays).Format(dateLayout) {
+			return nil, nil
+		}
+	}
+
+	attempt := StandingOrderAttempt{Date: businessDate}
+	from, err := getAccount(ctx, so.FromAccount)
+	if err != nil {
+		return nil, err
+	}
+	to, err := getAccount(ctx, so.ToAccount)
+	if err != nil {
+		return nil, err
+	}
+	// Standing orders are online instructions and pay the online transfer fee
+	fee, _, err := feeFor(ctx, opTransfer, from, channelOnline, so.Amount)
+	if err != nil {
+		return nil, err
+	}
+	narrative := "Standing order " + so.ID
+	reason := transferCheck(ctx, from, to, so.Amount+fee)
+	if reason == nil {
+		reason = enforceLimits(ctx, &LimitedOperation{Operation: opTransfer, AccountID: from.ID, ToAccount: to.ID, Amount: so.Amount})
+	}
+	if reason != nil {
+		attempt.Error = reason.Error()
+	} else {
+		record, err := postEntry(ctx, from, -so.Amount, narrative+" to "+to.ID, "")
+		if err != nil {
+			return nil, err
+		}
+		if err := postToAccount(ctx, to, so.Amount, narrative+" from "+from.ID); err != nil {
+			return nil, err
+		}
+		if err := postFee(ctx, from, opTransfer, fee); err != nil {
+			return nil, err
+		}
+		attempt.HistoryHash = record.HistoryHash
+	}
+
+	exec.Attempts = append(exec.Attempts, attempt)
+	switch {
+	case attempt.Error == "":
+		exec.Status = soExecuted
+	case len(exec.Attempts) >= cfg.MaxAttempts:
+		exec.Status = soAbandoned
+	default:
+		exec.Status = soRetrying
+	}
+	if err := putSOExecution(ctx, exec); err != nil {
+		return nil, err
+	}
+	if exec.Status == soRetrying {
+		return exec, nil
+	}
+	return exec, advanceStandingOrder(ctx, so)
+}
+
+// executeDueStandingOrders runs one page of orders due on or before businessDate
+func executeDueStandingOrders(ctx contractapi.TransactionContextInterface, businessDate string, bookmark string) (*BatchResult, error) {
+	cfg, err := getSOConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &BatchResult{}
+	next, err := scanIndex(ctx, soDueIndex, nil, bookmark, soPageSize,
+		func(key string, parts []string, _ []byte) (bool, error) {
+			if len(parts) != 2 || parts[0] > businessDate {
+				return false, nil
+			}
+			so, err := getStandingOrder(ctx, parts[1])
+			if err != nil {
+				return false, err
+			}
+			if so.Status != soActive || so.NextDueDate != parts[0] {
+				return true, nil
+			}
+			// Catch up on every due date up to the business date, stopping
+			// at a failure that is still being retried
+			for so.Status == soActive && so.NextDueDate <= businessDate {
+				dueDate := so.NextDueDate
+				exec, err := executeStandingOrder(ctx, so, businessDate, cfg)
+				if err != nil {
+					return false, err
+				}
+				if exec == nil {
+					break
+				}
+				if exec.Status == soExecuted {
+					result.Processed++
+					continue
+				}
+				result.Failed++
+				last := exec.Attempts[len(exec.Attempts)-1]
+				result.Errors = append(result.Errors, fmt.Sprintf("%s %s: %s", so.ID, dueDate, last.Error))
+				if exec.Status == soRetrying {
+					break
+				}
+			}
+			return true, nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	result.Bookmark = next
+	return result, nil
+}
+
+func eodStandingOrders(ctx contractapi.TransactionContextInterface, date string, bookmark string, r *EODStepResult) (string, error) {
+	page, err := executeDueStandingOrders(ctx, date, bookmark)
+	if err != nil {
+		return "", err
+	}
+	return r.addPage(page), nil
+}
+
+// requireOrderAccess allows staff or the owner of the paying account
+func requireOrderAccess(ctx contractapi.TransactionContextInterface, so *StandingOrder) error {
+	from, err := getAccount(ctx, so.FromAccount)
+	if err != nil {
+		return err
+	}
+	return requireAccountAccess(ctx, from)
+}
+
+// ======================== Standing Order Methods ========================
+
+// Set up a recurring transfer between two accounts
+func (s *SmartContract) CreateStandingOrder(
+	ctx contractapi.TransactionContextInterface,
+	fromAccount string, toAccount string, amount int64, frequency string, startDate string, endDate string,
+) (*StandingOrder, error) {
+
+	if amount <= 0 {
+		return nil, fmt.Errorf("amount must be positive")
+	}
+	if fromAccount == toAccount {
+		return nil, fmt.Errorf("cannot pay a standing order to the same account")
+	}
+	if _, err := dueDateOf(startDate, frequency, 0); err != nil {
+		return nil, err
+	}
+	if endDate != "" {
+		if _, err := parseDate(endDate); err != nil {
+			return nil, err
+		}
+		if endDate < startDate {
+			return nil, fmt.Errorf("endDate must not be before startDate")
+		}
+	}
+	today, err := getBusinessDate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if startDate < today {
+		return nil, fmt.Errorf("startDate must not be before the business date %s", today)
+	}
+
+	from, err := getAccount(ctx, fromAccount)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireDebitAuthority(ctx, from); err != nil {
+		return nil, err
+	}
+	to, err := getAccount(ctx, toAccount)
+	if err != nil {
+		return nil, err
+	}
+	if from.Status != accountActive || to.Status != accountActive {
+		return nil, fmt.Errorf("both accounts must be active")
+	}
+	if err := requireSameBank(from, to); err != nil {
+		return nil, err
+	}
+	if err := checkBeneficiary(ctx, from, to, amount); err != nil {
+		return nil, err
+	}
+
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cn, _ := getCallerCN(ctx)
+	so := &StandingOrder{
+		ID:          newID(ctx, "SO"),
+		FromAccount: from.ID,
+		ToAccount:   to.ID,
+		Amount:      amount,
+		Frequency:   frequency,
+		StartDate:   startDate,
+		EndDate:     endDate,
+		NextDueDate: startDate,
+		Status:      soActive,
+		CreatedBy:   cn,
+		CreatedAt:   now.Format(time.RFC3339),
+	}
+	if err := setSODueIndex(ctx, so, ""); err != nil {
+		return nil, err
+	}
+	if err := putStandingOrder(ctx, so); err != nil {
+		return nil, err
+	}
+	return so, nil
+}
+
+// Change the amount or end date of an active standing order. A zero amount
+// or an empty end date keeps the current one; clearEndDate removes the end
+// date so the order runs until cancelled.
+func (s *SmartContract) AmendStandingOrder(
+	ctx contractapi.TransactionContextInterface,
+	id string, amount int64, endDate string, clearEndDate bool,
+) (*StandingOrder, error) {
+
+	so, err := getStandingOrder(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	from, err := getAccount(ctx, so.FromAccount)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireDebitAuthority(ctx, from); err != nil {
+		return nil, err
+	}
+	if so.Status != soActive {
+		return nil, fmt.Errorf("standing order %s is %s", so.ID, so.Status)
+	}
+	if amount < 0 {
+		return nil, fmt.Errorf("amount must be positive")
+	}
+	if amount > 0 {
+		to, err := getAccount(ctx, so.ToAccount)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkBeneficiary(ctx, from, to, amount); err != nil {
+			return nil, err
+		}
+	}
+	if clearEndDate && endDate != "" {
+		return nil, fmt.Errorf("give an endDate or clear it, not both")
+	}
+	if endDate != "" {
+		if _, err := parseDate(endDate); err != nil {
+			return nil, err
+		}
+		if endDate < so.NextDueDate {
+			return nil, fmt.Errorf("endDate must not be before the next due date %s", so.NextDueDate)
+		}
+	}
+
+	if amount > 0 {
+		so.Amount = amount
+	}
+	if endDate != "" || clearEndDate {
+		so.EndDate = endDate
+	}
+	so.UpdatedBy, _ = getCallerCN(ctx)
+	if err := putStandingOrder(ctx, so); err != nil {
+		return nil, err
+	}
+	return so, nil
+}
+
+// Cancel a standing order; no further due dates are executed
+func (s *SmartContract) CancelStandingOrder(ctx contractapi.TransactionContextInterface, id string) (*StandingOrder, error) {
+
+	so, err := getStandingOrder(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireOrderAccess(ctx, so); err != nil {
+		return nil, err
+	}
+	if so.Status != soActive {
+		return nil, fmt.Errorf("standing order %s is %s", so.ID, so.Status)
+	}
+
+	oldDate := so.NextDueDate
+	so.Status = soCancelled
+	so.NextDueDate = ""
+	so.UpdatedBy, _ = getCallerCN(ctx)
+	if err := setSODueIndex(ctx, so, oldDate); err != nil {
+		return nil, err
+	}
+	if err := putStandingOrder(ctx, so); err != nil {
+		return nil, err
+	}
+	return so, nil
+}
+
+// Fetch standing order
+func (s *SmartContract) GetStandingOrder(ctx contractapi.TransactionContextInterface, id string) (*StandingOrder, error) {
+	so, err := getStandingOrder(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireOrderAccess(ctx, so); err != nil {
+		return nil, err
+	}
+	return so, nil
+}
+
+// Fetch the execution record of one due date of a standing order
+func (s *SmartContract) GetStandingOrderExecution(ctx contractapi.TransactionContextInterface, id string, dueDate string) (*StandingOrderExecution, error) {
+	so, err := getStandingOrder(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireOrderAccess(ctx, so); err != nil {
+		return nil, err
+	}
+	exec, err := getSOExecution(ctx, so.ID, dueDate)
+	if err != nil {
+		return nil, err
+	}
+	if exec.Status == "" {
+		return nil, fmt.Errorf("standing order %s has no execution for %s", so.ID, dueDate)
+	}
+	return exec, nil
+}
+
+// Execute standing orders due on or before the business date, one page per
+// transaction. Safe to rerun: a due date that has executed is never paid again.
+func (s *SmartContract) ExecuteDueStandingOrders(ctx contractapi.TransactionContextInterface, businessDate string, bookmark string) (*BatchResult, error) {
+
+	if err := requireRole(ctx, staffRoles...); err != nil {
+		return nil, err
+	}
+	if err := checkOpenDate(ctx, businessDate); err != nil {
+		return nil, err
+	}
+	today, err := getBusinessDate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if businessDate > today {
+		return nil, fmt.Errorf("cannot execute standing orders ahead of %s", today)
+	}
+	return executeDueStandingOrders(ctx, businessDate, bookmark)
+}
+
+// Set the retry policy for failed standing order executions
+func (s *SmartContract) SetStandingOrderRetryPolicy(ctx contractapi.TransactionContextInterface, maxAttempts int, retryAfterDays int) error {
+
+	if err := requireRole(ctx, "SuperAdmin", "Admin"); err != nil {
+		return err
+	}
+	if maxAttempts <= 0 || retryAfterDays <= 0 {
+		return fmt.Errorf("maxAttempts and retryAfterDays must be positive")
+	}
+
+	key, err := makeKey(ctx, soConfigKey)
+	if err != nil {
+		return err
+	}
+	cn, _ := getCallerCN(ctx)
+	return putJSON(ctx, key, StandingOrderConfig{MaxAttempts: maxAttempts, RetryAfterDays: retryAfterDays, UpdatedBy: cn})
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ======================== Structs ==========================
+
+const statementObjectType = "Statement"
+
+// StatementLine is one posting on a statement. RunningBalance is the account
+// balance after the posting.
+type StatementLine struct {
+	HistoryHash    string `json:"historyHash"`
+	Date           string `json:"date"`
+	Time           string `json:"time"`
+	Narrative      string `json:"narrative"`
+	Debit          int64  `json:"debit"`
+	Credit         int64  `json:"credit"`
+	RunningBalance int64  `json:"runningBalance"`
+}
+
+// Statement lists an account's postings between two dates inclusive.
+// MerkleRoot is computed over the entries' history hashes in statement order.
+type Statement struct {
+	ID             string           `json:"id"`
+	AccountID      string           `json:"accountId"`
+	From           string           `json:"from"`
+	To             string           `json:"to"`
+	OpeningBalance int64            `json:"openingBalance"`
+	Entries        []*StatementLine `json:"entries"`
+	ClosingBalance int64            `json:"closingBalance"`
+	MerkleRoot     string           `json:"merkleRoot"`
+	GeneratedBy    string           `json:"generatedBy"`
+	GeneratedAt    string           `json:"generatedAt"`
+}
+
+// StatementAnchor is the on-ledger record of a generated statement. A printed
+// statement is verified by recomputing the Merkle root of its entries.
+type StatementAnchor struct {
+	ID             string `json:"id"`
+	AccountID      string `json:"accountId"`
+	From           string `json:"from"`
+	To             string `json:"to"`
+	OpeningBalance int64  `json:"openingBalance"`
+	ClosingBalance int64  `json:"closingBalance"`
+	EntryCount     int    `json:"entryCount"`
+	MerkleRoot     string `json:"merkleRoot"`
+	GeneratedBy    string `json:"generatedBy"`
+	GeneratedAt    string `json:"generatedAt"`
+	TxID           string `json:"txId"`
+}
+
+// ======================== Statement Helpers ========================
+
+// Merkle tree hashes are domain separated so that a leaf can never be passed
+// off as an inner node or the other way round
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// merkleRoot hashes 32-byte hex leaves pairwise up to a single root. An odd
+// node at the end of a level is promoted unchanged to the next level. The
+// root of no leaves is the hash of the empty string.
+func merkleRoot(leaves []string) (string, error) {
+	if len(leaves) == 0 {
+		sum := sha256.Sum256(nil)
+		return hex.EncodeToString(sum[:]), nil
+	}
+
+	level := make([][]byte, len(leaves))
+	for i, leaf := range leaves {
+		b, err := hex.DecodeString(leaf)
+		if err != nil || len(b) != sha256.Size {
+			return "", fmt.Errorf("invalid entry hash %q", leaf)
+		}
+		sum := sha256.Sum256(append([]byte{merkleLeafPrefix}, b...))
+		level[i] = sum[:]
+	}
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			node := append([]byte{merkleNodePrefix}, level[i]...)
+			sum := sha256.Sum256(append(node, level[i+1]...))
+			next = append(next, sum[:])
+		}
+		level = next
+	}
+	return hex.EncodeToString(level[0]), nil
+}
+
+// accountEntries calls fn with every posting of an account in posting order
+// until fn returns false
+func accountEntries(
+	ctx contractapi.TransactionContextInterface, accountID string,
+	fn func(h *TransactionHistory, amount int64) bool,
+) error {
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(entryIndex, []string{accountID})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return err
+		}
+		_, parts, err := ctx.GetStub().SplitCompositeKey(res.Key)
+		if err != nil || len(parts) != 3 {
+			continue
+		}
+		h, err := getHistory(ctx, parts[2])
+		if err != nil {
+			return err
+		}
+		amount, err := strconv.ParseInt(h.Amount, 10, 64)
+		if err != nil {
+			return fmt.Errorf("history %s has invalid amount %q", h.HistoryHash, h.Amount)
+		}
+		if h.Type == entryDebit {
+			amount = -amount
+		}
+		if !fn(h, amount) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// ======================== Statement Methods ========================
+
+// Generate a statement for an account, anchor its Merkle root on the ledger
+// and charge the statement fee
+func (s *SmartContract) GenerateStatement(ctx contractapi.TransactionContextInterface, accountID string, from string, to string) (*Statement, error) {
+
+	a, err := getAccount(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountAccess(ctx, a); err != nil {
+		return nil, err
+	}
+	if _, err := parseDate(from); err != nil {
+		return nil, err
+	}
+	if _, err := parseDate(to); err != nil {
+		return nil, err
+	}
+	if from > to {
+		return nil, fmt.Errorf("from must not be after to")
+	}
+
+	st := &Statement{ID: newID(ctx, "STM"), AccountID: a.ID, From: from, To: to, Entries: []*StatementLine{}}
+	// Entries are in posting order, which need not be date order: postings
+	// made before the calendar was initialised carry the transaction date,
+	// which may be later than its start. Skip entries after the period
+	// rather than stopping, and open with every entry dated before it.
+	var amounts []int64
+	var leaves []string
+	err = accountEntries(ctx, a.ID, func(h *TransactionHistory, amount int64) bool {
+		if h.Date > to {
+			return true
+		}
+		if h.Date < from {
+			st.OpeningBalance += amount
+			return true
+		}
+		line := &StatementLine{
+			HistoryHash: h.HistoryHash,
+			Date:        h.Date,
+			Time:        h.Time,
+			Narrative:   h.Narrative,
+		}
+		if amount < 0 {
+			line.Debit = -amount
+		} else {
+			line.Credit = amount
+		}
+		st.Entries = append(st.Entries, line)
+		amounts = append(amounts, amount)
+		leaves = append(leaves, h.HistoryHash)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	balance := st.OpeningBalance
+	for i, line := range st.Entries {
+		balance += amounts[i]
+		line.RunningBalance = balance
+	}
+	st.ClosingBalance = balance
+
+	if st.MerkleRoot, err = merkleRoot(leaves); err != nil {
+		return nil, err
+	}
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	st.GeneratedBy, _ = getCallerCN(ctx)
+	st.GeneratedAt = now.Format(time.RFC3339)
+	// Charged after the statement is drawn up, so it appears on the next one
+	if err := chargeFee(ctx, a, feeStatement, feeChannel(ctx), 0); err != nil {
+		return nil, err
+	}
+
+	anchor := StatementAnchor{
+		ID:             st.ID,
+		AccountID:      st.AccountID,
+		From:           from,
+		To:             to,
+		OpeningBalance: st.OpeningBalance,
+		ClosingBalance: st.ClosingBalance,
+		EntryCount:     len(st.Entries),
+		MerkleRoot:     st.MerkleRoot,
+		GeneratedBy:    st.GeneratedBy,
+		GeneratedAt:    st.GeneratedAt,
+		TxID:           ctx.GetStub().GetTxID(),
+	}
+	key, err := makeKey(ctx, statementObjectType, st.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := putJSON(ctx, key, anchor); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Fetch the ledger anchor of a generated statement
+func (s *SmartContract) GetStatementAnchor(ctx contractapi.TransactionContextInterface, id string) (*StatementAnchor, error) {
+
+	key, err := makeKey(ctx, statementObjectType, id)
+	if err != nil {
+		return nil, err
+	}
+	var anchor StatementAnchor
+	found, err := getJSON(ctx, key, &anchor)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("statement %s not found", id)
+	}
+	a, err := getAccount(ctx, anchor.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAccountAccess(ctx, a); err != nil {
+		return nil, err
+	}
+	return &anchor, nil
+}
+
+// Check a printed statement: recompute the Merkle root of its entry hashes,
+// in statement order, and compare it with the anchored root. The statement
+// must list exactly as many entries as were anchored.
+func (s *SmartContract) VerifyStatement(ctx contractapi.TransactionContextInterface, id string, entryHashes []string) (bool, error) {
+
+	anchor, err := s.GetStatementAnchor(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	if len(entryHashes) != anchor.EntryCount {
+		return false, nil
+	}
+	root, err := merkleRoot(entryHashes)
+	if err != nil {
+		return false, err
+	}
+	return root == anchor.MerkleRoot, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestVerifyStatement(t *testing.T) {
+	l := newTestLedger(t)
+	l.openAccount("A1", "alice", 10000)
+	l.openAccount("B1", "bob", 0)
+	l.addBeneficiary("alice", "B1")
+	l.advance(2)
+	l.check(l.cc.Transfer(l.as("alice", "User"), "A1", "B1", 2500))
+	l.advance(1)
+	_, err := l.cc.Withdraw(l.staff(), "A1", 100)
+	l.check(err)
+	l.advance(1)
+	_, err = l.cc.Deposit(l.staff(), "A1", 7)
+	l.check(err)
+
+	st, err := l.cc.GenerateStatement(l.as("alice", "User"), "A1", "2025-08-02", "2025-08-05")
+	l.check(err)
+	if len(st.Entries) != 3 || st.OpeningBalance != 10000 || st.ClosingBalance != 7407 {
+		t.Fatalf("statement has %d entries from %d to %d", len(st.Entries), st.OpeningBalance, st.ClosingBalance)
+	}
+	e0, e1, e2 := st.Entries[0].HistoryHash, st.Entries[1].HistoryHash, st.Entries[2].HistoryHash
+	forged := sha256.Sum256([]byte("forged"))
+
+	// An inner node offered as a leaf must not reproduce the root
+	b0, _ := hex.DecodeString(e0)
+	b1, _ := hex.DecodeString(e1)
+	leaf0 := sha256.Sum256(append([]byte{merkleLeafPrefix}, b0...))
+	leaf1 := sha256.Sum256(append([]byte{merkleLeafPrefix}, b1...))
+	node := sha256.Sum256(append(append([]byte{merkleNodePrefix}, leaf0[:]...), leaf1[:]...))
+
+	tests := []struct {
+		name    string
+		caller  string
+		hashes  []string
+		want    bool
+		wantErr string
+	}{
+		{name: "statement order", caller: "alice", hashes: []string{e0, e1, e2}, want: true},
+		{name: "verified by staff", caller: "manager", hashes: []string{e0, e1, e2}, want: true},
+		{name: "reordered", caller: "alice", hashes: []string{e1, e0, e2}},
+		{name: "entry dropped", caller: "alice", hashes: []string{e0, e1}},
+		{name: "last entry repeated", caller: "alice", hashes: []string{e0, e1, e2, e2}},
+		{name: "entry replaced", caller: "alice", hashes: []string{e0, hex.EncodeToString(forged[:]), e2}},
+		{name: "inner node as a leaf", caller: "alice", hashes: []string{hex.EncodeToString(node[:]), e2}},
+		{name: "not a hash", caller: "alice", hashes: []string{e0, e1, "zz"}, wantErr: "invalid entry hash"},
+		{name: "another customer", caller: "bob", hashes: []string{e0, e1, e2}, wantErr: "access denied"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := l.as(tt.caller, "User")
+			if tt.caller == "manager" {
+				ctx = l.staff()
+			}
+			ok, err := l.cc.VerifyStatement(ctx, st.ID, tt.hashes)
+			if tt.wantErr != "" {
+				l.checkFails(err, tt.wantErr)
+				return
+			}
+			l.check(err)
+			if ok != tt.want {
+				t.Fatalf("verified %v, want %v", ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestMerkleRoot(t *testing.T) {
+	a := sha256.Sum256([]byte("a"))
+	b := sha256.Sum256([]byte("b"))
+	ha, hb := hex.EncodeToString(a[:]), hex.EncodeToString(b[:])
+	empty := sha256.Sum256(nil)
+
+	tests := []struct {
+		name    string
+		leaves  []string
+		same    []string
+		differ  []string
+		wantErr bool
+	}{
+		{name: "no leaves", leaves: nil, same: nil},
+		{name: "one leaf is not its own root", leaves: []string{ha}, differ: []string{hb}},
+		{name: "order matters", leaves: []string{ha, hb}, differ: []string{hb, ha}},
+		{name: "odd leaf is promoted, not duplicated", leaves: []string{ha, hb, ha}, differ: []string{ha, hb, ha, ha}},
+		{name: "upper case hex is the same leaf", leaves: []string{ha}, same: []string{strings.ToUpper(ha)}},
+		{name: "short leaf", leaves: []string{ha[:62]}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, err := merkleRoot(tt.leaves)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tt.leaves) == 1 && root == tt.leaves[0] {
+				t.Fatal("a single leaf is its own root")
+			}
+			if tt.leaves == nil && root != hex.EncodeToString(empty[:]) {
+				t.Fatalf("root of no leaves is %s", root)
+			}
+			if tt.differ != nil {
+				other, err := merkleRoot(tt.differ)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if other == root {
+					t.Fatalf("%v and %v share root %s", tt.leaves, tt.differ, root)
+				}
+			}
+			if tt.same != nil {
+				other, err := merkleRoot(tt.same)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if other != root {
+					t.Fatalf("%v and %v have different roots", tt.leaves, tt.same)
+				}
+			}
+		})
+	}
+}
+
+// TestStatementOutOfDateOrder posts before the calendar starts, so a posting
+// dated after the period comes before ones inside it
+func TestStatementOutOfDateOrder(t *testing.T) {
+	l := newTestLedger(t)
+	l.advance(9)
+	l.openAccount("A1", "alice", 500) // dated 2025-08-10
+	_, err := l.cc.InitBusinessCalendar(l.as("admin", "Admin"), "2025-08-04")
+	l.check(err)
+	_, err = l.cc.Deposit(l.staff(), "A1", 200)
+	l.check(err)
+	_, err = l.cc.Withdraw(l.staff(), "A1", 50)
+	l.check(err)
+
+	st, err := l.cc.GenerateStatement(l.as("alice", "User"), "A1", "2025-08-04", "2025-08-04")
+	l.check(err)
+	if len(st.Entries) != 2 || st.OpeningBalance != 0 || st.ClosingBalance != 150 {
+		t.Fatalf("statement has %d entries from %d to %d", len(st.Entries), st.OpeningBalance, st.ClosingBalance)
+	}
+	if st.Entries[0].RunningBalance != 200 || st.Entries[1].RunningBalance != 150 {
+		t.Fatalf("running balances %d and %d", st.Entries[0].RunningBalance, st.Entries[1].RunningBalance)
+	}
+}